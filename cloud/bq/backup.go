@@ -0,0 +1,159 @@
+package bq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/googleapis/google-cloud-go-testing/bigquery/bqiface"
+	"github.com/m-lab/go/cloud/bqx"
+	"github.com/m-lab/go/dataset"
+
+	"github.com/m-lab/etl-gardener/config"
+)
+
+// ErrNoBackup is returned by Rollback when a partition has no backup.
+var ErrNoBackup = errors.New("no backup")
+
+// Backup describes where partitions are backed up before they are replaced
+// by CopyToRaw and Join, and how long the backups are kept.
+type Backup struct {
+	Dataset   string        // Backups are disabled if empty.
+	Retention time.Duration // Zero means backups do not expire.
+}
+
+var (
+	backupLock sync.Mutex
+	backup     Backup
+)
+
+// SetBackup sets the Backup used by all TableOps created afterwards.
+func SetBackup(b Backup) {
+	backupLock.Lock()
+	defer backupLock.Unlock()
+	backup = b
+}
+
+// SetBackupFromConfig sets the Backup from the config.
+func SetBackupFromConfig(c config.BackupConfig) {
+	SetBackup(Backup{Dataset: c.Dataset, Retention: c.Retention})
+}
+
+func currentBackup() Backup {
+	backupLock.Lock()
+	defer backupLock.Unlock()
+	return backup
+}
+
+// BackupTable returns the table that the job's partition of pdt is backed up
+// to.  Each date has its own backup table, holding the partition as it was
+// before the most recent copy or join.
+func (to TableOps) BackupTable(pdt bqx.PDT) bqx.PDT {
+	return bqx.PDT{
+		Project: pdt.Project,
+		Dataset: to.Backup.Dataset,
+		Table:   fmt.Sprintf("%s_%s_%s", pdt.Dataset, pdt.Table, to.Job.Date.Format("20060102")),
+	}
+}
+
+// runCopy copies src to dest, replacing dest, and waits for the copy job.
+func runCopy(ctx context.Context, src, dest bqiface.Table) error {
+	copier := dest.CopierFrom(src)
+	config := bqiface.CopyConfig{}
+	config.WriteDisposition = bigquery.WriteTruncate
+	config.CreateDisposition = bigquery.CreateIfNeeded
+	config.Dst = dest
+	config.Srcs = append(config.Srcs, src)
+	copier.SetCopyConfig(config)
+	job, err := copier.Run(ctx)
+	if err != nil {
+		return err
+	}
+	status, err := job.Wait(ctx)
+	if err != nil {
+		return err
+	}
+	return status.Err()
+}
+
+// backupPartition copies the job's partition of pdt to its backup table,
+// before the partition is replaced.  It does nothing if backups are disabled,
+// if the table does not exist yet, or if the backup was written since
+// BackupSince, by an earlier attempt.
+func (to TableOps) backupPartition(ctx context.Context, pdt bqx.PDT) error {
+	if to.Backup.Dataset == "" {
+		return nil
+	}
+	if _, err := to.table(pdt, false).Metadata(ctx); isNotFound(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	bpdt := to.BackupTable(pdt)
+	if !to.BackupSince.IsZero() {
+		meta, err := to.table(bpdt, false).Metadata(ctx)
+		if err != nil && !isNotFound(err) {
+			return err
+		}
+		if err == nil && !meta.LastModifiedTime.Before(to.BackupSince) {
+			log.Println(to.Job, "already backed up to", bpdt.Dataset+"."+bpdt.Table)
+			return nil
+		}
+	}
+	err := to.client.DatasetInProject(bpdt.Project, bpdt.Dataset).Create(ctx, &bqiface.DatasetMetadata{})
+	if err != nil && !isAlreadyExists(err) {
+		return err
+	}
+	dest := to.table(bpdt, false)
+	if err := runCopy(ctx, to.table(pdt, true), dest); err != nil {
+		return fmt.Errorf("backup of %s failed: %w", pdt.Dataset+"."+pdt.Table, err)
+	}
+	if to.Backup.Retention > 0 {
+		update := bigquery.TableMetadataToUpdate{ExpirationTime: time.Now().Add(to.Backup.Retention)}
+		if _, err := dest.Update(ctx, update, ""); err != nil {
+			return err
+		}
+	}
+	log.Println("Backed up", to.Job, "to", dest.FullyQualifiedName())
+	return nil
+}
+
+// restorePartition copies the backup of the job's partition of pdt back to
+// the partition.
+func (to TableOps) restorePartition(ctx context.Context, pdt bqx.PDT) error {
+	src := to.table(to.BackupTable(pdt), false)
+	if _, err := src.Metadata(ctx); isNotFound(err) {
+		return fmt.Errorf("%w: %s", ErrNoBackup, src.FullyQualifiedName())
+	} else if err != nil {
+		return err
+	}
+	dest := to.table(pdt, true)
+	if err := runCopy(ctx, src, dest); err != nil {
+		return err
+	}
+	log.Println("Restored", dest.FullyQualifiedName(), "from", src.FullyQualifiedName())
+	return nil
+}
+
+// Rollback restores the job's raw partition, and its joined partition if the
+// datatype is joined, from the backups made by the most recent CopyToRaw and
+// Join.
+func (to TableOps) Rollback(ctx context.Context) error {
+	if to.client == nil {
+		return dataset.ErrNilBqClient
+	}
+	if to.Backup.Dataset == "" {
+		return fmt.Errorf("%w: backups are disabled", ErrNoBackup)
+	}
+	if err := to.restorePartition(ctx, to.Tables.Raw); err != nil {
+		return err
+	}
+	if to.NeedsJoin {
+		return to.restorePartition(ctx, to.Tables.Joined)
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package bq_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/go-test/deep"
+
+	"github.com/m-lab/etl-gardener/cloud/bq"
+	"github.com/m-lab/etl-gardener/config"
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+func TestBackupAndRollback(t *testing.T) {
+	bq.SetBackupFromConfig(config.BackupConfig{Dataset: "backup", Retention: 24 * time.Hour})
+	defer bq.SetBackup(bq.Backup{})
+
+	client := &fakeClient{tables: map[string]*bigquery.TableMetadata{
+		"raw_ndt.annotation": {},
+	}}
+	job := tracker.NewJob("bucket", "ndt", "annotation", time.Date(2020, 9, 5, 0, 0, 0, 0, time.UTC))
+	to, err := bq.NewTableOpsWithClient(client, job, "proj", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err := to.Rollback(ctx); !errors.Is(err, bq.ErrNoBackup) {
+		t.Error("Expected ErrNoBackup:", err)
+	}
+
+	if _, err := to.CopyToRaw(ctx, false); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"raw_ndt.annotation$20200905 -> backup.raw_ndt_annotation_20200905",
+		"tmp_ndt.annotation$20200905 -> raw_ndt.annotation$20200905",
+	}
+	if diff := deep.Equal(client.copies, want); diff != nil {
+		t.Error(diff)
+	}
+	backup := client.tables["backup.raw_ndt_annotation_20200905"]
+	if backup == nil || time.Until(backup.ExpirationTime) < 23*time.Hour {
+		t.Errorf("Bad backup table: %+v", backup)
+	}
+
+	client.copies = nil
+	if err := to.Rollback(ctx); err != nil {
+		t.Fatal(err)
+	}
+	want = []string{"backup.raw_ndt_annotation_20200905 -> raw_ndt.annotation$20200905"}
+	if diff := deep.Equal(client.copies, want); diff != nil {
+		t.Error(diff)
+	}
+
+	// Without backups, nothing is backed up.
+	to.Backup = bq.Backup{}
+	client.copies = nil
+	if _, err := to.CopyToRaw(ctx, false); err != nil {
+		t.Fatal(err)
+	}
+	if len(client.copies) != 1 {
+		t.Error("Expected copy without backup:", client.copies)
+	}
+	if err := to.Rollback(ctx); !errors.Is(err, bq.ErrNoBackup) {
+		t.Error("Expected ErrNoBackup:", err)
+	}
+}
+
+func TestBackup_RetryAfterCopy(t *testing.T) {
+	bq.SetBackupFromConfig(config.BackupConfig{Dataset: "backup"})
+	defer bq.SetBackup(bq.Backup{})
+
+	client := &fakeClient{tables: map[string]*bigquery.TableMetadata{
+		"raw_ndt.annotation": {},
+		// A backup left by an earlier copy of the same date.
+		"backup.raw_ndt_annotation_20200905": {LastModifiedTime: time.Now().Add(-24 * time.Hour)},
+	}}
+	job := tracker.NewJob("bucket", "ndt", "annotation", time.Date(2020, 9, 5, 0, 0, 0, 0, time.UTC))
+	to, err := bq.NewTableOpsWithClient(client, job, "proj", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	to.BackupSince = time.Now().Add(-time.Minute)
+	ctx := context.Background()
+
+	// The first attempt replaces the old backup.
+	if _, err := to.CopyToRaw(ctx, false); err != nil {
+		t.Fatal(err)
+	}
+	// The copy landed, but the attempt is retried, e.g. because waiting for
+	// the copy job failed.  The retry must not back up the new partition.
+	if _, err := to.CopyToRaw(ctx, false); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"raw_ndt.annotation$20200905 -> backup.raw_ndt_annotation_20200905",
+		"tmp_ndt.annotation$20200905 -> raw_ndt.annotation$20200905",
+		"tmp_ndt.annotation$20200905 -> raw_ndt.annotation$20200905",
+	}
+	if diff := deep.Equal(client.copies, want); diff != nil {
+		t.Error(diff)
+	}
+}
@@ -0,0 +1,213 @@
+package bq
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"cloud.google.com/go/bigquery"
+
+	"github.com/m-lab/etl-gardener/config"
+)
+
+// Datatype describes the table properties that TableOps needs to process
+// a particular datatype.
+type Datatype struct {
+	Name string
+	// map key is the single field name, value is fully qualified name
+	PartitionKeys map[string]string
+	OrderKeys     string
+	DateField     string              // Name of the partition field
+	SourceFormat  bigquery.DataFormat // Format of the files in LoadSource
+	Join          bool                // Whether the raw table must be joined with annotations.
+	Load          LoadOptions
+	Schema        SchemaOptions
+	Validation    Validation
+}
+
+// LoadOptions control how files in the SourceFormat are loaded.
+type LoadOptions struct {
+	Compression         bigquery.Compression
+	SchemaUpdateOptions []string // e.g. ALLOW_FIELD_ADDITION
+	MaxBadRecords       int64    // Number of bad records allowed before the load fails.
+	SkipLeadingRows     int64    // CSV header rows.
+}
+
+// Schema update options.
+const (
+	AllowFieldAddition   = "ALLOW_FIELD_ADDITION"
+	AllowFieldRelaxation = "ALLOW_FIELD_RELAXATION"
+)
+
+// AllowsFieldAddition returns true if loads may add new fields to the table.
+func (lo LoadOptions) AllowsFieldAddition() bool {
+	for _, opt := range lo.SchemaUpdateOptions {
+		if opt == AllowFieldAddition {
+			return true
+		}
+	}
+	return false
+}
+
+// ErrInvalidDatatype is returned when a Datatype description is incomplete.
+var ErrInvalidDatatype = errors.New("invalid datatype description")
+
+// The registry is initialized with the datatypes that were historically
+// hard-coded.  Others may be added from config with RegisterDatatype.
+var (
+	registryLock sync.Mutex
+	registry     = map[string]Datatype{
+		"annotation": {
+			Name:          "annotation",
+			PartitionKeys: map[string]string{"id": "id"},
+			DateField:     "date",
+			SourceFormat:  bigquery.JSON,
+			Join:          false,
+		},
+		"ndt7": {
+			Name:          "ndt7",
+			PartitionKeys: map[string]string{"id": "id"},
+			DateField:     "date",
+			SourceFormat:  bigquery.JSON,
+			Join:          true,
+		},
+	}
+)
+
+// RegisterDatatype adds or replaces a Datatype in the registry.
+func RegisterDatatype(dt Datatype) error {
+	if dt.Name == "" || dt.DateField == "" || len(dt.PartitionKeys) == 0 {
+		return fmt.Errorf("%w: %+v", ErrInvalidDatatype, dt)
+	}
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	registry[dt.Name] = dt
+	return nil
+}
+
+// LookupDatatype returns the registered Datatype with the given name.
+func LookupDatatype(name string) (Datatype, bool) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	dt, ok := registry[name]
+	return dt, ok
+}
+
+// Datatypes returns the names of all registered datatypes, in sorted order.
+func Datatypes() []string {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ParseSourceFormat converts a config format name to a bigquery.DataFormat.
+// An empty string defaults to newline delimited JSON.
+func ParseSourceFormat(format string) (bigquery.DataFormat, error) {
+	switch strings.ToLower(format) {
+	case "", "json":
+		return bigquery.JSON, nil
+	case "avro":
+		return bigquery.Avro, nil
+	case "parquet":
+		return bigquery.Parquet, nil
+	case "csv":
+		return bigquery.CSV, nil
+	default:
+		return "", fmt.Errorf("%w: unknown source format %q", ErrInvalidDatatype, format)
+	}
+}
+
+// compressions lists the compressions that may be used with each format.
+var compressions = map[bigquery.DataFormat][]bigquery.Compression{
+	bigquery.JSON: {bigquery.None, bigquery.Gzip},
+	bigquery.CSV:  {bigquery.None, bigquery.Gzip},
+	bigquery.Avro: {bigquery.None, bigquery.Deflate, bigquery.Snappy},
+	// Parquet files are compressed internally.
+	bigquery.Parquet: {bigquery.None},
+}
+
+// ParseLoadOptions converts the load options of a datatype config, and checks
+// that they are valid for the format.
+func ParseLoadOptions(c config.DatatypeConfig, format bigquery.DataFormat) (LoadOptions, error) {
+	lo := LoadOptions{
+		Compression:     bigquery.Compression(strings.ToUpper(c.Compression)),
+		MaxBadRecords:   c.MaxBadRecords,
+		SkipLeadingRows: c.SkipLeadingRows,
+	}
+	if lo.Compression == "" {
+		lo.Compression = bigquery.None
+	}
+	valid := false
+	for _, comp := range compressions[format] {
+		valid = valid || lo.Compression == comp
+	}
+	if !valid {
+		return lo, fmt.Errorf("%w: compression %q not supported for %s", ErrInvalidDatatype, c.Compression, format)
+	}
+	if lo.SkipLeadingRows != 0 && format != bigquery.CSV {
+		return lo, fmt.Errorf("%w: skip_leading_rows requires csv", ErrInvalidDatatype)
+	}
+	for _, opt := range c.SchemaUpdateOptions {
+		opt = strings.ToUpper(opt)
+		if opt != AllowFieldAddition && opt != AllowFieldRelaxation {
+			return lo, fmt.Errorf("%w: unknown schema update option %q", ErrInvalidDatatype, opt)
+		}
+		lo.SchemaUpdateOptions = append(lo.SchemaUpdateOptions, opt)
+	}
+	return lo, nil
+}
+
+// DatatypeFromConfig creates a Datatype from its config description.
+func DatatypeFromConfig(c config.DatatypeConfig) (Datatype, error) {
+	format, err := ParseSourceFormat(c.SourceFormat)
+	if err != nil {
+		return Datatype{}, err
+	}
+	load, err := ParseLoadOptions(c, format)
+	if err != nil {
+		return Datatype{}, err
+	}
+	schema, err := ParseSchemaOptions(c)
+	if err != nil {
+		return Datatype{}, err
+	}
+	dt := Datatype{
+		Name:          c.Name,
+		PartitionKeys: c.PartitionKeys,
+		OrderKeys:     c.OrderKeys,
+		DateField:     c.DateField,
+		SourceFormat:  format,
+		Join:          c.Join,
+		Load:          load,
+		Schema:        schema,
+		Validation:    Validation(c.Validation),
+	}
+	if dt.DateField == "" {
+		dt.DateField = "date"
+	}
+	if len(dt.PartitionKeys) == 0 {
+		dt.PartitionKeys = map[string]string{"id": "id"}
+	}
+	return dt, nil
+}
+
+// RegisterDatatypes registers all the datatypes described in the config.
+func RegisterDatatypes(configs []config.DatatypeConfig) error {
+	for _, c := range configs {
+		dt, err := DatatypeFromConfig(c)
+		if err != nil {
+			return err
+		}
+		if err := RegisterDatatype(dt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package bq_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/go-test/deep"
+
+	"github.com/m-lab/etl-gardener/cloud/bq"
+	"github.com/m-lab/etl-gardener/config"
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+func TestNewTableOpsWithClient(t *testing.T) {
+	job := tracker.NewJob("bucket", "ndt", "newtype", time.Date(2019, 3, 4, 0, 0, 0, 0, time.UTC))
+	_, err := bq.NewTableOpsWithClient(nil, job, "fake-project", "")
+	if err != bq.ErrDatatypeNotSupported {
+		t.Fatal("Expected ErrDatatypeNotSupported:", err)
+	}
+
+	err = bq.RegisterDatatypes([]config.DatatypeConfig{
+		{Name: "newtype", PartitionKeys: map[string]string{"id": "id"}, SourceFormat: "parquet", Join: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bq.UnregisterDatatype("newtype")
+	to, err := bq.NewTableOpsWithClient(nil, job, "fake-project", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if to.Date != "date" || to.SourceFormat != bigquery.Parquet || !to.NeedsJoin {
+		t.Errorf("Bad TableOps: %+v", to)
+	}
+	qs := bq.DedupQuery(*to)
+	if !strings.Contains(qs, "`fake-project.tmp_ndt.newtype`") {
+		t.Error("query should contain tmp_ndt.newtype:\n", qs)
+	}
+
+	job.Datatype = "annotation"
+	to, err = bq.NewTableOpsWithClient(nil, job, "fake-project", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if to.NeedsJoin {
+		t.Error("annotation should not require join")
+	}
+}
+
+func TestDatatypeFromConfig(t *testing.T) {
+	_, err := bq.DatatypeFromConfig(config.DatatypeConfig{Name: "foo", SourceFormat: "xml"})
+	if !errors.Is(err, bq.ErrInvalidDatatype) {
+		t.Error("Expected ErrInvalidDatatype:", err)
+	}
+	err = bq.RegisterDatatype(bq.Datatype{Name: "foo"})
+	if !errors.Is(err, bq.ErrInvalidDatatype) {
+		t.Error("Expected ErrInvalidDatatype:", err)
+	}
+	if _, ok := bq.LookupDatatype("foo"); ok {
+		t.Error("foo should not be registered")
+	}
+}
+
+func TestParseLoadOptions(t *testing.T) {
+	tests := []struct {
+		name    string
+		c       config.DatatypeConfig
+		want    bq.LoadOptions
+		wantErr bool
+	}{
+		{
+			name: "defaults",
+			c:    config.DatatypeConfig{Name: "foo"},
+			want: bq.LoadOptions{Compression: bigquery.None},
+		},
+		{
+			name: "json",
+			c: config.DatatypeConfig{Name: "foo", Compression: "gzip", MaxBadRecords: 10,
+				SchemaUpdateOptions: []string{"allow_field_addition"}},
+			want: bq.LoadOptions{Compression: bigquery.Gzip, MaxBadRecords: 10,
+				SchemaUpdateOptions: []string{bq.AllowFieldAddition}},
+		},
+		{
+			name: "csv",
+			c:    config.DatatypeConfig{Name: "foo", SourceFormat: "csv", SkipLeadingRows: 1},
+			want: bq.LoadOptions{Compression: bigquery.None, SkipLeadingRows: 1},
+		},
+		{
+			name:    "bad-compression",
+			c:       config.DatatypeConfig{Name: "foo", SourceFormat: "parquet", Compression: "gzip"},
+			wantErr: true,
+		},
+		{
+			name:    "bad-skip",
+			c:       config.DatatypeConfig{Name: "foo", SkipLeadingRows: 1},
+			wantErr: true,
+		},
+		{
+			name:    "bad-option",
+			c:       config.DatatypeConfig{Name: "foo", SchemaUpdateOptions: []string{"ALLOW_ANYTHING"}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dt, err := bq.DatatypeFromConfig(tt.c)
+			if tt.wantErr {
+				if !errors.Is(err, bq.ErrInvalidDatatype) {
+					t.Error("Expected ErrInvalidDatatype:", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := deep.Equal(dt.Load, tt.want); diff != nil {
+				t.Error(diff)
+			}
+			if dt.Load.AllowsFieldAddition() != (len(tt.want.SchemaUpdateOptions) > 0) {
+				t.Error("Bad AllowsFieldAddition")
+			}
+		})
+	}
+}
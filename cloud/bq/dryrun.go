@@ -0,0 +1,63 @@
+package bq
+
+import (
+	"context"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/googleapis/google-cloud-go-testing/bigquery/bqiface"
+)
+
+// dryRunJob is a completed dry run job.  The BigQuery client only supports
+// dry runs of queries, and dry run query jobs cannot be waited on, so load,
+// copy and query dry runs all return a dryRunJob.  Its status statistics
+// hold the estimated bytes processed.
+type dryRunJob struct {
+	bqiface.Job // nil; methods other than those below are not supported.
+	status      *bigquery.JobStatus
+}
+
+func newDryRunJob(bytes int64, details bigquery.Statistics) *dryRunJob {
+	return &dryRunJob{status: &bigquery.JobStatus{
+		State: bigquery.Done,
+		Statistics: &bigquery.JobStatistics{
+			TotalBytesProcessed: bytes,
+			Details:             details,
+		},
+	}}
+}
+
+// queryDryRunJob converts the job returned by a dry run query.
+func queryDryRunJob(job bqiface.Job) *dryRunJob {
+	if job != nil && job.LastStatus() != nil && job.LastStatus().Statistics != nil {
+		return &dryRunJob{status: job.LastStatus()}
+	}
+	return newDryRunJob(0, &bigquery.QueryStatistics{})
+}
+
+func (j *dryRunJob) ID() string {
+	return "dryrun"
+}
+
+func (j *dryRunJob) LastStatus() *bigquery.JobStatus {
+	return j.status
+}
+
+func (j *dryRunJob) Status(context.Context) (*bigquery.JobStatus, error) {
+	return j.status, nil
+}
+
+func (j *dryRunJob) Wait(context.Context) (*bigquery.JobStatus, error) {
+	return j.status, nil
+}
+
+// EstimatedBytes returns the bytes that a dry run job estimated it would
+// process.
+func EstimatedBytes(status *bigquery.JobStatus) int64 {
+	if status == nil || status.Statistics == nil {
+		return 0
+	}
+	if qs, ok := status.Statistics.Details.(*bigquery.QueryStatistics); ok && qs.TotalBytesProcessed > 0 {
+		return qs.TotalBytesProcessed
+	}
+	return status.Statistics.TotalBytesProcessed
+}
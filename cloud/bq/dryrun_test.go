@@ -0,0 +1,30 @@
+package bq_test
+
+import (
+	"context"
+	"testing"
+
+	"cloud.google.com/go/bigquery"
+
+	"github.com/m-lab/etl-gardener/cloud/bq"
+)
+
+func TestDryRunJob(t *testing.T) {
+	j := bq.NewDryRunJob(1000, &bigquery.LoadStatistics{})
+	status, err := j.Wait(context.Background())
+	if err != nil || status.State != bigquery.Done || status.Err() != nil {
+		t.Fatal("Dry run job should be done:", status, err)
+	}
+	if b := bq.EstimatedBytes(status); b != 1000 {
+		t.Error("Wrong estimate:", b)
+	}
+
+	// Query dry runs report the bytes in the query statistics.
+	j = bq.NewDryRunJob(0, &bigquery.QueryStatistics{TotalBytesProcessed: 2000})
+	if b := bq.EstimatedBytes(j.LastStatus()); b != 2000 {
+		t.Error("Wrong estimate:", b)
+	}
+	if b := bq.EstimatedBytes(nil); b != 0 {
+		t.Error("Wrong estimate:", b)
+	}
+}
@@ -6,3 +6,22 @@ var DedupQuery = dedupQuery
 func JoinQuery(to TableOps) string {
 	return to.makeQuery(joinTemplate)
 }
+
+var NewDryRunJob = newDryRunJob
+
+// StatsQuery returns the validation statistics query.
+func StatsQuery(to TableOps) string {
+	return to.statsQuery()
+}
+
+// RowCountQuery returns the neighbouring partition row count query.
+func RowCountQuery(to TableOps) string {
+	return to.rowCountQuery()
+}
+
+// UnregisterDatatype removes a datatype registered by a test.
+func UnregisterDatatype(name string) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	delete(registry, name)
+}
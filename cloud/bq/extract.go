@@ -0,0 +1,131 @@
+package bq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"cloud.google.com/go/storage"
+	"github.com/googleapis/google-cloud-go-testing/bigquery/bqiface"
+	"github.com/googleapis/google-cloud-go-testing/storage/stiface"
+	"github.com/m-lab/go/cloud/gcs"
+	"github.com/m-lab/go/dataset"
+)
+
+// Errors returned by Export and VerifyExport.
+var (
+	ErrNoExport         = errors.New("no export configured")
+	ErrExportIncomplete = errors.New("export incomplete")
+)
+
+// fileExtensions are the extensions of exported files, by format.
+var fileExtensions = map[bigquery.DataFormat]string{
+	bigquery.JSON:    "json",
+	bigquery.Avro:    "avro",
+	bigquery.Parquet: "parquet",
+}
+
+// ExportPrefix returns the gs://bucket/prefix/ that the job's partition is
+// exported to, e.g. gs://bucket/prefix/ndt7/2020/09/05/
+func (to TableOps) ExportPrefix() string {
+	return fmt.Sprintf("%s/%s/%s", to.Tables.Export, to.Job.Datatype, to.Job.Date.Format("2006/01/02/"))
+}
+
+// exportURI returns the wildcard URI of the exported files.
+func (to TableOps) exportURI() string {
+	ext, ok := fileExtensions[to.Tables.ExportFormat]
+	if !ok {
+		ext = fileExtensions[bigquery.JSON]
+	}
+	return to.ExportPrefix() + to.Job.Datatype + "-*." + ext
+}
+
+// Export exports the job's partition of the final table, which is the joined
+// table if the datatype needs a join, and the raw table otherwise, to the
+// source's export prefix.  The BigQuery client does not support dry run
+// extract jobs, so if dryRun is true, the source table is checked, and the
+// estimated bytes are the size of the source partition.
+func (to TableOps) Export(ctx context.Context, dryRun bool) (bqiface.Job, error) {
+	if to.Tables.Export == "" {
+		return nil, ErrNoExport
+	}
+	if to.client == nil {
+		return nil, dataset.ErrNilBqClient
+	}
+	src := to.table(to.finalTable(), true)
+
+	gcsRef := bigquery.NewGCSReference(to.exportURI())
+	gcsRef.DestinationFormat = to.Tables.ExportFormat
+	if gcsRef.DestinationFormat == "" {
+		gcsRef.DestinationFormat = bigquery.JSON
+	}
+	extractor := src.ExtractorTo(gcsRef)
+	config := bqiface.ExtractConfig{}
+	config.Dst = gcsRef
+	config.Src = src
+	extractor.SetExtractConfig(config)
+
+	if dryRun {
+		meta, err := src.Metadata(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return newDryRunJob(meta.NumBytes, &bigquery.ExtractStatistics{}), nil
+	}
+	return extractor.Run(ctx)
+}
+
+// VerifyExport checks that the files reported by a completed export job are
+// present in GCS, and returns the number of files and bytes exported.  Only
+// files written since the export job started are counted.  Once the export
+// is complete, older files under the prefix, left by earlier exports of the
+// partition, are deleted.
+func (to TableOps) VerifyExport(ctx context.Context, sClient stiface.Client, status *bigquery.JobStatus) (int, int64, error) {
+	var want int64
+	var started time.Time
+	if status != nil && status.Statistics != nil {
+		started = status.Statistics.StartTime
+		if es, ok := status.Statistics.Details.(*bigquery.ExtractStatistics); ok {
+			for _, n := range es.DestinationURIFileCounts {
+				want += n
+			}
+		}
+	}
+	if want == 0 {
+		return 0, 0, fmt.Errorf("%w: no files reported", ErrExportIncomplete)
+	}
+	parts := strings.SplitN(strings.TrimPrefix(to.ExportPrefix(), "gs://"), "/", 2)
+	bh, err := gcs.GetBucket(ctx, sClient, parts[0])
+	if err != nil {
+		return 0, 0, err
+	}
+	all, _, err := bh.GetFilesSince(ctx, parts[1], nil, time.Time{})
+	if err != nil {
+		return 0, 0, err
+	}
+	var bytes int64
+	var files, stale []*storage.ObjectAttrs
+	for _, o := range all {
+		if o.Updated.Before(started) {
+			stale = append(stale, o)
+			continue
+		}
+		files = append(files, o)
+		bytes += o.Size
+	}
+	if int64(len(files)) < want {
+		return len(files), bytes, fmt.Errorf("%w: found %d of %d files in %s",
+			ErrExportIncomplete, len(files), want, to.ExportPrefix())
+	}
+	for _, o := range stale {
+		if err := bh.Object(o.Name).Delete(ctx); err != nil {
+			return len(files), bytes, err
+		}
+		log.Println(to.Job, "deleted stale export file", o.Name)
+	}
+	return len(files), bytes, nil
+}
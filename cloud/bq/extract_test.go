@@ -0,0 +1,193 @@
+package bq_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"cloud.google.com/go/storage"
+	"github.com/googleapis/google-cloud-go-testing/storage/stiface"
+	"github.com/m-lab/go/cloudtest/gcsfake"
+
+	"github.com/m-lab/etl-gardener/cloud/bq"
+	"github.com/m-lab/etl-gardener/config"
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+func TestTablesFromConfig_Export(t *testing.T) {
+	src := config.SourceConfig{Experiment: "ndt", Datatype: "ndt7", Export: "gs://bucket/prefix/", ExportFormat: "avro"}
+	tables, err := bq.TablesFromConfig(src, "proj")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tables.Export != "gs://bucket/prefix" || tables.ExportFormat != bigquery.Avro {
+		t.Errorf("Bad export: %+v", tables)
+	}
+
+	src.ExportFormat = "csv"
+	if _, err := bq.TablesFromConfig(src, "proj"); !errors.Is(err, bq.ErrInvalidExport) {
+		t.Error("Expected ErrInvalidExport:", err)
+	}
+	src.ExportFormat = ""
+	src.Export = "bucket/prefix"
+	if _, err := bq.TablesFromConfig(src, "proj"); !errors.Is(err, bq.ErrInvalidExport) {
+		t.Error("Expected ErrInvalidExport:", err)
+	}
+}
+
+func TestVerifyExport(t *testing.T) {
+	err := bq.RegisterSourceTables([]config.SourceConfig{
+		{Experiment: "export", Datatype: "ndt7", Export: "gs://fake-bucket/daily"},
+	}, "proj")
+	if err != nil {
+		t.Fatal(err)
+	}
+	job := tracker.NewJob("bucket", "export", "ndt7", time.Date(2020, 9, 5, 0, 0, 0, 0, time.UTC))
+	to, err := bq.NewTableOpsWithClient(nil, job, "proj", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if to.ExportPrefix() != "gs://fake-bucket/daily/ndt7/2020/09/05/" {
+		t.Error("Bad export prefix:", to.ExportPrefix())
+	}
+	if _, err := to.Export(context.Background(), false); err == nil {
+		t.Error("Expected error for nil client")
+	}
+
+	fc := gcsfake.GCSClient{}
+	fc.AddTestBucket("fake-bucket",
+		&gcsfake.BucketHandle{
+			ObjAttrs: []*storage.ObjectAttrs{
+				{Name: "daily/ndt7/2020/09/05/ndt7-000000000000.json", Size: 100, Updated: time.Now()},
+				{Name: "daily/ndt7/2020/09/05/ndt7-000000000001.json", Size: 200, Updated: time.Now()},
+				{Name: "daily/ndt7/2020/09/06/ndt7-000000000000.json", Size: 400, Updated: time.Now()},
+			}})
+	status := func(counts ...int64) *bigquery.JobStatus {
+		return &bigquery.JobStatus{Statistics: &bigquery.JobStatistics{
+			Details: &bigquery.ExtractStatistics{DestinationURIFileCounts: counts}}}
+	}
+	ctx := context.Background()
+	files, bytes, err := to.VerifyExport(ctx, &fc, status(2))
+	if err != nil || files != 2 || bytes != 300 {
+		t.Error("Expected 2 files with 300 bytes:", files, bytes, err)
+	}
+	if _, _, err := to.VerifyExport(ctx, &fc, status(3)); !errors.Is(err, bq.ErrExportIncomplete) {
+		t.Error("Expected ErrExportIncomplete:", err)
+	}
+	if _, _, err := to.VerifyExport(ctx, &fc, status()); !errors.Is(err, bq.ErrExportIncomplete) {
+		t.Error("Expected ErrExportIncomplete:", err)
+	}
+
+	job.Experiment = "other"
+	to, err = bq.NewTableOpsWithClient(nil, job, "proj", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := to.Export(ctx, false); err != bq.ErrNoExport {
+		t.Error("Expected ErrNoExport:", err)
+	}
+}
+
+// deletingBucket records the objects deleted from a fake bucket.
+type deletingBucket struct {
+	*gcsfake.BucketHandle
+	deleted []string
+}
+
+func (b *deletingBucket) Object(name string) stiface.ObjectHandle {
+	return &deletingObject{ObjectHandle: b.BucketHandle.Object(name), bucket: b, name: name}
+}
+
+type deletingObject struct {
+	stiface.ObjectHandle
+	bucket *deletingBucket
+	name   string
+}
+
+func (o *deletingObject) Delete(ctx context.Context) error {
+	o.bucket.deleted = append(o.bucket.deleted, o.name)
+	return nil
+}
+
+type deletingClient struct {
+	stiface.Client
+	bucket *deletingBucket
+}
+
+func (c *deletingClient) Bucket(name string) stiface.BucketHandle {
+	return c.bucket
+}
+
+func TestVerifyExport_StaleFiles(t *testing.T) {
+	err := bq.RegisterSourceTables([]config.SourceConfig{
+		{Experiment: "export", Datatype: "ndt7", Export: "gs://fake-bucket/daily"},
+	}, "proj")
+	if err != nil {
+		t.Fatal(err)
+	}
+	job := tracker.NewJob("bucket", "export", "ndt7", time.Date(2020, 9, 5, 0, 0, 0, 0, time.UTC))
+	to, err := bq.NewTableOpsWithClient(nil, job, "proj", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Shards 1 and 2 are left from an earlier export with more files.
+	started := time.Now()
+	before := started.Add(-time.Hour)
+	bucket := &deletingBucket{BucketHandle: &gcsfake.BucketHandle{
+		ObjAttrs: []*storage.ObjectAttrs{
+			{Name: "daily/ndt7/2020/09/05/ndt7-000000000000.json", Size: 100, Updated: started.Add(time.Minute)},
+			{Name: "daily/ndt7/2020/09/05/ndt7-000000000001.json", Size: 200, Updated: before},
+			{Name: "daily/ndt7/2020/09/05/ndt7-000000000002.json", Size: 400, Updated: before},
+		}}}
+	client := &deletingClient{bucket: bucket}
+	status := func(n int64) *bigquery.JobStatus {
+		return &bigquery.JobStatus{Statistics: &bigquery.JobStatistics{
+			StartTime: started,
+			Details:   &bigquery.ExtractStatistics{DestinationURIFileCounts: []int64{n}}}}
+	}
+	ctx := context.Background()
+	if _, _, err := to.VerifyExport(ctx, client, status(3)); !errors.Is(err, bq.ErrExportIncomplete) {
+		t.Error("Expected ErrExportIncomplete:", err)
+	}
+	if len(bucket.deleted) != 0 {
+		t.Error("Incomplete export should not delete files:", bucket.deleted)
+	}
+
+	files, bytes, err := to.VerifyExport(ctx, client, status(1))
+	if err != nil || files != 1 || bytes != 100 {
+		t.Error("Expected 1 file with 100 bytes:", files, bytes, err)
+	}
+	if len(bucket.deleted) != 2 || bucket.deleted[0] != "daily/ndt7/2020/09/05/ndt7-000000000001.json" {
+		t.Error("Expected stale files to be deleted:", bucket.deleted)
+	}
+}
+
+func TestFinalPartition(t *testing.T) {
+	client := &fakeClient{tables: map[string]*bigquery.TableMetadata{
+		"raw_ndt.annotation": {NumRows: 100},
+		"ndt.ndt7":           {NumRows: 200},
+	}}
+	ctx := context.Background()
+	date := time.Date(2020, 9, 5, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		datatype string
+		want     string
+		rows     int64
+	}{
+		{"annotation", "proj.raw_ndt.annotation$20200905", 100},
+		{"ndt7", "proj.ndt.ndt7$20200905", 200},
+	}
+	for _, tt := range tests {
+		to, err := bq.NewTableOpsWithClient(client, tracker.NewJob("bucket", "ndt", tt.datatype, date), "proj", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		name, rows, err := to.FinalPartition(ctx)
+		if err != nil || name != tt.want || rows != tt.rows {
+			t.Errorf("FinalPartition() = %s, %d, %v, want %s, %d", name, rows, err, tt.want, tt.rows)
+		}
+	}
+}
@@ -7,10 +7,12 @@ import (
 	"fmt"
 	"html/template"
 	"log"
+	"time"
 
 	"cloud.google.com/go/bigquery"
 	"github.com/googleapis/google-cloud-go-testing/bigquery/bqiface"
 
+	"github.com/m-lab/go/cloud/bqx"
 	"github.com/m-lab/go/dataset"
 
 	"github.com/m-lab/etl-gardener/tracker"
@@ -26,6 +28,23 @@ type TableOps struct {
 	// map key is the single field name, value is fully qualified name
 	PartitionKeys map[string]string
 	OrderKeys     string
+	SourceFormat  bigquery.DataFormat // Format of the files in LoadSource
+	Load          LoadOptions         // Options for loading LoadSource.
+	Schema        SchemaOptions       // Schema of the load and raw tables.
+	Validation    Validation          // Checks applied before copying to the raw table.
+	Backup        Backup              // Backups of partitions replaced by CopyToRaw and Join.
+	NeedsJoin     bool                // Whether the raw table must be joined with annotations.
+	Tables        Tables              // The tables that the job's data passes through.
+	Annotation    bqx.PDT             // The raw annotation table to join with.
+	// BackupSince is when the job entered the copy or join state.  Backups
+	// written since then are kept, because a retried copy or join may have
+	// already replaced the partition.
+	BackupSince time.Time
+	// RelaxSchema causes LoadToTmp to load with the load table's schema and
+	// the fields of the configured schema that it lacks, so that new fields
+	// are added to the load table.  It requires a configured schema, and the
+	// AllowFieldAddition schema update option.
+	RelaxSchema bool
 }
 
 // ErrDatatypeNotSupported is returned by Query for unsupported datatypes.
@@ -44,33 +63,29 @@ func NewTableOps(ctx context.Context, job tracker.Job, project string, loadSourc
 }
 
 // NewTableOpsWithClient creates a suitable QueryParams for a Job.
+// The job Datatype must be present in the datatype registry.
 func NewTableOpsWithClient(client bqiface.Client, job tracker.Job, project string, loadSource string) (*TableOps, error) {
-	switch job.Datatype {
-	case "annotation":
-		return &TableOps{
-			client:        client,
-			LoadSource:    loadSource,
-			Project:       project,
-			Date:          "date",
-			Job:           job,
-			PartitionKeys: map[string]string{"id": "id"},
-			OrderKeys:     "",
-		}, nil
-
-	case "ndt7":
-		return &TableOps{
-			client:        client,
-			LoadSource:    loadSource,
-			Project:       project,
-			Date:          "date",
-			Job:           job,
-			PartitionKeys: map[string]string{"id": "id"},
-			OrderKeys:     "",
-		}, nil
-
-	default:
+	dt, ok := LookupDatatype(job.Datatype)
+	if !ok {
 		return nil, ErrDatatypeNotSupported
 	}
+	return &TableOps{
+		client:        client,
+		LoadSource:    loadSource,
+		Project:       project,
+		Date:          dt.DateField,
+		Job:           job,
+		PartitionKeys: dt.PartitionKeys,
+		OrderKeys:     dt.OrderKeys,
+		SourceFormat:  dt.SourceFormat,
+		Load:          dt.Load,
+		Schema:        dt.Schema,
+		Validation:    dt.Validation,
+		Backup:        currentBackup(),
+		NeedsJoin:     dt.Join,
+		Tables:        lookupTables(job.Experiment, job.Datatype, project),
+		Annotation:    lookupTables(job.Experiment, "annotation", project).Raw,
+	}, nil
 }
 
 var queryTemplates = map[string]*template.Template{
@@ -93,6 +108,8 @@ func dedupQuery(to TableOps) string {
 }
 
 // Dedup initiates a deduplication query, and returns the bqiface.Job.
+// If dryRun is true, the query is validated but not run, and the returned
+// job is already done, with the estimated bytes in its statistics.
 func (to TableOps) Dedup(ctx context.Context, dryRun bool) (bqiface.Job, error) {
 	qs := dedupQuery(to)
 	if len(qs) == 0 {
@@ -108,49 +125,103 @@ func (to TableOps) Dedup(ctx context.Context, dryRun bool) (bqiface.Job, error)
 	if dryRun {
 		qc := bqiface.QueryConfig{QueryConfig: bigquery.QueryConfig{DryRun: dryRun, Q: qs}}
 		q.SetQueryConfig(qc)
+		job, err := q.Run(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return queryDryRunJob(job), nil
 	}
 	return q.Run(ctx)
 }
 
-// LoadToTmp loads the tmp_ exp table from GCS files.
-func (to TableOps) LoadToTmp(ctx context.Context, dryRun bool) (bqiface.Job, error) {
-	if dryRun {
-		return nil, errors.New("dryrun not implemented")
+// table returns a bigquery table in the same project and dataset as pdt.
+// If partition is true, the table is the job's date partition.
+func (to TableOps) table(pdt bqx.PDT, partition bool) bqiface.Table {
+	name := pdt.Table
+	if partition {
+		name += "$" + to.Job.Date.Format("20060102")
+	}
+	return to.client.DatasetInProject(pdt.Project, pdt.Dataset).Table(name)
+}
+
+// finalTable returns the table that holds the job's final data, which is the
+// joined table if the datatype needs a join, and the raw table otherwise.
+func (to TableOps) finalTable() bqx.PDT {
+	if to.NeedsJoin {
+		return to.Tables.Joined
+	}
+	return to.Tables.Raw
+}
+
+// FinalPartition returns the fully qualified name of the job's partition of
+// the final table, and the number of rows in the partition.
+func (to TableOps) FinalPartition(ctx context.Context) (string, int64, error) {
+	if to.client == nil {
+		return "", 0, dataset.ErrNilBqClient
+	}
+	pdt := to.finalTable()
+	name := fmt.Sprintf("%s.%s.%s$%s", pdt.Project, pdt.Dataset, pdt.Table, to.Job.Date.Format("20060102"))
+	meta, err := to.table(pdt, true).Metadata(ctx)
+	if err != nil {
+		return name, 0, err
 	}
+	return name, int64(meta.NumRows), nil
+}
+
+// LoadToTmp loads the load table from GCS files.
+// The BigQuery client does not support dry run load jobs, so if dryRun is
+// true, the load config is built and the destination table is checked, but
+// the estimated bytes are zero.
+func (to TableOps) LoadToTmp(ctx context.Context, dryRun bool) (bqiface.Job, error) {
 	if to.client == nil {
 		return nil, dataset.ErrNilBqClient
 	}
 
 	gcsRef := bigquery.NewGCSReference(to.LoadSource)
-	gcsRef.SourceFormat = bigquery.JSON
+	gcsRef.SourceFormat = to.SourceFormat
+	gcsRef.Compression = to.Load.Compression
+	gcsRef.MaxBadRecords = to.Load.MaxBadRecords
+	gcsRef.SkipLeadingRows = to.Load.SkipLeadingRows
 
-	dest := to.client.
-		Dataset("tmp_" + to.Job.Experiment).
-		Table(to.Job.Datatype)
+	dest := to.table(to.Tables.Load, false)
 	if dest == nil {
 		return nil, ErrTableNotFound
 	}
+	if to.RelaxSchema {
+		schema, err := to.relaxedSchema(ctx, dest)
+		if err != nil {
+			return nil, err
+		}
+		gcsRef.Schema = schema
+	}
 	loader := dest.LoaderFrom(gcsRef)
 	loadConfig := bqiface.LoadConfig{}
 	loadConfig.WriteDisposition = bigquery.WriteAppend
 	loadConfig.Dst = dest
 	loadConfig.Src = gcsRef
+	loadConfig.SchemaUpdateOptions = to.Load.SchemaUpdateOptions
 	loader.SetLoadConfig(loadConfig)
 
+	if dryRun {
+		if _, err := dest.Metadata(ctx); err != nil {
+			return nil, err
+		}
+		return newDryRunJob(0, &bigquery.LoadStatistics{}), nil
+	}
 	return loader.Run(ctx)
 }
 
-// CopyToRaw copies the tmp_ job partition to the raw_ job partition.
+// CopyToRaw copies the job partition of the load table to the raw table.
+// If backups are enabled, the raw partition is backed up first.
+// The BigQuery client does not support dry run copy jobs, so if dryRun is
+// true, the copy config is built and both tables are checked, and the
+// estimated bytes are the size of the source partition.
 func (to TableOps) CopyToRaw(ctx context.Context, dryRun bool) (bqiface.Job, error) {
-	if dryRun {
-		return nil, errors.New("dryrun not implemented")
-	}
 	if to.client == nil {
 		return nil, dataset.ErrNilBqClient
 	}
-	tableName := to.Job.Datatype + "$" + to.Job.Date.Format("20060102")
-	src := to.client.Dataset("tmp_" + to.Job.Experiment).Table(tableName)
-	dest := to.client.Dataset("raw_" + to.Job.Experiment).Table(tableName)
+	src := to.table(to.Tables.Load, true)
+	dest := to.table(to.Tables.Raw, true)
 
 	copier := dest.CopierFrom(src)
 	config := bqiface.CopyConfig{}
@@ -158,13 +229,26 @@ func (to TableOps) CopyToRaw(ctx context.Context, dryRun bool) (bqiface.Job, err
 	config.Dst = dest
 	config.Srcs = append(config.Srcs, src)
 	copier.SetCopyConfig(config)
+
+	if dryRun {
+		meta, err := src.Metadata(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := to.table(to.Tables.Raw, false).Metadata(ctx); err != nil {
+			return nil, err
+		}
+		return newDryRunJob(meta.NumBytes, nil), nil
+	}
+	if err := to.backupPartition(ctx, to.Tables.Raw); err != nil {
+		return nil, err
+	}
 	return copier.Run(ctx)
 }
 
-// TODO get the tmp_ and raw_ from the job Target?
-const tmpTable = "`{{.Project}}.tmp_{{.Job.Experiment}}.{{.Job.Datatype}}`"
-const rawTable = "`{{.Project}}.raw_{{.Job.Experiment}}.{{.Job.Datatype}}`"
-const joinedTable = "`{{.Project}}.{{.Job.Experiment}}.{{.Job.Datatype}}`"
+const tmpTable = "`{{.Tables.Load.Project}}.{{.Tables.Load.Dataset}}.{{.Tables.Load.Table}}`"
+const rawTable = "`{{.Tables.Raw.Project}}.{{.Tables.Raw.Dataset}}.{{.Tables.Raw.Table}}`"
+const annotationTable = "`{{.Annotation.Project}}.{{.Annotation.Dataset}}.{{.Annotation.Table}}`"
 
 var dedupTemplate = template.Must(template.New("").Parse(`
 #standardSQL
@@ -202,14 +286,18 @@ AND NOT EXISTS (
     target.parser.Time = keep.Time
 )`))
 
-// DeleteTmp deletes the tmp table partition.
-func (to TableOps) DeleteTmp(ctx context.Context) error {
+// DeleteTmp deletes the load table partition.  If dryRun is true, it only
+// checks that the partition exists.
+func (to TableOps) DeleteTmp(ctx context.Context, dryRun bool) error {
 	if to.client == nil {
 		return dataset.ErrNilBqClient
 	}
-	// TODO - name should be field in queryer.
-	tmp := to.client.Dataset("tmp_" + to.Job.Experiment).Table(
-		fmt.Sprintf("%s$%s", to.Job.Datatype, to.Job.Date.Format("20060102")))
+	tmp := to.table(to.Tables.Load, true)
+	if dryRun {
+		log.Println("Dry run: would delete", tmp.FullyQualifiedName())
+		_, err := tmp.Metadata(ctx)
+		return err
+	}
 	log.Println("Deleting", tmp.FullyQualifiedName())
 	return tmp.Delete(ctx)
 }
@@ -230,7 +318,7 @@ WHERE {{.Date}} = "{{.Job.Date.Format "2006-01-02"}}"
 # Need to remove dups?
 ann AS (
 SELECT *
-FROM ` + "`{{.Project}}.raw_{{.Job.Experiment}}.annotation`" + `
+FROM ` + annotationTable + `
 WHERE {{.Date}} BETWEEN DATE_SUB("{{.Job.Date.Format "2006-01-02"}}", INTERVAL 1 DAY) AND "{{.Job.Date.Format "2006-01-02"}}"
 )
 
@@ -239,7 +327,8 @@ SELECT {{.Job.Datatype}}.id, {{.Job.Datatype}}.date, {{.Job.Datatype}}.parser,
 FROM {{.Job.Datatype}} LEFT JOIN ann USING (id)
 `))
 
-// Join joins the raw tables into annotated tables.
+// Join joins the raw tables into annotated tables.  If backups are enabled,
+// the joined partition is backed up first.
 func (to TableOps) Join(ctx context.Context, dryRun bool) (bqiface.Job, error) {
 	qs := to.makeQuery(joinTemplate)
 
@@ -253,10 +342,8 @@ func (to TableOps) Join(ctx context.Context, dryRun bool) (bqiface.Job, error) {
 	if q == nil {
 		return nil, dataset.ErrNilQuery
 	}
-	// The destintation is a partition in a table based on the job
-	// type and date.  Initially, this will only be ndt7.
-	dest := to.client.Dataset(to.Job.Experiment).Table(
-		to.Job.Datatype + "$" + to.Job.Date.Format("20060102"))
+	// The destintation is the job's date partition of the joined table.
+	dest := to.table(to.Tables.Joined, true)
 	qc := bqiface.QueryConfig{
 		QueryConfig: bigquery.QueryConfig{
 			DryRun: dryRun,
@@ -274,5 +361,14 @@ func (to TableOps) Join(ctx context.Context, dryRun bool) (bqiface.Job, error) {
 		Dst: dest,
 	}
 	q.SetQueryConfig(qc)
-	return q.Run(ctx)
+	if !dryRun {
+		if err := to.backupPartition(ctx, to.Tables.Joined); err != nil {
+			return nil, err
+		}
+	}
+	job, err := q.Run(ctx)
+	if err != nil || !dryRun {
+		return job, err
+	}
+	return queryDryRunJob(job), nil
 }
@@ -0,0 +1,225 @@
+package bq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/googleapis/google-cloud-go-testing/bigquery/bqiface"
+	"github.com/m-lab/go/cloud/bqx"
+	"github.com/m-lab/go/dataset"
+	"google.golang.org/api/googleapi"
+
+	"github.com/m-lab/etl-gardener/config"
+	"github.com/m-lab/etl-gardener/metrics"
+)
+
+// ErrNoSchema is returned when a schema is required, but the datatype has
+// no configured schema.
+var ErrNoSchema = errors.New("datatype has no schema")
+
+// SchemaOptions describe the schema that Gardener maintains for the load
+// and raw tables of a datatype.
+type SchemaOptions struct {
+	Schema     bigquery.Schema // nil if Gardener does not manage the schema.
+	Clustering []string        // Fields the tables are clustered by.
+	// ApplyChanges adds fields that are missing from existing tables.
+	// Otherwise, missing fields are only reported.
+	ApplyChanges bool
+	// RequirePartitionFilter is set on the tables that are created.
+	RequirePartitionFilter bool
+}
+
+// ParseSchemaOptions reads the schema file of a datatype config, if any.
+func ParseSchemaOptions(c config.DatatypeConfig) (SchemaOptions, error) {
+	so := SchemaOptions{Clustering: c.Clustering, RequirePartitionFilter: c.RequirePartitionFilter}
+	switch strings.ToLower(c.SchemaChanges) {
+	case "", "report":
+	case "apply":
+		so.ApplyChanges = true
+	default:
+		return so, fmt.Errorf("%w: unknown schema_changes %q", ErrInvalidDatatype, c.SchemaChanges)
+	}
+	if c.SchemaFile == "" {
+		return so, nil
+	}
+	b, err := ioutil.ReadFile(c.SchemaFile)
+	if err != nil {
+		return so, fmt.Errorf("%w: %v", ErrInvalidDatatype, err)
+	}
+	so.Schema, err = bigquery.SchemaFromJSON(b)
+	if err != nil {
+		return so, fmt.Errorf("%w: %s: %v", ErrInvalidDatatype, c.SchemaFile, err)
+	}
+	return so, nil
+}
+
+// Standard SQL type names that the API reports with their legacy names.
+var legacyTypes = map[bigquery.FieldType]bigquery.FieldType{
+	"INT64":   bigquery.IntegerFieldType,
+	"FLOAT64": bigquery.FloatFieldType,
+	"BOOL":    bigquery.BooleanFieldType,
+	"STRUCT":  bigquery.RecordFieldType,
+}
+
+func legacyType(t bigquery.FieldType) bigquery.FieldType {
+	if lt, ok := legacyTypes[t]; ok {
+		return lt
+	}
+	return t
+}
+
+// MergeSchema compares the actual schema of a table to the expected schema.
+// It returns the actual schema with the fields that are missing from it
+// added, the names of the added fields, and descriptions of differences that
+// cannot be applied by adding fields, such as type changes.
+func MergeSchema(actual, expected bigquery.Schema) (merged bigquery.Schema, added []string, conflicts []string) {
+	return mergeSchema(actual, expected, "")
+}
+
+func mergeSchema(actual, expected bigquery.Schema, prefix string) (bigquery.Schema, []string, []string) {
+	var added, conflicts []string
+	merged := make(bigquery.Schema, 0, len(actual)+len(expected))
+	index := make(map[string]int, len(actual))
+	for i, f := range actual {
+		merged = append(merged, f)
+		index[strings.ToLower(f.Name)] = i
+	}
+	for _, want := range expected {
+		name := prefix + want.Name
+		i, ok := index[strings.ToLower(want.Name)]
+		if !ok {
+			if want.Required {
+				conflicts = append(conflicts, name+": missing required field")
+				continue
+			}
+			merged = append(merged, want)
+			added = append(added, name)
+			continue
+		}
+		got := actual[i]
+		switch {
+		case legacyType(got.Type) != legacyType(want.Type):
+			conflicts = append(conflicts, fmt.Sprintf("%s: type %s, expected %s", name, got.Type, want.Type))
+		case got.Repeated != want.Repeated || got.Required != want.Required:
+			conflicts = append(conflicts, name+": mode differs")
+		case legacyType(got.Type) == bigquery.RecordFieldType:
+			sub, a, c := mergeSchema(got.Schema, want.Schema, name+".")
+			added = append(added, a...)
+			conflicts = append(conflicts, c...)
+			if len(a) > 0 {
+				f := *got
+				f.Schema = sub
+				merged[i] = &f
+			}
+		}
+	}
+	return merged, added, conflicts
+}
+
+func isNotFound(err error) bool {
+	var apiErr *googleapi.Error
+	return errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound
+}
+
+func isAlreadyExists(err error) bool {
+	var apiErr *googleapi.Error
+	return errors.As(err, &apiErr) && apiErr.Code == http.StatusConflict
+}
+
+// relaxedSchema returns the schema of table with the fields of the configured
+// schema that it lacks.
+func (to TableOps) relaxedSchema(ctx context.Context, table bqiface.Table) (bigquery.Schema, error) {
+	if to.Schema.Schema == nil {
+		return nil, ErrNoSchema
+	}
+	meta, err := table.Metadata(ctx)
+	if err != nil {
+		return nil, err
+	}
+	merged, added, _ := MergeSchema(meta.Schema, to.Schema.Schema)
+	log.Println(to.Job, "loading with added fields", added)
+	return merged, nil
+}
+
+// EnsureTables creates the load and raw tables if they do not exist, and
+// checks the schemas of existing tables against the expected schema.
+// Missing fields are reported, and added if ApplyChanges is set.  It does
+// nothing if the datatype has no schema.  If dryRun is true, the changes are
+// only logged.
+func (to TableOps) EnsureTables(ctx context.Context, dryRun bool) error {
+	if to.Schema.Schema == nil {
+		return nil
+	}
+	if to.client == nil {
+		return dataset.ErrNilBqClient
+	}
+	for _, pdt := range []bqx.PDT{to.Tables.Load, to.Tables.Raw} {
+		if err := to.ensureTable(ctx, pdt, dryRun); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (to TableOps) ensureTable(ctx context.Context, pdt bqx.PDT, dryRun bool) error {
+	j := to.Job
+	name := pdt.Project + "." + pdt.Dataset + "." + pdt.Table
+	table := to.table(pdt, false)
+	meta, err := table.Metadata(ctx)
+	if isNotFound(err) {
+		if dryRun {
+			log.Println("Dry run: would create", name)
+			return nil
+		}
+		err = to.client.DatasetInProject(pdt.Project, pdt.Dataset).Create(ctx, &bqiface.DatasetMetadata{})
+		if err != nil && !isAlreadyExists(err) {
+			return err
+		}
+		tm := &bigquery.TableMetadata{
+			Schema: to.Schema.Schema,
+			TimePartitioning: &bigquery.TimePartitioning{
+				Field:                  to.Date,
+				RequirePartitionFilter: to.Schema.RequirePartitionFilter,
+			},
+		}
+		if len(to.Schema.Clustering) > 0 {
+			tm.Clustering = &bigquery.Clustering{Fields: to.Schema.Clustering}
+		}
+		err = table.Create(ctx, tm)
+		if err != nil && !isAlreadyExists(err) {
+			return err
+		}
+		log.Println("Created", name)
+		metrics.WarningCount.WithLabelValues(j.Experiment, j.Datatype, "SchemaTableCreated").Inc()
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	merged, added, conflicts := MergeSchema(meta.Schema, to.Schema.Schema)
+	for _, c := range conflicts {
+		log.Println("Schema conflict in", name, c)
+		metrics.WarningCount.WithLabelValues(j.Experiment, j.Datatype, "SchemaConflict").Inc()
+	}
+	if len(added) == 0 {
+		return nil
+	}
+	if !to.Schema.ApplyChanges || dryRun {
+		log.Println("Schema drift:", name, "is missing", added)
+		metrics.WarningCount.WithLabelValues(j.Experiment, j.Datatype, "SchemaMissingFields").Inc()
+		return nil
+	}
+	if _, err := table.Update(ctx, bigquery.TableMetadataToUpdate{Schema: merged}, meta.ETag); err != nil {
+		return err
+	}
+	log.Println("Added", added, "to", name)
+	metrics.WarningCount.WithLabelValues(j.Experiment, j.Datatype, "SchemaFieldsAdded").Inc()
+	return nil
+}
@@ -0,0 +1,271 @@
+package bq_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/go-test/deep"
+	"github.com/googleapis/google-cloud-go-testing/bigquery/bqiface"
+	"google.golang.org/api/googleapi"
+
+	"github.com/m-lab/etl-gardener/cloud/bq"
+	"github.com/m-lab/etl-gardener/config"
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+// fakeClient holds table metadata by dataset.table, and records copies.
+type fakeClient struct {
+	bqiface.Client
+	tables map[string]*bigquery.TableMetadata
+	copies []string // src -> dest
+	loads  []*bigquery.GCSReference
+}
+
+func (c *fakeClient) DatasetInProject(project, dataset string) bqiface.Dataset {
+	return &fakeDataset{c: c, name: dataset}
+}
+
+type fakeDataset struct {
+	bqiface.Dataset
+	c    *fakeClient
+	name string
+}
+
+func (d *fakeDataset) Create(context.Context, *bqiface.DatasetMetadata) error {
+	return &googleapi.Error{Code: http.StatusConflict}
+}
+
+func (d *fakeDataset) Table(name string) bqiface.Table {
+	return &fakeTable{c: d.c, name: d.name + "." + name}
+}
+
+type fakeTable struct {
+	bqiface.Table
+	c    *fakeClient
+	name string
+}
+
+func (t *fakeTable) FullyQualifiedName() string {
+	return t.name
+}
+
+func (t *fakeTable) Metadata(context.Context) (*bigquery.TableMetadata, error) {
+	if meta, ok := t.c.tables[strings.Split(t.name, "$")[0]]; ok {
+		return meta, nil
+	}
+	return nil, &googleapi.Error{Code: http.StatusNotFound}
+}
+
+func (t *fakeTable) Create(ctx context.Context, meta *bigquery.TableMetadata) error {
+	t.c.tables[t.name] = meta
+	return nil
+}
+
+func (t *fakeTable) Update(ctx context.Context, u bigquery.TableMetadataToUpdate, etag string) (*bigquery.TableMetadata, error) {
+	meta := t.c.tables[t.name]
+	if u.Schema != nil {
+		meta.Schema = u.Schema
+	}
+	if !u.ExpirationTime.IsZero() {
+		meta.ExpirationTime = u.ExpirationTime
+	}
+	return meta, nil
+}
+
+func (t *fakeTable) LoaderFrom(src bigquery.LoadSource) bqiface.Loader {
+	t.c.loads = append(t.c.loads, src.(*bigquery.GCSReference))
+	return &fakeLoader{}
+}
+
+type fakeLoader struct {
+	bqiface.Loader
+}
+
+func (l *fakeLoader) SetLoadConfig(bqiface.LoadConfig) {}
+
+func (l *fakeLoader) Run(context.Context) (bqiface.Job, error) {
+	return bq.NewDryRunJob(0, nil), nil
+}
+
+func (t *fakeTable) CopierFrom(srcs ...bqiface.Table) bqiface.Copier {
+	return &fakeCopier{dest: t, src: srcs[0].(*fakeTable)}
+}
+
+type fakeCopier struct {
+	bqiface.Copier
+	src, dest *fakeTable
+}
+
+func (c *fakeCopier) SetCopyConfig(bqiface.CopyConfig) {}
+
+func (c *fakeCopier) Run(context.Context) (bqiface.Job, error) {
+	c.dest.c.copies = append(c.dest.c.copies, c.src.name+" -> "+c.dest.name)
+	name := strings.Split(c.dest.name, "$")[0]
+	meta, ok := c.dest.c.tables[name]
+	if !ok {
+		meta = &bigquery.TableMetadata{}
+		c.dest.c.tables[name] = meta
+	}
+	meta.LastModifiedTime = time.Now()
+	return bq.NewDryRunJob(0, nil), nil
+}
+
+func TestMergeSchema(t *testing.T) {
+	actual := bigquery.Schema{
+		{Name: "id", Type: bigquery.StringFieldType},
+		{Name: "a", Type: bigquery.RecordFieldType, Schema: bigquery.Schema{
+			{Name: "x", Type: bigquery.IntegerFieldType},
+		}},
+		{Name: "b", Type: bigquery.StringFieldType},
+		{Name: "extra", Type: bigquery.StringFieldType},
+	}
+	expected := bigquery.Schema{
+		{Name: "id", Type: bigquery.StringFieldType},
+		{Name: "a", Type: "STRUCT", Schema: bigquery.Schema{
+			{Name: "x", Type: "INT64"},
+			{Name: "y", Type: bigquery.FloatFieldType},
+		}},
+		{Name: "b", Type: bigquery.IntegerFieldType},
+		{Name: "c", Type: bigquery.TimestampFieldType},
+		{Name: "d", Type: bigquery.StringFieldType, Required: true},
+	}
+	merged, added, conflicts := bq.MergeSchema(actual, expected)
+	if diff := deep.Equal(added, []string{"a.y", "c"}); diff != nil {
+		t.Error(diff)
+	}
+	if len(conflicts) != 2 {
+		t.Error("Expected conflicts for b and d:", conflicts)
+	}
+	if len(merged) != 5 || merged[4].Name != "c" || len(merged[1].Schema) != 2 {
+		t.Errorf("Bad merged schema: %+v", merged)
+	}
+	// The actual schema is unchanged.
+	if len(actual[1].Schema) != 1 {
+		t.Error("Actual schema was modified")
+	}
+}
+
+func TestEnsureTables(t *testing.T) {
+	_, err := bq.DatatypeFromConfig(config.DatatypeConfig{Name: "foo", SchemaFile: "testdata/missing.json"})
+	if !errors.Is(err, bq.ErrInvalidDatatype) {
+		t.Error("Expected ErrInvalidDatatype:", err)
+	}
+	_, err = bq.DatatypeFromConfig(config.DatatypeConfig{Name: "foo", SchemaChanges: "sometimes"})
+	if !errors.Is(err, bq.ErrInvalidDatatype) {
+		t.Error("Expected ErrInvalidDatatype:", err)
+	}
+	dt, err := bq.DatatypeFromConfig(config.DatatypeConfig{
+		Name: "schematest", SchemaFile: "testdata/schema.json", Clustering: []string{"id"}, SchemaChanges: "apply"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dt.Schema.Schema) != 4 || !dt.Schema.ApplyChanges {
+		t.Fatalf("Bad schema options: %+v", dt.Schema)
+	}
+	if err := bq.RegisterDatatype(dt); err != nil {
+		t.Fatal(err)
+	}
+
+	client := &fakeClient{tables: map[string]*bigquery.TableMetadata{
+		// The raw table is missing the raw field.
+		"raw_ndt.schematest": {Schema: dt.Schema.Schema[:3]},
+	}}
+	job := tracker.NewJob("bucket", "ndt", "schematest", time.Date(2020, 9, 5, 0, 0, 0, 0, time.UTC))
+	to, err := bq.NewTableOpsWithClient(client, job, "proj", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	// A dry run changes nothing.
+	if err := to.EnsureTables(ctx, true); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := client.tables["tmp_ndt.schematest"]; ok || len(client.tables["raw_ndt.schematest"].Schema) != 3 {
+		t.Error("Dry run should not change tables")
+	}
+
+	if err := to.EnsureTables(ctx, false); err != nil {
+		t.Fatal(err)
+	}
+	tmp, ok := client.tables["tmp_ndt.schematest"]
+	if !ok {
+		t.Fatal("tmp table not created")
+	}
+	if tmp.TimePartitioning.Field != "date" || tmp.TimePartitioning.RequirePartitionFilter ||
+		tmp.Clustering.Fields[0] != "id" || len(tmp.Schema) != 4 {
+		t.Errorf("Bad tmp table: %+v", tmp)
+	}
+	if len(client.tables["raw_ndt.schematest"].Schema) != 4 {
+		t.Error("raw field not added:", client.tables["raw_ndt.schematest"].Schema)
+	}
+
+	// Partition filters are opt-in.
+	delete(client.tables, "tmp_ndt.schematest")
+	to.Schema.RequirePartitionFilter = true
+	if err := to.EnsureTables(ctx, false); err != nil {
+		t.Fatal(err)
+	}
+	if !client.tables["tmp_ndt.schematest"].TimePartitioning.RequirePartitionFilter {
+		t.Error("Expected RequirePartitionFilter")
+	}
+
+	// Without a schema, tables are not checked.
+	to.Schema = bq.SchemaOptions{}
+	delete(client.tables, "tmp_ndt.schematest")
+	if err := to.EnsureTables(ctx, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := client.tables["tmp_ndt.schematest"]; ok {
+		t.Error("tmp table should not be created without a schema")
+	}
+}
+
+func TestLoadToTmp_RelaxSchema(t *testing.T) {
+	dt, err := bq.DatatypeFromConfig(config.DatatypeConfig{
+		Name: "relaxtest", SchemaFile: "testdata/schema.json", SourceFormat: "json"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bq.RegisterDatatype(dt); err != nil {
+		t.Fatal(err)
+	}
+	client := &fakeClient{tables: map[string]*bigquery.TableMetadata{
+		// The load table is missing the last field.
+		"tmp_ndt.relaxtest": {Schema: dt.Schema.Schema[:3]},
+	}}
+	job := tracker.NewJob("bucket", "ndt", "relaxtest", time.Date(2020, 9, 5, 0, 0, 0, 0, time.UTC))
+	to, err := bq.NewTableOpsWithClient(client, job, "proj", "gs://bucket/path")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if _, err := to.LoadToTmp(ctx, false); err != nil {
+		t.Fatal(err)
+	}
+	to.RelaxSchema = true
+	if _, err := to.LoadToTmp(ctx, false); err != nil {
+		t.Fatal(err)
+	}
+	if len(client.loads) != 2 {
+		t.Fatal("Expected 2 loads:", client.loads)
+	}
+	if client.loads[0].Schema != nil || client.loads[0].AutoDetect {
+		t.Errorf("Normal load should use the table schema: %+v", client.loads[0])
+	}
+	// The relaxed load adds the configured field, and never detects types.
+	if diff := deep.Equal(client.loads[1].Schema, dt.Schema.Schema); diff != nil || client.loads[1].AutoDetect {
+		t.Error("Bad relaxed schema:", diff, client.loads[1].AutoDetect)
+	}
+
+	// Without a configured schema, loads are not relaxed.
+	to.Schema = bq.SchemaOptions{}
+	if _, err := to.LoadToTmp(ctx, false); !errors.Is(err, bq.ErrNoSchema) {
+		t.Error("Expected ErrNoSchema:", err)
+	}
+}
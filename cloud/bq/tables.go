@@ -0,0 +1,111 @@
+package bq
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/m-lab/go/cloud/bqx"
+
+	"github.com/m-lab/etl-gardener/config"
+)
+
+// Tables names the BigQuery tables that a source's data passes through.
+type Tables struct {
+	Load   bqx.PDT // Loaded from GCS, and deduplicated.
+	Raw    bqx.PDT // Copied from the load table.
+	Joined bqx.PDT // Joined with annotations.
+
+	// Optional gs://bucket/prefix that the final partition is exported to.
+	Export       string
+	ExportFormat bigquery.DataFormat
+}
+
+// Errors returned for invalid source configs.
+var (
+	ErrInvalidTable    = errors.New("invalid table config")
+	ErrInvalidExport   = errors.New("invalid export config")
+	ErrDuplicateSource = errors.New("duplicate experiment/datatype source")
+)
+
+// exportFormats maps the configured export formats to DataFormats.
+var exportFormats = map[string]bigquery.DataFormat{
+	"":        bigquery.JSON,
+	"json":    bigquery.JSON,
+	"avro":    bigquery.Avro,
+	"parquet": bigquery.Parquet,
+}
+
+var (
+	tablesLock sync.Mutex
+	tables     = map[string]Tables{} // by experiment/datatype
+)
+
+// TablesFromConfig returns the tables of a source, with the defaults filled
+// in.  Tables without a project are in the given project.
+func TablesFromConfig(src config.SourceConfig, project string) (Tables, error) {
+	load, raw, joined := src.TableNames(project)
+	var t Tables
+	var err error
+	if t.Load, err = bqx.ParsePDT(load); err != nil {
+		return t, fmt.Errorf("%w: %s: %v", ErrInvalidTable, load, err)
+	}
+	if t.Raw, err = bqx.ParsePDT(raw); err != nil {
+		return t, fmt.Errorf("%w: %s: %v", ErrInvalidTable, raw, err)
+	}
+	if t.Joined, err = bqx.ParsePDT(joined); err != nil {
+		return t, fmt.Errorf("%w: %s: %v", ErrInvalidTable, joined, err)
+	}
+	if src.Export != "" {
+		if !strings.HasPrefix(src.Export, "gs://") || len(src.Export) <= len("gs://") {
+			return t, fmt.Errorf("%w: %s", ErrInvalidExport, src.Export)
+		}
+		t.Export = strings.TrimSuffix(src.Export, "/")
+		var ok bool
+		if t.ExportFormat, ok = exportFormats[src.ExportFormat]; !ok {
+			return t, fmt.Errorf("%w: unknown format %s", ErrInvalidExport, src.ExportFormat)
+		}
+	}
+	return t, nil
+}
+
+// RegisterSourceTables replaces the registered tables with the tables of
+// each source in the config, so that TableOps for the source's jobs use
+// them.  Jobs are identified by experiment and datatype, so each source must
+// have a distinct experiment and datatype.  The job service's TargetTable is
+// the source's load table.
+func RegisterSourceTables(sources []config.SourceConfig, project string) error {
+	registered := make(map[string]Tables, len(sources))
+	for _, src := range sources {
+		key := src.Experiment + "/" + src.Datatype
+		if _, ok := registered[key]; ok {
+			return fmt.Errorf("%w: %s", ErrDuplicateSource, key)
+		}
+		t, err := TablesFromConfig(src, project)
+		if err != nil {
+			return err
+		}
+		registered[key] = t
+	}
+	tablesLock.Lock()
+	defer tablesLock.Unlock()
+	tables = registered
+	return nil
+}
+
+// lookupTables returns the registered tables for an experiment and datatype,
+// or the default tables in the project, as described by SourceConfig.TableNames.
+func lookupTables(experiment, datatype, project string) Tables {
+	tablesLock.Lock()
+	defer tablesLock.Unlock()
+	if t, ok := tables[experiment+"/"+datatype]; ok {
+		return t
+	}
+	return Tables{
+		Load:   bqx.PDT{Project: project, Dataset: "tmp_" + experiment, Table: datatype},
+		Raw:    bqx.PDT{Project: project, Dataset: "raw_" + experiment, Table: datatype},
+		Joined: bqx.PDT{Project: project, Dataset: experiment, Table: datatype},
+	}
+}
@@ -0,0 +1,72 @@
+package bq_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/m-lab/go/cloud/bqx"
+
+	"github.com/m-lab/etl-gardener/cloud/bq"
+	"github.com/m-lab/etl-gardener/config"
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+func TestTablesFromConfig(t *testing.T) {
+	src := config.SourceConfig{Experiment: "ndt", Datatype: "ndt7", RawTable: "other.raw.ndt7"}
+	tables, err := bq.TablesFromConfig(src, "proj")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := bq.Tables{
+		Load:   bqx.PDT{Project: "proj", Dataset: "tmp_ndt", Table: "ndt7"},
+		Raw:    bqx.PDT{Project: "other", Dataset: "raw", Table: "ndt7"},
+		Joined: bqx.PDT{Project: "proj", Dataset: "ndt", Table: "ndt7"},
+	}
+	if tables != want {
+		t.Errorf("Bad tables: %+v", tables)
+	}
+
+	src.JoinedTable = "ndt7"
+	if _, err := bq.TablesFromConfig(src, "proj"); !errors.Is(err, bq.ErrInvalidTable) {
+		t.Error("Expected ErrInvalidTable:", err)
+	}
+}
+
+func TestRegisterSourceTables(t *testing.T) {
+	err := bq.RegisterSourceTables([]config.SourceConfig{
+		{Experiment: "staging", Datatype: "ndt7", LoadTable: "sandbox_tmp.ndt7",
+			RawTable: "sandbox_raw.ndt7", JoinedTable: "other.sandbox.ndt7"},
+		{Experiment: "staging", Datatype: "annotation", RawTable: "sandbox_raw.annotation"},
+	}, "proj")
+	if err != nil {
+		t.Fatal(err)
+	}
+	job := tracker.NewJob("bucket", "staging", "ndt7", time.Date(2019, 3, 4, 0, 0, 0, 0, time.UTC))
+	to, err := bq.NewTableOpsWithClient(nil, job, "proj", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if to.Tables.Joined != (bqx.PDT{Project: "other", Dataset: "sandbox", Table: "ndt7"}) {
+		t.Errorf("Bad joined table: %v", to.Tables.Joined)
+	}
+	qs := bq.DedupQuery(*to)
+	if !strings.Contains(qs, "`proj.sandbox_tmp.ndt7`") {
+		t.Error("query should contain sandbox_tmp.ndt7:\n", qs)
+	}
+	qs = bq.JoinQuery(*to)
+	if !strings.Contains(qs, "`proj.sandbox_raw.ndt7`") ||
+		!strings.Contains(qs, "`proj.sandbox_raw.annotation`") {
+		t.Error("query should contain sandbox_raw tables:\n", qs)
+	}
+
+	// Sources with the same experiment and datatype would share jobs.
+	err = bq.RegisterSourceTables([]config.SourceConfig{
+		{Experiment: "staging", Datatype: "ndt7", LoadTable: "a_tmp.ndt7"},
+		{Experiment: "staging", Datatype: "ndt7", LoadTable: "b_tmp.ndt7"},
+	}, "proj")
+	if !errors.Is(err, bq.ErrDuplicateSource) {
+		t.Error("Expected ErrDuplicateSource:", err)
+	}
+}
@@ -0,0 +1,194 @@
+package bq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"google.golang.org/api/iterator"
+
+	"github.com/m-lab/go/dataset"
+
+	"github.com/m-lab/etl-gardener/config"
+)
+
+// ErrValidationFailed is returned when a partition fails a validation check.
+var ErrValidationFailed = errors.New("validation failed")
+
+// Validation describes the checks applied to a job's deduplicated load
+// partition before it is copied over the raw partition.
+type Validation config.ValidationConfig
+
+// IsZero returns true if no checks are configured.
+func (v Validation) IsZero() bool {
+	return v.MinPreviousRatio == 0 && v.MinNeighbourRatio == 0 &&
+		len(v.MaxNullRates) == 0 && v.TimeField == ""
+}
+
+// nullFields returns the fields with null rate checks, in sorted order.
+func (v Validation) nullFields() []string {
+	fields := make([]string, 0, len(v.MaxNullRates))
+	for f := range v.MaxNullRates {
+		fields = append(fields, f)
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+func (v Validation) neighbourDays() int {
+	if v.NeighbourDays <= 0 {
+		return 3
+	}
+	return v.NeighbourDays
+}
+
+// PartitionStats are the statistics of a partition used by the checks.
+type PartitionStats struct {
+	Rows       int64
+	Nulls      map[string]int64 // by field
+	OutOfRange int64            // Rows with TimeField outside the allowed range.
+}
+
+// Check applies the checks to the statistics of the new partition, the row
+// count of the partition that it replaces, and the row counts of the
+// neighbouring partitions.  Missing partitions are not compared.
+func (v Validation) Check(stats PartitionStats, previous int64, neighbours []int64) error {
+	var failures []string
+	if v.MinPreviousRatio > 0 && previous > 0 &&
+		float64(stats.Rows) < v.MinPreviousRatio*float64(previous) {
+		failures = append(failures, fmt.Sprintf("%d rows, previously %d", stats.Rows, previous))
+	}
+	if v.MinNeighbourRatio > 0 && len(neighbours) > 0 {
+		var sum int64
+		for _, n := range neighbours {
+			sum += n
+		}
+		avg := float64(sum) / float64(len(neighbours))
+		if float64(stats.Rows) < v.MinNeighbourRatio*avg {
+			failures = append(failures, fmt.Sprintf("%d rows, neighbouring days average %.0f", stats.Rows, avg))
+		}
+	}
+	if stats.Rows > 0 {
+		for _, f := range v.nullFields() {
+			rate := float64(stats.Nulls[f]) / float64(stats.Rows)
+			if rate > v.MaxNullRates[f] {
+				failures = append(failures, fmt.Sprintf("%s is null in %.1f%% of rows", f, 100*rate))
+			}
+		}
+	}
+	if stats.OutOfRange > 0 {
+		failures = append(failures, fmt.Sprintf("%d rows with %s out of range", stats.OutOfRange, v.TimeField))
+	}
+	if len(failures) > 0 {
+		return fmt.Errorf("%w: %s", ErrValidationFailed, strings.Join(failures, "; "))
+	}
+	return nil
+}
+
+// statsQuery returns the query for the PartitionStats of the job's load
+// partition.
+func (to TableOps) statsQuery() string {
+	v := to.Validation
+	date := to.Job.Date.Format("2006-01-02")
+	b := strings.Builder{}
+	b.WriteString("#standardSQL\nSELECT COUNT(*) AS row_count")
+	for i, f := range v.nullFields() {
+		fmt.Fprintf(&b, ", COUNTIF(%s IS NULL) AS nulls_%d", f, i)
+	}
+	if v.TimeField != "" {
+		skew := int64(v.MaxTimeSkew / time.Second)
+		fmt.Fprintf(&b, `, COUNTIF(%[1]s < TIMESTAMP_SUB(TIMESTAMP("%[2]s"), INTERVAL %[3]d SECOND)`+
+			` OR %[1]s >= TIMESTAMP_ADD(TIMESTAMP(DATE_ADD("%[2]s", INTERVAL 1 DAY)), INTERVAL %[3]d SECOND)) AS out_of_range`,
+			v.TimeField, date, skew)
+	}
+	fmt.Fprintf(&b, "\nFROM `%s.%s.%s`\nWHERE %s = \"%s\"",
+		to.Tables.Load.Project, to.Tables.Load.Dataset, to.Tables.Load.Table, to.Date, date)
+	return b.String()
+}
+
+// rowCountQuery returns the query for the row counts of the raw partitions
+// within the neighbouring days of the job's date, including the job's date.
+func (to TableOps) rowCountQuery() string {
+	date := to.Job.Date.Format("2006-01-02")
+	return fmt.Sprintf("#standardSQL\nSELECT CAST(%[1]s AS STRING) AS day, COUNT(*) AS row_count\n"+
+		"FROM `%[2]s.%[3]s.%[4]s`\n"+
+		"WHERE %[1]s BETWEEN DATE_SUB(\"%[5]s\", INTERVAL %[6]d DAY) AND DATE_ADD(\"%[5]s\", INTERVAL %[6]d DAY)\n"+
+		"GROUP BY day",
+		to.Date, to.Tables.Raw.Project, to.Tables.Raw.Dataset, to.Tables.Raw.Table, date, to.Validation.neighbourDays())
+}
+
+// readRows runs a query and returns its rows.
+func (to TableOps) readRows(ctx context.Context, qs string) ([]map[string]bigquery.Value, error) {
+	q := to.client.Query(qs)
+	if q == nil {
+		return nil, dataset.ErrNilQuery
+	}
+	it, err := q.Read(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var rows []map[string]bigquery.Value
+	for {
+		row := map[string]bigquery.Value{}
+		err := it.Next(&row)
+		if err == iterator.Done {
+			return rows, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		rows = append(rows, row)
+	}
+}
+
+func toInt64(v bigquery.Value) int64 {
+	n, _ := v.(int64)
+	return n
+}
+
+// Validate applies the datatype's checks to the job's deduplicated load
+// partition, comparing it to the raw partition that it will replace, and to
+// the neighbouring raw partitions.  It returns an ErrValidationFailed error
+// if any check fails.
+func (to TableOps) Validate(ctx context.Context) (PartitionStats, error) {
+	stats := PartitionStats{Nulls: map[string]int64{}}
+	if to.Validation.IsZero() {
+		return stats, nil
+	}
+	if to.client == nil {
+		return stats, dataset.ErrNilBqClient
+	}
+	rows, err := to.readRows(ctx, to.statsQuery())
+	if err != nil {
+		return stats, err
+	}
+	if len(rows) == 1 {
+		stats.Rows = toInt64(rows[0]["row_count"])
+		stats.OutOfRange = toInt64(rows[0]["out_of_range"])
+		for i, f := range to.Validation.nullFields() {
+			stats.Nulls[f] = toInt64(rows[0][fmt.Sprintf("nulls_%d", i)])
+		}
+	}
+
+	var previous int64
+	var neighbours []int64
+	if to.Validation.MinPreviousRatio > 0 || to.Validation.MinNeighbourRatio > 0 {
+		rows, err = to.readRows(ctx, to.rowCountQuery())
+		if err != nil && !isNotFound(err) {
+			return stats, err
+		}
+		date := to.Job.Date.Format("2006-01-02")
+		for _, row := range rows {
+			if day, _ := row["day"].(string); day == date {
+				previous = toInt64(row["row_count"])
+			} else {
+				neighbours = append(neighbours, toInt64(row["row_count"]))
+			}
+		}
+	}
+	return stats, to.Validation.Check(stats, previous, neighbours)
+}
@@ -0,0 +1,160 @@
+package bq_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/googleapis/google-cloud-go-testing/bigquery/bqiface"
+	"github.com/m-lab/go/cloudtest/bqfake"
+
+	"github.com/m-lab/etl-gardener/cloud/bq"
+	"github.com/m-lab/etl-gardener/config"
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+func TestValidation_Check(t *testing.T) {
+	v := bq.Validation{
+		MinPreviousRatio:  0.95,
+		MinNeighbourRatio: 0.5,
+		MaxNullRates:      map[string]float64{"id": 0, "a.b": 0.1},
+		TimeField:         "a.TestTime",
+	}
+	stats := bq.PartitionStats{Rows: 1000, Nulls: map[string]int64{"a.b": 100}}
+	tests := []struct {
+		name       string
+		stats      bq.PartitionStats
+		previous   int64
+		neighbours []int64
+		want       string // Expected failure, or "".
+	}{
+		{name: "ok", stats: stats, previous: 1000, neighbours: []int64{1500, 1500}},
+		{name: "no-previous", stats: stats},
+		{name: "previous", stats: stats, previous: 1100, want: "previously 1100"},
+		{name: "neighbours", stats: stats, neighbours: []int64{1000, 4000}, want: "average 2500"},
+		{name: "nulls", stats: bq.PartitionStats{Rows: 1000, Nulls: map[string]int64{"id": 1}}, want: "id is null"},
+		{name: "time", stats: bq.PartitionStats{Rows: 1000, OutOfRange: 3}, want: "3 rows with a.TestTime"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := v.Check(tt.stats, tt.previous, tt.neighbours)
+			if tt.want == "" {
+				if err != nil {
+					t.Error(err)
+				}
+				return
+			}
+			if !errors.Is(err, bq.ErrValidationFailed) || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Check() = %v, want %q", err, tt.want)
+			}
+		})
+	}
+	if !(bq.Validation{}).IsZero() || v.IsZero() {
+		t.Error("Bad IsZero")
+	}
+}
+
+// queryClient returns the stats row to stats queries, and the rows per day
+// to row count queries.
+type queryClient struct {
+	bqiface.Client
+	stats map[string]bigquery.Value
+	days  []map[string]bigquery.Value
+}
+
+func (c *queryClient) Query(qs string) bqiface.Query {
+	if strings.Contains(qs, "GROUP BY day") {
+		return bqfake.NewQueryReadClient(bqfake.QueryConfig{
+			RowIteratorConfig: bqfake.RowIteratorConfig{Rows: c.days}}).Query(qs)
+	}
+	return bqfake.NewQueryReadClient(bqfake.QueryConfig{
+		RowIteratorConfig: bqfake.RowIteratorConfig{Rows: []map[string]bigquery.Value{c.stats}}}).Query(qs)
+}
+
+func TestValidate(t *testing.T) {
+	dt, err := bq.DatatypeFromConfig(config.DatatypeConfig{
+		Name: "validated",
+		Validation: config.ValidationConfig{
+			MinPreviousRatio: 0.9, MaxNullRates: map[string]float64{"id": 0},
+			TimeField: "a.TestTime", MaxTimeSkew: time.Hour},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bq.RegisterDatatype(dt); err != nil {
+		t.Fatal(err)
+	}
+	client := &queryClient{
+		stats: map[string]bigquery.Value{"row_count": int64(1000), "nulls_0": int64(0), "out_of_range": int64(0)},
+		days: []map[string]bigquery.Value{
+			{"day": "2020-09-04", "row_count": int64(5000)},
+			{"day": "2020-09-05", "row_count": int64(1050)},
+		},
+	}
+	job := tracker.NewJob("bucket", "ndt", "validated", time.Date(2020, 9, 5, 0, 0, 0, 0, time.UTC))
+	to, err := bq.NewTableOpsWithClient(client, job, "proj", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	qs := bq.StatsQuery(*to)
+	for _, want := range []string{"`proj.tmp_ndt.validated`", "COUNTIF(id IS NULL) AS nulls_0",
+		`TIMESTAMP_SUB(TIMESTAMP("2020-09-05"), INTERVAL 3600 SECOND)`} {
+		if !strings.Contains(qs, want) {
+			t.Errorf("query should contain %s:\n%s", want, qs)
+		}
+	}
+
+	ctx := context.Background()
+	stats, err := to.Validate(ctx)
+	if err != nil || stats.Rows != 1000 {
+		t.Error("Expected valid partition:", stats, err)
+	}
+
+	// A big drop from the previous partition fails.
+	client.days[1]["row_count"] = int64(2000)
+	if _, err := to.Validate(ctx); !errors.Is(err, bq.ErrValidationFailed) {
+		t.Error("Expected ErrValidationFailed:", err)
+	}
+}
+
+func TestValidationQueries(t *testing.T) {
+	dt, err := bq.DatatypeFromConfig(config.DatatypeConfig{
+		Name: "validatedsql",
+		Validation: config.ValidationConfig{
+			MinNeighbourRatio: 0.5, NeighbourDays: 2, MaxNullRates: map[string]float64{"id": 0},
+			TimeField: "a.TestTime", MaxTimeSkew: time.Hour},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bq.RegisterDatatype(dt); err != nil {
+		t.Fatal(err)
+	}
+	job := tracker.NewJob("bucket", "ndt", "validatedsql", time.Date(2020, 9, 5, 0, 0, 0, 0, time.UTC))
+	to, err := bq.NewTableOpsWithClient(&queryClient{}, job, "proj", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// ROWS is a reserved keyword, so it must not be used as an alias.
+	wantStats := "#standardSQL\n" +
+		"SELECT COUNT(*) AS row_count, COUNTIF(id IS NULL) AS nulls_0, " +
+		`COUNTIF(a.TestTime < TIMESTAMP_SUB(TIMESTAMP("2020-09-05"), INTERVAL 3600 SECOND) OR ` +
+		`a.TestTime >= TIMESTAMP_ADD(TIMESTAMP(DATE_ADD("2020-09-05", INTERVAL 1 DAY)), INTERVAL 3600 SECOND)) AS out_of_range` + "\n" +
+		"FROM `proj.tmp_ndt.validatedsql`\n" +
+		`WHERE date = "2020-09-05"`
+	if qs := bq.StatsQuery(*to); qs != wantStats {
+		t.Errorf("Bad stats query:\n%s\nwant:\n%s", qs, wantStats)
+	}
+	wantCounts := "#standardSQL\n" +
+		"SELECT CAST(date AS STRING) AS day, COUNT(*) AS row_count\n" +
+		"FROM `proj.raw_ndt.validatedsql`\n" +
+		`WHERE date BETWEEN DATE_SUB("2020-09-05", INTERVAL 2 DAY) AND DATE_ADD("2020-09-05", INTERVAL 2 DAY)` + "\n" +
+		"GROUP BY day"
+	if qs := bq.RowCountQuery(*to); qs != wantCounts {
+		t.Errorf("Bad row count query:\n%s\nwant:\n%s", qs, wantCounts)
+	}
+}
@@ -13,13 +13,17 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"path/filepath"
 	"runtime"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"cloud.google.com/go/bigquery"
 	"cloud.google.com/go/datastore"
 	"cloud.google.com/go/storage"
+	"github.com/googleapis/google-cloud-go-testing/bigquery/bqiface"
 	"github.com/googleapis/google-cloud-go-testing/datastore/dsiface"
 	"github.com/googleapis/google-cloud-go-testing/storage/stiface"
 	"golang.org/x/sync/errgroup"
@@ -30,8 +34,10 @@ import (
 	"github.com/m-lab/go/rtx"
 
 	"github.com/m-lab/etl-gardener/cloud"
+	"github.com/m-lab/etl-gardener/cloud/bq"
 	"github.com/m-lab/etl-gardener/config"
 	job "github.com/m-lab/etl-gardener/job-service"
+	"github.com/m-lab/etl-gardener/notify"
 	"github.com/m-lab/etl-gardener/ops"
 	"github.com/m-lab/etl-gardener/persistence"
 	"github.com/m-lab/etl-gardener/reproc"
@@ -60,6 +66,19 @@ var (
 	jobCleanupDelay   = flag.Duration("job_cleanup_delay", 3*time.Hour, "Time after which completed jobs will be removed from tracker")
 	shutdownTimeout   = flag.Duration("shutdown_timeout", 1*time.Minute, "Graceful shutdown time allowance")
 	statusPort        = flag.String("status_port", ":0", "The public interface port where status (and pprof) will be published")
+	persistenceMode   = flagx.Enum{
+		Options: []string{"datastore", "file", "memory"},
+		Value:   "datastore",
+	}
+	persistenceDir = flag.String("persistence_dir", "/var/lib/gardener", "Directory for local state when -persistence=file")
+	operatorToken  = flag.String("operator_token", "", "Bearer token for the operator job and batch endpoints.  Disabled if empty")
+	dryRun         = flag.Bool("dry_run", false, "Validate post processing BigQuery jobs with dry runs, without mutating any tables")
+	historyFile    = flag.String("history_file", "", "JSONL file to which finished job histories are appended.  Disabled if empty")
+	leaseDuration  = flag.Duration("lease_duration", 0, "Parser lease duration, extended by heartbeats.  Leases are disabled if zero")
+	maxLeaseLosses = flag.Int("max_lease_losses", 3, "Number of expired leases after which a job is failed")
+	leaderElection = flag.Bool("leader_election", false, "Run as one of several manager instances, of which only the elected leader manages jobs")
+	leaderLease    = flag.Duration("leader_lease", 30*time.Second, "Duration of the leader's lease, renewed every third of the duration")
+	instanceID     = flag.String("instance_id", "", "Name of this instance in leader election.  Defaults to the hostname")
 
 	// Context and injected variables to allow smoke testing of main()
 	mainCtx, mainCancel = context.WithCancel(context.Background())
@@ -68,6 +87,7 @@ var (
 func init() {
 	// Always prepend the filename and line number.
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
+	flag.Var(&persistenceMode, "persistence", "Where manager state is persisted: datastore, file, or memory")
 }
 
 // Environment provides "global" variables.
@@ -240,8 +260,24 @@ func taskHandlerFromEnv(ctx context.Context, client *http.Client) (*reproc.TaskH
 // until we get annotation fixed to use the actual data date instead of NOW.
 const StartDateRFC3339 = "2017-05-01T00:00:00Z"
 
-// Job state tracker, when operating in manager mode.
-var globalTracker *tracker.Tracker
+// Job state tracker, when operating in manager mode.  On standby instances,
+// this is a read-only snapshot of the leader's tracker.
+var (
+	trackerLock   sync.Mutex
+	globalTracker *tracker.Tracker
+)
+
+func setGlobalTracker(tk *tracker.Tracker) {
+	trackerLock.Lock()
+	defer trackerLock.Unlock()
+	globalTracker = tk
+}
+
+func getGlobalTracker() *tracker.Tracker {
+	trackerLock.Lock()
+	defer trackerLock.Unlock()
+	return globalTracker
+}
 
 // ###############################################################################
 //  Top level service control code.
@@ -264,8 +300,11 @@ func Status(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "</br></br>\n")
 
 	// TODO - attach the environment to the context.
-	if globalTracker != nil {
-		globalTracker.WriteHTMLStatusTo(r.Context(), w)
+	if lead := getLeader(); lead != "" {
+		fmt.Fprintf(w, "Leader: %s</br>\n", lead)
+	}
+	if tk := getGlobalTracker(); tk != nil {
+		tk.WriteHTMLStatusTo(r.Context(), w)
 	}
 	state.WriteHTMLStatusTo(r.Context(), w, env.Project, env.Experiment)
 	fmt.Fprintf(w, "</br>\n")
@@ -301,7 +340,7 @@ func startStatusServer() *http.Server {
 
 var healthy = false
 
-// healthCheck, for now, used for both /ready and /alive.
+// healthCheck, for now, used for /alive, and by readyCheck.
 func healthCheck(w http.ResponseWriter, r *http.Request) {
 	if !healthy {
 		log.Println("Reporting unhealthy for", r.RequestURI)
@@ -312,35 +351,293 @@ func healthCheck(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func mustStandardTracker() *tracker.Tracker {
-	client, err := datastore.NewClient(context.Background(), env.Project)
-	rtx.Must(err, "datastore client")
-	dsKey := datastore.NameKey("tracker", "jobs", nil)
-	dsKey.Namespace = "gardener"
+// readyCheck is used for /ready.  Standby instances are alive, but not ready,
+// because they do not serve the parser endpoints.
+func readyCheck(w http.ResponseWriter, r *http.Request) {
+	if isStandby() {
+		log.Println("Reporting not ready on standby for", r.RequestURI)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprint(w, `{"message": "Standby instance."}`)
+		return
+	}
+	healthCheck(w, r)
+}
+
+// mustTrackerSaver creates the tracker Saver for the -persistence mode.
+func mustTrackerSaver() tracker.Saver {
+	switch persistenceMode.Value {
+	case "file":
+		rtx.Must(os.MkdirAll(*persistenceDir, 0755), "Could not create persistence dir")
+		return tracker.NewFileSaver(filepath.Join(*persistenceDir, "tracker.json"))
+	case "memory":
+		return tracker.NewMemorySaver()
+	default:
+		client, err := datastore.NewClient(context.Background(), env.Project)
+		rtx.Must(err, "datastore client")
+		dsKey := datastore.NameKey("tracker", "jobs", nil)
+		dsKey.Namespace = "gardener"
+		return tracker.NewDatastoreSaver(dsiface.AdaptClient(client), dsKey)
+	}
+}
+
+// mustStateSaver creates the job service Saver for the -persistence mode.
+func mustStateSaver() persistence.Saver {
+	switch persistenceMode.Value {
+	case "file":
+		saver, err := persistence.NewFileSaver(*persistenceDir)
+		rtx.Must(err, "Could not initialize file saver")
+		return saver
+	case "memory":
+		return persistence.NewMemorySaver()
+	default:
+		saver, err := persistence.NewDatastoreSaver(context.Background(), env.Project)
+		rtx.Must(err, "Could not initialize datastore saver")
+		return saver
+	}
+}
 
-	tk, err := tracker.InitTracker(
-		context.Background(),
-		dsiface.AdaptClient(client), dsKey,
+func mustStandardTracker(ctx context.Context) *tracker.Tracker {
+	tk, err := tracker.NewTracker(
+		context.Background(), mustTrackerSaver(),
 		time.Minute, *jobExpirationTime, *jobCleanupDelay)
 	rtx.Must(err, "tracker init")
 	if tk == nil {
 		log.Fatal("nil tracker")
 	}
+	if *historyFile != "" {
+		tk.SetArchive(tracker.NewFileArchive(*historyFile))
+	}
+	if *leaseDuration > 0 {
+		tk.SetLeasePolicy(ctx, *leaseDuration, *maxLeaseLosses, time.Minute)
+	}
 
 	return tk
 }
 
-func mustCreateJobService(ctx context.Context, mux *http.ServeMux) {
+func mustCreateJobService(ctx context.Context, mux *http.ServeMux, tk *tracker.Tracker) {
 	storageClient, err := storage.NewClient(ctx)
 	rtx.Must(err, "Could not create storage client for job service")
 
-	saver, err := persistence.NewDatastoreSaver(context.Background(), os.Getenv("PROJECT"))
-	rtx.Must(err, "Could not initialize datastore saver")
-	svc, err := job.NewJobService(ctx, globalTracker, config.StartDate(),
-		os.Getenv("PROJECT"), config.Sources(), saver,
+	svc, err := job.NewJobService(ctx, tk, config.StartDate(),
+		os.Getenv("PROJECT"), config.Sources(), mustStateSaver(),
 		stiface.AdaptClient(storageClient))
 	rtx.Must(err, "Could not initialize job service")
+	if schedule := config.Schedule(); len(schedule) > 0 {
+		rtx.Must(svc.SetSchedule(ctx, schedule), "Invalid job source schedule")
+	}
+	svc.SetOperatorToken(*operatorToken)
 	mux.HandleFunc("/job", svc.JobHandler)
+	mux.HandleFunc("/v1/batch", svc.BatchHandler)
+}
+
+// runManager starts the tracker, the monitor and the job service, and
+// registers their handlers on mux.
+func runManager(ctx context.Context, mux *http.ServeMux) {
+	tk := mustStandardTracker(ctx)
+	setGlobalTracker(tk)
+
+	// TODO - refactor this block.
+	cloudCfg := cloud.Config{
+		Project: env.Project,
+		Client:  nil}
+	bqConfig := NewBQConfig(cloudCfg)
+	bqConfig.BQFinalDataset = "base_tables"
+	bqConfig.BQBatchDataset = "batch"
+	monitor, err := ops.NewStandardMonitor(ctx, bqConfig, tk)
+	rtx.Must(err, "NewStandardMonitor failed")
+	rtx.Must(monitor.AddSourcePipelines(config.Sources()), "Invalid pipeline config")
+	tk.SetDefaultPipeline(monitor.DefaultStates())
+	monitor.AddSourceDependencies(config.Sources())
+	monitor.AddRetryPolicies(config.RetryPolicies())
+	monitor.AddConcurrencyLimits(config.ActionLimits(), config.DatatypeLimits())
+	if window, budgets := config.Budgets(); window > 0 && len(budgets) > 0 {
+		budget := ops.NewBudgetManagerFromConfig(window, budgets)
+		budget.SetSaver(ctx, mustStateSaver())
+		monitor.SetBudgetManager(budget)
+	}
+	storageClient, err := storage.NewClient(ctx)
+	rtx.Must(err, "Could not create storage client for monitor")
+	monitor.SetStorageClient(stiface.AdaptClient(storageClient))
+	if *dryRun {
+		log.Println("Dry run mode: post processing will not mutate any tables")
+		monitor.SetDryRun(true)
+	}
+	go monitor.Watch(ctx, 5*time.Second)
+
+	handler := tracker.NewHandler(tk)
+	handler.SetOperatorToken(*operatorToken)
+	handler.Register(mux)
+
+	mustCreateJobService(ctx, mux, tk)
+
+	if nc := config.Notifications(); nc.Enabled() {
+		go mustCreateNotifier(ctx, nc).Watch(ctx, tk)
+	}
+}
+
+// mustCreateNotifier creates a Notifier for the configured receivers, which
+// reports each job's partition of its final table.
+func mustCreateNotifier(ctx context.Context, nc config.NotificationConfig) *notify.Notifier {
+	notifier, err := notify.NewNotifierFromConfig(ctx, env.Project, nc)
+	rtx.Must(err, "Could not create notifier")
+	bqClient, err := bigquery.NewClient(ctx, env.Project)
+	rtx.Must(err, "Could not create bigquery client for notifier")
+	client := bqiface.AdaptClient(bqClient)
+	notifier.SetPartitionFunc(func(ctx context.Context, j tracker.Job) (string, int64, error) {
+		to, err := bq.NewTableOpsWithClient(client, j, env.Project, "")
+		if err != nil {
+			return "", 0, err
+		}
+		return to.FinalPartition(ctx)
+	})
+	return notifier
+}
+
+// The holder of the leader lease, when running with -leader_election.
+var (
+	leaderLock sync.Mutex
+	leader     string
+)
+
+// Whether this instance is a standby, waiting to be elected.
+var (
+	standbyLock sync.Mutex
+	standby     bool
+)
+
+func setStandby(s bool) {
+	standbyLock.Lock()
+	defer standbyLock.Unlock()
+	standby = s
+}
+
+func isStandby() bool {
+	standbyLock.Lock()
+	defer standbyLock.Unlock()
+	return standby
+}
+
+func setLeader(id string) {
+	leaderLock.Lock()
+	defer leaderLock.Unlock()
+	leader = id
+}
+
+func getLeader() string {
+	leaderLock.Lock()
+	defer leaderLock.Unlock()
+	return leader
+}
+
+// switchHandler serves requests with a handler that is replaced when a
+// standby instance refreshes its snapshot, or becomes the leader.
+type switchHandler struct {
+	lock    sync.Mutex
+	handler http.Handler
+}
+
+func (sh *switchHandler) set(h http.Handler) {
+	sh.lock.Lock()
+	defer sh.lock.Unlock()
+	sh.handler = h
+}
+
+func (sh *switchHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	sh.lock.Lock()
+	h := sh.handler
+	sh.lock.Unlock()
+	h.ServeHTTP(w, r)
+}
+
+// newMainMux returns a mux for the main server, with the status and health
+// handlers.
+func newMainMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", Status)
+	mux.HandleFunc("/status", Status)
+
+	// TODO - do we want different health checks for manager mode?
+	mux.HandleFunc("/alive", healthCheck)
+	mux.HandleFunc("/ready", readyCheck)
+	return mux
+}
+
+// mustElector creates the leader Elector for the -persistence mode.
+func mustElector() persistence.Elector {
+	switch persistenceMode.Value {
+	case "file":
+		rtx.Must(os.MkdirAll(*persistenceDir, 0755), "Could not create persistence dir")
+		return persistence.NewFileElector(filepath.Join(*persistenceDir, "leader.lock"))
+	case "memory":
+		log.Fatal("-leader_election requires datastore or file persistence")
+		return nil
+	default:
+		elector, err := persistence.NewDatastoreElector(context.Background(), env.Project, "manager")
+		rtx.Must(err, "Could not initialize datastore elector")
+		return elector
+	}
+}
+
+// runStandby serves read-only status from snapshots of the leader's saved
+// tracker state until this instance is elected, and then runs the manager.
+// The instance is not ready until it is elected.
+// If the instance later loses the lease, it shuts down, so that it restarts
+// as a standby instead of acting on jobs that the new leader now manages.
+func runStandby(ctx context.Context, sh *switchHandler, elector persistence.Elector) {
+	id := *instanceID
+	if id == "" {
+		var err error
+		id, err = os.Hostname()
+		rtx.Must(err, "Could not get hostname for -instance_id")
+	}
+	saver := mustTrackerSaver()
+	snapshot := func() {
+		if l, err := elector.Current(ctx); err == nil {
+			setLeader(l.Holder)
+		}
+		tk, err := tracker.LoadSnapshot(ctx, saver)
+		if err != nil {
+			log.Println("Could not load tracker snapshot:", err)
+			return
+		}
+		setGlobalTracker(tk)
+		mux := newMainMux()
+		tracker.NewHandler(tk).RegisterReadOnly(mux)
+		sh.set(mux)
+	}
+
+	elected := make(chan context.Context, 1)
+	go func() {
+		leaderCtx, err := persistence.Campaign(ctx, elector, id, *leaderLease)
+		if err == nil {
+			elected <- leaderCtx
+		}
+	}()
+	log.Println("Running as standby", id)
+	snapshot()
+	ticker := time.NewTicker(*leaderLease)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			snapshot()
+		case leaderCtx := <-elected:
+			log.Println("Running as leader", id)
+			setLeader(id)
+			mux := newMainMux()
+			runManager(leaderCtx, mux)
+			sh.set(mux)
+			setStandby(false)
+			<-leaderCtx.Done()
+			if ctx.Err() == nil {
+				log.Println("Lost the leader lease, shutting down")
+				mainCancel()
+			}
+			return
+		}
+	}
 }
 
 // ###############################################################################
@@ -371,45 +668,31 @@ func main() {
 	defer statusServer.Close()
 	log.Println("Status server at", statusServer.Addr)
 
-	mux := http.NewServeMux()
+	mux := newMainMux()
 	// Start up the main job and update server.
 	server := &http.Server{
 		Addr:    ":8080",
 		Handler: mux,
 	}
 
-	mux.HandleFunc("/", Status)
-	mux.HandleFunc("/status", Status)
-
-	// TODO - do we want different health checks for manager mode?
-	mux.HandleFunc("/alive", healthCheck)
-	mux.HandleFunc("/ready", healthCheck)
-
 	switch env.ServiceMode {
 	case "manager":
 		// This is new new "manager" mode, in which Gardener provides /job and /update apis
 		// for parsers to get work and report progress.
 		// TODO Once the legacy deployments are turned down, this should move to head of main().
 		config.ParseConfig()
-
-		globalTracker = mustStandardTracker()
-
-		// TODO - refactor this block.
-		cloudCfg := cloud.Config{
-			Project: env.Project,
-			Client:  nil}
-		bqConfig := NewBQConfig(cloudCfg)
-		bqConfig.BQFinalDataset = "base_tables"
-		bqConfig.BQBatchDataset = "batch"
-		monitor, err := ops.NewStandardMonitor(mainCtx, bqConfig, globalTracker)
-		rtx.Must(err, "NewStandardMonitor failed")
-		go monitor.Watch(mainCtx, 5*time.Second)
-
-		handler := tracker.NewHandler(globalTracker)
-		handler.Register(mux)
-
-		mustCreateJobService(mainCtx, mux)
-
+		rtx.Must(bq.RegisterDatatypes(config.Datatypes()), "Invalid datatype config")
+		rtx.Must(bq.RegisterSourceTables(config.Sources(), env.Project), "Invalid table config")
+		bq.SetBackupFromConfig(config.Backup())
+
+		if *leaderElection {
+			sh := &switchHandler{handler: mux}
+			server.Handler = sh
+			setStandby(true)
+			go runStandby(mainCtx, sh, mustElector())
+		} else {
+			runManager(mainCtx, mux)
+		}
 		healthy = true
 		log.Println("Running as manager service")
 	case "legacy":
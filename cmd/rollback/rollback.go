@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/m-lab/go/flagx"
+	"github.com/m-lab/go/rtx"
+
+	"github.com/m-lab/etl-gardener/cloud/bq"
+	"github.com/m-lab/etl-gardener/config"
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+var (
+	project    = flag.String("project", os.Getenv("PROJECT"), "GCP project")
+	experiment = flag.String("experiment", "ndt", "experiment")
+	datatype   = flag.String("datatype", "ndt7", "datatype")
+	date       = flag.String("date", "", "partition date")
+)
+
+var usageText = `
+NAME
+  rollback - restore a partition from the backup made before it was last replaced
+
+DESCRIPTION
+  rollback restores the raw partition of a single experiment/datatype/date, and
+  the joined partition if the datatype is joined, from the backups that gardener
+  made before the most recent copy and join.  It uses the datatypes, sources and
+  backup dataset in the gardener config file.
+
+EXAMPLES
+  rollback -config_path=config.yml -project=mlab-sandbox -datatype=ndt7 -date=2020-03-01
+`
+
+func init() {
+	// Always prepend the filename and line number.
+	log.SetFlags(log.LstdFlags | log.Lshortfile)
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usageText)
+		flag.PrintDefaults()
+	}
+}
+
+func main() {
+	ctx := context.Background()
+
+	flag.Parse()
+	rtx.Must(flagx.ArgsFromEnv(flag.CommandLine), "Could not get args from env")
+
+	d, err := time.Parse("2006-01-02", *date)
+	rtx.Must(err, "Invalid date")
+	config.ParseConfig()
+	rtx.Must(bq.RegisterDatatypes(config.Datatypes()), "Invalid datatype config")
+	rtx.Must(bq.RegisterSourceTables(config.Sources(), *project), "Invalid table config")
+	bq.SetBackupFromConfig(config.Backup())
+
+	j := tracker.NewJob("unused-bucket", *experiment, *datatype, d)
+	log.Println(j)
+	to, err := bq.NewTableOps(ctx, j, *project, "")
+	rtx.Must(err, "NewTableOps failed")
+	rtx.Must(to.Rollback(ctx), "Rollback failed")
+}
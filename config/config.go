@@ -9,6 +9,7 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/kelseyhightower/envconfig"
@@ -23,6 +24,51 @@ type TrackerConfig struct {
 // MonitorConfig holds the config for the state machine monitor.
 type MonitorConfig struct {
 	PollingInterval time.Duration `yaml:"polling_interval"`
+	// Retry policies for the actions of particular states.
+	Retry []RetryConfig `yaml:"retry"`
+	// ActionLimits limits the number of jobs that run the action of a state
+	// concurrently, e.g. {deduplicating: 3}.
+	ActionLimits map[string]int `yaml:"action_limits"`
+	// DatatypeLimits limits the number of jobs of a datatype that run any
+	// action concurrently.
+	DatatypeLimits map[string]int `yaml:"datatype_limits"`
+	// Budgets limit the BigQuery resources used by each datatype's queries
+	// over the BudgetWindow.  Dedup and join actions are paused while a
+	// datatype exceeds its budget.
+	BudgetWindow time.Duration  `yaml:"budget_window"`
+	Budgets      []BudgetConfig `yaml:"budgets"`
+}
+
+// BudgetConfig sets the query budget of a datatype.  The budget without a
+// datatype applies to all datatypes without their own budget.  Zero values
+// are unlimited.
+type BudgetConfig struct {
+	Datatype  string  `yaml:"datatype"`
+	SlotHours float64 `yaml:"slot_hours"`
+	Bytes     int64   `yaml:"bytes"` // Bytes processed.
+}
+
+// RetryConfig sets the retry policy for the action of a state.  Zero valued
+// fields use the monitor's default policy.
+type RetryConfig struct {
+	State string `yaml:"state"`
+	// MaxAttempts after which the job is failed.  Negative means unlimited.
+	MaxAttempts int `yaml:"max_attempts"`
+	// InitialDelay is doubled after each attempt, up to MaxDelay.
+	InitialDelay time.Duration `yaml:"initial_delay"`
+	MaxDelay     time.Duration `yaml:"max_delay"`
+	// Jitter randomizes the delays by up to this fraction.
+	Jitter float64 `yaml:"jitter"`
+}
+
+// DependencyConfig declares that jobs of a source must wait for jobs of another
+// datatype to complete before joining.
+type DependencyConfig struct {
+	Experiment string `yaml:"experiment"` // Defaults to the source's experiment.
+	Datatype   string `yaml:"datatype"`
+	// DateOffsets are the dates, in days relative to the job date, that must be
+	// complete, e.g. [-1, 0].  Defaults to [0].
+	DateOffsets []int `yaml:"date_offsets"`
 }
 
 // SourceConfig holds the config that defines all data sources to be processed.
@@ -31,15 +77,157 @@ type SourceConfig struct {
 	Experiment string `yaml:"experiment"`
 	Datatype   string `yaml:"datatype"`
 	Filter     string `yaml:"filter"`
-	Target     string `yaml:"target"`
+	Target     string `yaml:"target"` // The load table as dataset.table, superseded by LoadTable, or gs://bucket/prefix.
+	// The tables that the source's data is loaded into, copied to, and joined
+	// into, as [project.]dataset.table.  The project defaults to the Gardener
+	// project, and the tables default to tmp_<experiment>.<datatype>,
+	// raw_<experiment>.<datatype> and <experiment>.<datatype>.
+	LoadTable   string `yaml:"load_table"`
+	RawTable    string `yaml:"raw_table"`
+	JoinedTable string `yaml:"joined_table"`
+	// Export is an optional gs://bucket/prefix that the final table partition
+	// of each job is exported to, in ExportFormat: avro, parquet or json
+	// (newline delimited, the default).  The standard pipeline of a source
+	// with an Export ends with an exporting state.
+	Export       string `yaml:"export"`
+	ExportFormat string `yaml:"export_format"`
+	// Pipeline optionally lists the post processing states, e.g. [loading, deduplicating],
+	// for this source.  If empty, the standard pipeline is used.
+	Pipeline []string `yaml:"pipeline"`
+	// DependsOn lists the datatypes that must be complete before joining.
+	DependsOn []DependencyConfig `yaml:"depends_on"`
+}
+
+// qualify prepends the project to a dataset.table name.
+func qualify(table, project string) string {
+	if strings.Count(table, ".") == 1 {
+		return project + "." + table
+	}
+	return table
+}
+
+// TableNames returns the fully qualified names of the source's load, raw
+// and joined tables, using the defaults for any that are not configured.
+func (s SourceConfig) TableNames(project string) (load, raw, joined string) {
+	load, raw, joined = s.LoadTable, s.RawTable, s.JoinedTable
+	if load == "" && !strings.HasPrefix(s.Target, "gs://") {
+		load = s.Target
+	}
+	if load == "" {
+		load = "tmp_" + s.Experiment + "." + s.Datatype
+	}
+	if raw == "" {
+		raw = "raw_" + s.Experiment + "." + s.Datatype
+	}
+	if joined == "" {
+		joined = s.Experiment + "." + s.Datatype
+	}
+	return qualify(load, project), qualify(raw, project), qualify(joined, project)
+}
+
+// DatatypeConfig describes the table properties of a datatype, so that
+// new datatypes can be processed without code changes.
+type DatatypeConfig struct {
+	Name string `yaml:"name"`
+	// PartitionKeys maps single field names to fully qualified field names.
+	PartitionKeys map[string]string `yaml:"partition_keys"`
+	// OrderKeys are prepended to the dedup ORDER BY clause, and should end with a comma.
+	OrderKeys    string `yaml:"order_keys"`
+	DateField    string `yaml:"date_field"`
+	SourceFormat string `yaml:"source_format"` // json, avro, parquet, or csv
+	Join         bool   `yaml:"join"`
+	// Load options.  Compression is none, gzip (json and csv), or deflate or
+	// snappy (avro).  SchemaUpdateOptions may include ALLOW_FIELD_ADDITION and
+	// ALLOW_FIELD_RELAXATION.  SkipLeadingRows applies to csv only.
+	Compression         string   `yaml:"compression"`
+	SchemaUpdateOptions []string `yaml:"schema_update_options"`
+	MaxBadRecords       int64    `yaml:"max_bad_records"`
+	SkipLeadingRows     int64    `yaml:"skip_leading_rows"`
+	// SchemaFile is an optional BigQuery json schema file for the datatype's
+	// load and raw tables.  If set, missing tables are created, partitioned by
+	// the DateField and clustered by the Clustering fields, and the schemas
+	// of existing tables are checked before loading.  SchemaChanges is
+	// "report" (the default) to log fields missing from a table, or "apply"
+	// to add them.  RequirePartitionFilter makes created tables require a
+	// partition filter in queries.
+	SchemaFile             string   `yaml:"schema_file"`
+	Clustering             []string `yaml:"clustering"`
+	SchemaChanges          string   `yaml:"schema_changes"`
+	RequirePartitionFilter bool     `yaml:"require_partition_filter"`
+	// Validation configures the checks of the validating state.
+	Validation ValidationConfig `yaml:"validation"`
+}
+
+// ValidationConfig configures the checks applied to a job's deduplicated
+// partition before it replaces the raw partition.  Zero values disable
+// each check.
+type ValidationConfig struct {
+	// The partition must have at least these fractions of the rows of the
+	// current raw partition, and of the average raw partition within
+	// NeighbourDays (default 3) days.
+	MinPreviousRatio  float64 `yaml:"min_previous_ratio"`
+	MinNeighbourRatio float64 `yaml:"min_neighbour_ratio"`
+	NeighbourDays     int     `yaml:"neighbour_days"`
+	// MaxNullRates maps key fields to the maximum fraction of NULL values.
+	MaxNullRates map[string]float64 `yaml:"max_null_rates"`
+	// Values of the TimeField timestamp must be within MaxTimeSkew of the
+	// partition date.
+	TimeField   string        `yaml:"time_field"`
+	MaxTimeSkew time.Duration `yaml:"max_time_skew"`
+}
+
+// ScheduleConfig sets the priority and weight of a kind of job source in the
+// job service, i.e. daily, adhoc, backfill or retry.
+type ScheduleConfig struct {
+	Source string `yaml:"source"`
+	// Sources with lower Priority values are always served first.
+	Priority int `yaml:"priority"`
+	// Sources with the same Priority share jobs in proportion to their
+	// Weight.  Defaults to 1.
+	Weight int `yaml:"weight"`
+}
+
+// BackupConfig configures the backups of partitions that are replaced by
+// the copy and join actions.  Backups are disabled if Dataset is empty.
+type BackupConfig struct {
+	// Dataset holds the backup tables, in the same project as the backed up
+	// tables.  It is created if necessary.
+	Dataset string `yaml:"dataset"`
+	// Backups expire after Retention.  Zero means never.
+	Retention time.Duration `yaml:"retention"`
+}
+
+// NotificationConfig configures the notifications sent when jobs become
+// complete or failed.  Notifications are disabled if there are no webhooks
+// and no topic.
+type NotificationConfig struct {
+	Webhooks []string `yaml:"webhooks"` // URLs to which notifications are POSTed.
+	// Topic is a Pub/Sub topic ID in the Gardener project, or a full
+	// projects/<project>/topics/<id> name.
+	Topic string `yaml:"topic"`
+	// Retry applies to each delivery.  The state is ignored.
+	Retry RetryConfig `yaml:"retry"`
+	// Notifications that cannot be delivered are logged, and appended to
+	// DeadLetterFile as json lines, if set.
+	DeadLetterFile string `yaml:"dead_letter_file"`
+}
+
+// Enabled returns true if notifications have a destination.
+func (nc NotificationConfig) Enabled() bool {
+	return len(nc.Webhooks) > 0 || nc.Topic != ""
 }
 
 // Gardener is the full config for a Gardener instance.
 type Gardener struct {
-	StartDate time.Time      `yaml:"start_date"`
-	Tracker   TrackerConfig  `yaml:"tracker"`
-	Monitor   MonitorConfig  `yaml:"monitor"`
-	Sources   []SourceConfig `yaml:"sources"`
+	StartDate time.Time        `yaml:"start_date"`
+	Tracker   TrackerConfig    `yaml:"tracker"`
+	Monitor   MonitorConfig    `yaml:"monitor"`
+	Datatypes []DatatypeConfig `yaml:"datatypes"`
+	Sources   []SourceConfig   `yaml:"sources"`
+	Schedule  []ScheduleConfig `yaml:"schedule"`
+	Backup    BackupConfig     `yaml:"backup"`
+
+	Notifications NotificationConfig `yaml:"notifications"`
 }
 
 var gardener Gardener
@@ -51,6 +239,65 @@ func Sources() []SourceConfig {
 	return src
 }
 
+// Datatypes returns the list of datatype descriptions from the config.
+func Datatypes() []DatatypeConfig {
+	dt := make([]DatatypeConfig, len(gardener.Datatypes))
+	copy(dt, gardener.Datatypes)
+	return dt
+}
+
+// Schedule returns the job source schedule.  If empty, the job service
+// uses its default schedule.
+func Schedule() []ScheduleConfig {
+	sc := make([]ScheduleConfig, len(gardener.Schedule))
+	copy(sc, gardener.Schedule)
+	return sc
+}
+
+// RetryPolicies returns the retry policies for the monitor's actions.
+func RetryPolicies() []RetryConfig {
+	rc := make([]RetryConfig, len(gardener.Monitor.Retry))
+	copy(rc, gardener.Monitor.Retry)
+	return rc
+}
+
+// ActionLimits returns the concurrency limits of the monitor's actions, by state.
+func ActionLimits() map[string]int {
+	return copyLimits(gardener.Monitor.ActionLimits)
+}
+
+// DatatypeLimits returns the concurrency limits of the monitor's actions, by datatype.
+func DatatypeLimits() map[string]int {
+	return copyLimits(gardener.Monitor.DatatypeLimits)
+}
+
+func copyLimits(limits map[string]int) map[string]int {
+	m := make(map[string]int, len(limits))
+	for k, v := range limits {
+		m[k] = v
+	}
+	return m
+}
+
+// Budgets returns the query budget window and the budgets of the datatypes.
+func Budgets() (time.Duration, []BudgetConfig) {
+	b := make([]BudgetConfig, len(gardener.Monitor.Budgets))
+	copy(b, gardener.Monitor.Budgets)
+	return gardener.Monitor.BudgetWindow, b
+}
+
+// Backup returns the partition backup config.
+func Backup() BackupConfig {
+	return gardener.Backup
+}
+
+// Notifications returns the job notification config.
+func Notifications() NotificationConfig {
+	nc := gardener.Notifications
+	nc.Webhooks = append([]string(nil), nc.Webhooks...)
+	return nc
+}
+
 // StartDate returns the first date that should be processed.
 func StartDate() time.Time {
 	return gardener.StartDate.UTC().Truncate(24 * time.Hour)
@@ -4,6 +4,7 @@ import (
 	"flag"
 	"log"
 	"testing"
+	"time"
 
 	"github.com/m-lab/etl-gardener/config"
 	"github.com/m-lab/go/flagx"
@@ -22,4 +23,94 @@ func TestBasic(t *testing.T) {
 
 	config.ParseConfig()
 
+	dt := config.Datatypes()
+	if len(dt) != 2 {
+		t.Fatal("Expected 2 datatypes:", dt)
+	}
+	if dt[0].Name != "tcpinfo" || !dt[0].Join || dt[0].PartitionKeys["Timestamp"] != "FinalSnapshot.Timestamp" {
+		t.Errorf("Bad tcpinfo datatype: %+v", dt[0])
+	}
+	if dt[0].Compression != "gzip" || dt[0].MaxBadRecords != 5 {
+		t.Errorf("Bad tcpinfo load options: %+v", dt[0])
+	}
+	if dt[1].SourceFormat != "avro" || dt[1].Join {
+		t.Errorf("Bad ndt5 datatype: %+v", dt[1])
+	}
+
+	rc := config.RetryPolicies()
+	if len(rc) != 1 || rc[0].State != "loading" || rc[0].MaxAttempts != 3 || rc[0].InitialDelay != time.Minute {
+		t.Errorf("Bad retry policies: %+v", rc)
+	}
+
+	if al, dl := config.ActionLimits(), config.DatatypeLimits(); al["deduplicating"] != 3 || dl["tcpinfo"] != 1 {
+		t.Errorf("Bad concurrency limits: %v %v", al, dl)
+	}
+
+	if w, b := config.Budgets(); w != 6*time.Hour || len(b) != 1 || b[0].Datatype != "tcpinfo" || b[0].SlotHours != 10.5 {
+		t.Errorf("Bad budgets: %v %+v", w, b)
+	}
+
+	src := config.Sources()
+	if load, _, joined := src[0].TableNames("proj"); load != "proj.staging_tmp_ndt.tcpinfo" ||
+		joined != "other-project.staging_ndt.tcpinfo" {
+		t.Errorf("Bad tables: %s %s", load, joined)
+	}
+
+	sc := config.Schedule()
+	if len(sc) != 3 || sc[1].Source != "backfill" || sc[1].Priority != 1 || sc[1].Weight != 3 {
+		t.Errorf("Bad schedule: %+v", sc)
+	}
+
+	nc := config.Notifications()
+	if !nc.Enabled() || len(nc.Webhooks) != 1 || nc.Topic != "gardener-jobs" || nc.Retry.MaxAttempts != 2 ||
+		nc.DeadLetterFile != "/tmp/dead.jsonl" {
+		t.Errorf("Bad notifications: %+v", nc)
+	}
+}
+
+func TestSourceConfig_TableNames(t *testing.T) {
+	tests := []struct {
+		name              string
+		src               config.SourceConfig
+		load, raw, joined string
+	}{
+		{
+			name:   "defaults",
+			src:    config.SourceConfig{Experiment: "ndt", Datatype: "ndt7"},
+			load:   "proj.tmp_ndt.ndt7",
+			raw:    "proj.raw_ndt.ndt7",
+			joined: "proj.ndt.ndt7",
+		},
+		{
+			name:   "target",
+			src:    config.SourceConfig{Experiment: "ndt", Datatype: "ndt7", Target: "tmp_x.ndt7"},
+			load:   "proj.tmp_x.ndt7",
+			raw:    "proj.raw_ndt.ndt7",
+			joined: "proj.ndt.ndt7",
+		},
+		{
+			name:   "gcs target",
+			src:    config.SourceConfig{Experiment: "ndt", Datatype: "ndt7", Target: "gs://bucket/prefix"},
+			load:   "proj.tmp_ndt.ndt7",
+			raw:    "proj.raw_ndt.ndt7",
+			joined: "proj.ndt.ndt7",
+		},
+		{
+			name: "configured",
+			src: config.SourceConfig{Experiment: "ndt", Datatype: "ndt7", Target: "tmp_x.ndt7",
+				LoadTable: "staging_tmp.ndt7", RawTable: "other.staging_raw.ndt7", JoinedTable: "staging.ndt7"},
+			load:   "proj.staging_tmp.ndt7",
+			raw:    "other.staging_raw.ndt7",
+			joined: "proj.staging.ndt7",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			load, raw, joined := tt.src.TableNames("proj")
+			if load != tt.load || raw != tt.raw || joined != tt.joined {
+				t.Errorf("TableNames() = %s, %s, %s; want %s, %s, %s",
+					load, raw, joined, tt.load, tt.raw, tt.joined)
+			}
+		})
+	}
 }
@@ -0,0 +1,59 @@
+package config
+
+import (
+	"math/rand"
+	"time"
+)
+
+// A RetryPolicy determines how often, and how long after each failure, an
+// operation is retried.
+type RetryPolicy struct {
+	// MaxAttempts is the number of attempts after which the operation fails.
+	// Zero or negative means unlimited.
+	MaxAttempts int
+	// The delay after the first failure, doubled after each further failure,
+	// up to MaxDelay.
+	InitialDelay time.Duration
+	MaxDelay     time.Duration
+	// Jitter randomizes each delay by up to this fraction, e.g. 0.2, so that
+	// operations that fail together are not retried together.
+	Jitter float64
+}
+
+// WithConfig returns the policy, with the non-zero fields of the config.
+func (p RetryPolicy) WithConfig(rc RetryConfig) RetryPolicy {
+	if rc.MaxAttempts != 0 {
+		p.MaxAttempts = rc.MaxAttempts
+	}
+	if rc.InitialDelay != 0 {
+		p.InitialDelay = rc.InitialDelay
+	}
+	if rc.MaxDelay != 0 {
+		p.MaxDelay = rc.MaxDelay
+	}
+	if rc.Jitter != 0 {
+		p.Jitter = rc.Jitter
+	}
+	return p
+}
+
+// Delay returns the delay before retrying after the given number of failed
+// attempts.
+func (p RetryPolicy) Delay(attempts int) time.Duration {
+	delay := p.InitialDelay
+	for i := 1; i < attempts && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+	if p.MaxDelay > 0 && delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	if p.Jitter > 0 {
+		delay += time.Duration(p.Jitter * (2*rand.Float64() - 1) * float64(delay))
+	}
+	return delay
+}
+
+// Exhausted returns true if no attempts remain.
+func (p RetryPolicy) Exhausted(attempts int) bool {
+	return p.MaxAttempts > 0 && attempts >= p.MaxAttempts
+}
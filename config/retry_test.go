@@ -0,0 +1,44 @@
+package config_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/m-lab/etl-gardener/config"
+)
+
+func TestRetryPolicy_Delay(t *testing.T) {
+	p := config.RetryPolicy{InitialDelay: time.Minute, MaxDelay: 10 * time.Minute}
+	want := []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute, 8 * time.Minute, 10 * time.Minute, 10 * time.Minute}
+	for i, w := range want {
+		if d := p.Delay(i + 1); d != w {
+			t.Errorf("Delay(%d) = %v, want %v", i+1, d, w)
+		}
+	}
+
+	p.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		if d := p.Delay(2); d < time.Minute || d > 3*time.Minute {
+			t.Fatal("Jitter out of range:", d)
+		}
+	}
+
+	p.MaxAttempts = 3
+	if p.Exhausted(2) || !p.Exhausted(3) {
+		t.Error("Wrong Exhausted")
+	}
+	if (config.RetryPolicy{}).Exhausted(1000) {
+		t.Error("Zero MaxAttempts should be unlimited")
+	}
+}
+
+func TestRetryPolicy_WithConfig(t *testing.T) {
+	base := config.RetryPolicy{MaxAttempts: 10, InitialDelay: time.Minute, MaxDelay: time.Hour, Jitter: 0.2}
+	p := base.WithConfig(config.RetryConfig{State: "loading", MaxAttempts: 3, MaxDelay: 2 * time.Hour})
+	want := base
+	want.MaxAttempts = 3
+	want.MaxDelay = 2 * time.Hour
+	if p != want {
+		t.Errorf("Wrong policy: %+v", p)
+	}
+}
@@ -0,0 +1,295 @@
+package job
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/datastore"
+
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+// Errors returned for invalid batch requests.
+var (
+	ErrUnknownSource    = errors.New("no source for experiment/datatype")
+	ErrInvalidDateRange = errors.New("invalid date range")
+	ErrNoSuchBatch      = errors.New("no such batch")
+	ErrInvalidFilter    = errors.New("invalid filter")
+)
+
+// maxBatches limits the number of fully dispatched batches that are kept
+// for progress reporting.
+const maxBatches = 100
+
+// maxBatchDays limits the number of dates in a batch.
+const maxBatchDays = 366
+
+// Batch is a set of ad-hoc jobs, e.g. to reprocess one datatype for a date
+// range after a parser fix.  By default, batch jobs are dispatched ahead of
+// the background cycle.
+type Batch struct {
+	ID        string
+	Submitted time.Time
+	Jobs      []tracker.JobWithTarget
+	Next      int // Index of the next job to dispatch.
+}
+
+func (b *Batch) done() bool {
+	return b.Next >= len(b.Jobs)
+}
+
+// BatchQueue holds the pending and recently dispatched batches.  It
+// implements persistence.StateObject, so that pending batches survive restarts.
+type BatchQueue struct {
+	Batches []*Batch
+	NextID  int
+}
+
+// Save implements datastore.PropertyLoadSaver.  The batches are encoded
+// as json, because datastore doesn't handle nested slices.
+func (q *BatchQueue) Save() ([]datastore.Property, error) {
+	b, err := json.Marshal(q)
+	if err != nil {
+		return nil, err
+	}
+	return []datastore.Property{{Name: "JSON", Value: b, NoIndex: true}}, nil
+}
+
+// Load implements datastore.PropertyLoadSaver
+func (q *BatchQueue) Load(ps []datastore.Property) error {
+	for _, p := range ps {
+		if b, ok := p.Value.([]byte); ok && p.Name == "JSON" {
+			return json.Unmarshal(b, q)
+		}
+	}
+	return nil
+}
+
+// GetName implements StateObject.GetName
+func (q BatchQueue) GetName() string {
+	return "singleton" // There is only one job service.
+}
+
+// GetKind implements StateObject.GetKind
+func (q BatchQueue) GetKind() string {
+	return reflect.TypeOf(q).String()
+}
+
+// nextJob returns the next job from the oldest batch with undispatched jobs,
+// or nil if there are none.
+// Not thread-safe.
+func (q *BatchQueue) nextJob() *tracker.JobWithTarget {
+	for _, b := range q.Batches {
+		if !b.done() {
+			job := b.Jobs[b.Next]
+			b.Next++
+			return &job
+		}
+	}
+	return nil
+}
+
+// add appends a batch, and drops the oldest dispatched batches beyond maxBatches.
+// Not thread-safe.
+func (q *BatchQueue) add(b *Batch) {
+	q.Batches = append(q.Batches, b)
+	for len(q.Batches) > maxBatches && q.Batches[0].done() {
+		q.Batches = q.Batches[1:]
+	}
+}
+
+func (q *BatchQueue) get(id string) *Batch {
+	for _, b := range q.Batches {
+		if b.ID == id {
+			return b
+		}
+	}
+	return nil
+}
+
+// BatchProgress summarizes the progress of a Batch.
+type BatchProgress struct {
+	ID        string
+	Submitted time.Time
+	Total     int
+	// Pending is the number of jobs not yet dispatched.
+	Pending int
+	// States counts the dispatched jobs in each tracker state.  Jobs that
+	// are no longer in the tracker, e.g. because they completed and were
+	// cleaned up, are counted as "removed".
+	States map[string]int
+}
+
+// SubmitBatch enqueues jobs for an experiment/datatype source, for each date
+// from start to end inclusive, up to maxBatchDays dates.  If filter is
+// non-empty, it must be a valid regular expression, and replaces the source's
+// Filter.
+func (svc *Service) SubmitBatch(ctx context.Context, experiment, datatype string, start, end time.Time, filter string) (*Batch, error) {
+	start = start.UTC().Truncate(24 * time.Hour)
+	end = end.UTC().Truncate(24 * time.Hour)
+	if start.IsZero() || end.Before(start) || time.Since(end) < 24*time.Hour {
+		return nil, ErrInvalidDateRange
+	}
+	if days := int(end.Sub(start)/(24*time.Hour)) + 1; days > maxBatchDays {
+		return nil, fmt.Errorf("%w: %d days, limit is %d", ErrInvalidDateRange, days, maxBatchDays)
+	}
+	if _, err := regexp.Compile(filter); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidFilter, err)
+	}
+	var spec *tracker.JobWithTarget
+	for i := range svc.jobSpecs {
+		if svc.jobSpecs[i].Experiment == experiment && svc.jobSpecs[i].Datatype == datatype {
+			spec = &svc.jobSpecs[i]
+			break
+		}
+	}
+	if spec == nil {
+		return nil, ErrUnknownSource
+	}
+
+	jobs := make([]tracker.JobWithTarget, 0)
+	for date := start; !date.After(end); date = date.AddDate(0, 0, 1) {
+		job := *spec
+		job.Date = date
+		if filter != "" {
+			job.Filter = filter
+		}
+		jobs = append(jobs, job)
+	}
+
+	svc.lock.Lock()
+	defer svc.lock.Unlock()
+	svc.batches.NextID++
+	b := &Batch{
+		ID:        strconv.Itoa(svc.batches.NextID),
+		Submitted: time.Now(),
+		Jobs:      jobs,
+	}
+	svc.batches.add(b)
+	log.Printf("Batch %s: %d %s/%s jobs from %s to %s\n", b.ID, len(jobs),
+		experiment, datatype, start.Format("2006-01-02"), end.Format("2006-01-02"))
+	svc.saveBatches(ctx)
+	return b, nil
+}
+
+// nextBatchJob returns the next ad-hoc batch job, if any, and saves the
+// batch positions.
+// Caller must hold the lock.
+func (svc *Service) nextBatchJob(ctx context.Context) *tracker.JobWithTarget {
+	j := svc.batches.nextJob()
+	if j != nil {
+		svc.saveBatches(ctx)
+	}
+	return j
+}
+
+// saveBatches persists the batch queue.
+// Caller must hold the lock.
+func (svc *Service) saveBatches(ctx context.Context) {
+	ctx, cf := context.WithTimeout(ctx, 5*time.Second)
+	defer cf()
+	err := svc.saver.Save(ctx, &svc.batches)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// BatchProgress returns the progress of a batch.
+// Returns ErrNoSuchBatch if the batch is unknown.
+func (svc *Service) BatchProgress(id string) (BatchProgress, error) {
+	svc.lock.Lock()
+	b := svc.batches.get(id)
+	var jobs []tracker.JobWithTarget
+	var p BatchProgress
+	if b != nil {
+		jobs = b.Jobs[:b.Next]
+		p = BatchProgress{ID: b.ID, Submitted: b.Submitted, Total: len(b.Jobs),
+			Pending: len(b.Jobs) - b.Next, States: make(map[string]int)}
+	}
+	svc.lock.Unlock()
+	if b == nil {
+		return p, ErrNoSuchBatch
+	}
+
+	for _, j := range jobs {
+		status, err := svc.jobAdder.GetStatus(j.Job)
+		if err != nil {
+			p.States["removed"]++
+			continue
+		}
+		p.States[string(status.State())]++
+	}
+	return p, nil
+}
+
+// SetOperatorToken enables batch submission, which requires requests to
+// include an "Authorization: Bearer <token>" header.
+func (svc *Service) SetOperatorToken(token string) {
+	svc.operatorToken = token
+}
+
+// BatchHandler handles ad-hoc batch submission with POST, and reports
+// batch progress with GET.
+//
+// POST parameters: experiment, datatype, start and end (YYYY-MM-DD), and
+// optional filter.  POST requires the operator token (see SetOperatorToken).
+// The response is the json encoded BatchProgress.
+//
+// GET parameters: id.
+func (svc *Service) BatchHandler(resp http.ResponseWriter, req *http.Request) {
+	if err := req.ParseForm(); err != nil {
+		resp.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	var id string
+	switch req.Method {
+	case http.MethodPost:
+		if !tracker.CheckBearerToken(resp, req, svc.operatorToken) {
+			return
+		}
+		start, err := time.Parse("2006-01-02", req.Form.Get("start"))
+		if err != nil {
+			resp.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		end, err := time.Parse("2006-01-02", req.Form.Get("end"))
+		if err != nil {
+			resp.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		b, err := svc.SubmitBatch(req.Context(), req.Form.Get("experiment"), req.Form.Get("datatype"),
+			start, end, req.Form.Get("filter"))
+		if err != nil {
+			resp.WriteHeader(http.StatusBadRequest)
+			resp.Write([]byte(err.Error()))
+			return
+		}
+		id = b.ID
+	case http.MethodGet:
+		id = req.Form.Get("id")
+	default:
+		resp.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	p, err := svc.BatchProgress(id)
+	if err != nil {
+		resp.WriteHeader(http.StatusNotFound)
+		return
+	}
+	b, err := json.Marshal(p)
+	if err != nil {
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	resp.Write(b)
+}
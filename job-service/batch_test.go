@@ -0,0 +1,149 @@
+// +build integration
+
+package job_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"bou.ke/monkey"
+	"cloud.google.com/go/datastore"
+
+	"github.com/m-lab/etl-gardener/config"
+	"github.com/m-lab/etl-gardener/job-service"
+	"github.com/m-lab/etl-gardener/persistence"
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+func TestBatch(t *testing.T) {
+	// Fake time will avoid yesterday trigger.
+	now := time.Date(2011, 2, 16, 1, 2, 3, 4, time.UTC)
+	monkey.Patch(time.Now, func() time.Time {
+		return now
+	})
+	defer monkey.Unpatch(time.Now)
+
+	ctx := context.Background()
+	tk, err := tracker.InitTracker(ctx, nil, nil, 0, 0, 0) // Only using jobmap.
+	must(t, err)
+	sources := []config.SourceConfig{
+		{Bucket: "fake-bucket", Experiment: "ndt", Datatype: "ndt5", Target: "tmp_ndt.ndt5"},
+		{Bucket: "fake-bucket", Experiment: "ndt", Datatype: "tcpinfo", Target: "tmp_ndt.tcpinfo"},
+	}
+	start := time.Date(2011, 2, 3, 0, 0, 0, 0, time.UTC)
+	saver := persistence.NewMemorySaver()
+	svc, err := job.NewJobService(ctx, tk, start, "fake-bucket", sources, saver, nil)
+	must(t, err)
+
+	token := "Bearer secret"
+	post := func(params url.Values) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/v1/batch", strings.NewReader(params.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Authorization", token)
+		resp := httptest.NewRecorder()
+		svc.BatchHandler(resp, req)
+		return resp
+	}
+
+	valid := url.Values{"experiment": {"ndt"}, "datatype": {"ndt5"}, "start": {"2011-01-01"}, "end": {"2011-01-01"}}
+	if resp := post(valid); resp.Code != http.StatusForbidden {
+		t.Error("Expected Forbidden without an operator token", resp.Code)
+	}
+	svc.SetOperatorToken("secret")
+	token = "Bearer wrong"
+	if resp := post(valid); resp.Code != http.StatusUnauthorized {
+		t.Error("Expected Unauthorized", resp.Code)
+	}
+	token = "Bearer secret"
+
+	bad := []url.Values{
+		{"experiment": {"ndt"}, "datatype": {"foo"}, "start": {"2011-01-01"}, "end": {"2011-01-03"}},
+		{"experiment": {"ndt"}, "datatype": {"ndt5"}, "start": {"2011-01-03"}, "end": {"2011-01-01"}},
+		{"experiment": {"ndt"}, "datatype": {"ndt5"}, "start": {"2011-01-01"}, "end": {"2011-02-16"}},
+		{"experiment": {"ndt"}, "datatype": {"ndt5"}, "start": {"20110101"}, "end": {"2011-01-03"}},
+		{"experiment": {"ndt"}, "datatype": {"ndt5"}, "start": {"0001-01-01"}, "end": {"2011-01-03"}},
+		{"experiment": {"ndt"}, "datatype": {"ndt5"}, "start": {"2011-01-01"}, "end": {"2011-01-03"}, "filter": {"(foo"}},
+	}
+	for _, params := range bad {
+		if resp := post(params); resp.Code != http.StatusBadRequest {
+			t.Error("Expected BadRequest", params, resp.Code)
+		}
+	}
+	// Batches are limited to 366 days.
+	end := time.Date(2011, 1, 1, 0, 0, 0, 0, time.UTC)
+	if _, err := svc.SubmitBatch(ctx, "ndt", "ndt5", end.AddDate(0, 0, -366), end, ""); !errors.Is(err, job.ErrInvalidDateRange) {
+		t.Error("Expected ErrInvalidDateRange", err)
+	}
+	if _, err := svc.SubmitBatch(ctx, "ndt", "ndt5", start, start, "(foo"); !errors.Is(err, job.ErrInvalidFilter) {
+		t.Error("Expected ErrInvalidFilter", err)
+	}
+
+	resp := post(url.Values{"experiment": {"ndt"}, "datatype": {"tcpinfo"},
+		"start": {"2011-01-01"}, "end": {"2011-01-03"}, "filter": {"foo"}})
+	if resp.Code != http.StatusOK {
+		t.Fatal("Expected OK", resp.Code, resp.Body.String())
+	}
+	p := job.BatchProgress{}
+	must(t, json.Unmarshal(resp.Body.Bytes(), &p))
+	if p.Total != 3 || p.Pending != 3 {
+		t.Errorf("Wrong progress: %+v", p)
+	}
+
+	// Batch jobs are dispatched ahead of the cycle.
+	for i := 0; i < 3; i++ {
+		j := svc.NextJob(ctx)
+		if j.Datatype != "tcpinfo" || j.Filter != "foo" || !j.Date.Equal(time.Date(2011, 1, 1+i, 0, 0, 0, 0, time.UTC)) {
+			t.Error("Wrong batch job:", j)
+		}
+		if i < 2 {
+			must(t, tk.AddJob(j.Job))
+		}
+	}
+	if j := svc.NextJob(ctx); !j.Date.Equal(start) {
+		t.Error("Expected cycle job:", j)
+	}
+
+	req := httptest.NewRequest("GET", "/v1/batch?id="+p.ID, nil)
+	resp = httptest.NewRecorder()
+	svc.BatchHandler(resp, req)
+	must(t, json.Unmarshal(resp.Body.Bytes(), &p))
+	if p.Pending != 0 || p.States["init"] != 2 || p.States["removed"] != 1 {
+		t.Errorf("Wrong progress: %+v", p)
+	}
+
+	req = httptest.NewRequest("GET", "/v1/batch?id=foo", nil)
+	resp = httptest.NewRecorder()
+	svc.BatchHandler(resp, req)
+	if resp.Code != http.StatusNotFound {
+		t.Error("Expected NotFound", resp.Code)
+	}
+
+	// Pending batches are recovered on restart.
+	_, err = svc.SubmitBatch(ctx, "ndt", "ndt5", start, start, "")
+	must(t, err)
+	restart, err := job.NewJobService(ctx, tk, start, "fake-bucket", sources, saver, nil)
+	must(t, err)
+	if j := restart.NextJob(ctx); j.Datatype != "ndt5" || !j.Date.Equal(start) {
+		t.Error("Expected recovered batch job:", j)
+	}
+}
+
+func TestBatchQueue_PropertyLoadSaver(t *testing.T) {
+	q := job.BatchQueue{NextID: 3, Batches: []*job.Batch{{ID: "3", Next: 1,
+		Jobs: []tracker.JobWithTarget{{Job: tracker.NewJob("bucket", "ndt", "ndt5", time.Now())}}}}}
+	var _ datastore.PropertyLoadSaver = &q
+	ps, err := q.Save()
+	must(t, err)
+	got := job.BatchQueue{}
+	must(t, got.Load(ps))
+	if got.NextID != 3 || len(got.Batches) != 1 || got.Batches[0].Jobs[0].Datatype != "ndt5" {
+		t.Errorf("Wrong queue: %+v", got)
+	}
+}
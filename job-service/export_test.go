@@ -0,0 +1,8 @@
+package job
+
+import "time"
+
+// SetRetryDelay sets the minimum time since failure before a job is retried.
+func (svc *Service) SetRetryDelay(d time.Duration) {
+	svc.retry.delay = d
+}
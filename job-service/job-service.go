@@ -3,10 +3,12 @@ package job
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"log"
 	"net/http"
 	"reflect"
+	"strings"
 	"sync"
 	"time"
 
@@ -25,6 +27,8 @@ var ErrNilParameter = errors.New("nil parameter not allowed")
 
 type jobAdder interface {
 	AddJob(job tracker.Job) error
+	GetStatus(job tracker.Job) (tracker.Status, error)
+	Jobs(f tracker.JobFilter) tracker.JobMap
 	LastJob() tracker.Job // temporary
 }
 
@@ -37,7 +41,7 @@ type YesterdaySource struct {
 	jobSpecs  []tracker.JobWithTarget // The job prefixes to be iterated through.
 	Date      time.Time               // The next "yesterday" date to be processed.
 	delay     time.Duration           // time after UTC to process yesterday.
-	nextIndex int
+	NextIndex int                     // Exported for persistence.
 }
 
 // nextJob returns a yesterday Job if appropriate
@@ -49,24 +53,25 @@ func (y *YesterdaySource) nextJob(ctx context.Context) *tracker.JobWithTarget {
 	}
 
 	// Copy the jobspec and set the date.
-	job := y.jobSpecs[y.nextIndex]
+	job := y.jobSpecs[y.NextIndex]
 	job.Date = y.Date
 
 	// Advance to the next jobSpec for next call.
-	y.nextIndex++
+	y.NextIndex++
 	// When we have dispatched all jobs, advance yesterdayDate to next day
 	// and reset the index.
-	if y.nextIndex >= len(y.jobSpecs) {
-		y.nextIndex = 0
+	if y.NextIndex >= len(y.jobSpecs) {
+		y.NextIndex = 0
 		y.Date = y.Date.AddDate(0, 0, 1).UTC().Truncate(24 * time.Hour)
+	}
 
-		ctx, cf := context.WithTimeout(ctx, 5*time.Second)
-		defer cf()
-		log.Println("Saving", y.GetName(), y.GetKind(), y.Date.Format("2006-01-02"))
-		err := y.saver.Save(ctx, y)
-		if err != nil {
-			log.Println(err)
-		}
+	// Save the position after each job, so that a restart resumes here.
+	ctx, cf := context.WithTimeout(ctx, 5*time.Second)
+	defer cf()
+	log.Println("Saving", y.GetName(), y.GetKind(), y.Date.Format("2006-01-02"), y.NextIndex)
+	err := y.saver.Save(ctx, y)
+	if err != nil {
+		log.Println(err)
 	}
 
 	return &job
@@ -84,7 +89,7 @@ func initYesterday(ctx context.Context, saver persistence.Saver, delay time.Dura
 		jobSpecs:  specs,
 		Date:      date,
 		delay:     delay,
-		nextIndex: 0,
+		NextIndex: 0,
 	}
 
 	// Recover the date from datastore.
@@ -94,6 +99,9 @@ func initYesterday(ctx context.Context, saver persistence.Saver, delay time.Dura
 	if err != nil {
 		log.Println(err)
 	}
+	if src.NextIndex >= len(specs) {
+		src.NextIndex = 0
+	}
 
 	log.Println("Yesterday starting at", src.Date)
 	return &src, nil
@@ -125,17 +133,24 @@ type Service struct {
 	// Storage client used to get source lists.
 	sClient stiface.Client
 
+	// Bearer token required to submit batches.  If empty, batch submission
+	// is disabled.
+	operatorToken string
+
 	// All fields above are const after initialization.
 	// All fields below are protected by *lock*
 	lock *sync.Mutex
 
-	// The Date is exported for persistence.  It is the only field
-	// that is recovered after restart.  All others are injected
-	// from config.
+	// The Date and NextIndex are exported for persistence.  They are
+	// the only fields that are recovered after restart.  All others
+	// are injected from config.
 	Date      time.Time // The date currently being dispatched.
-	nextIndex int       // index of TypeSource to dispatch next.
+	NextIndex int       // index of TypeSource to dispatch next.
 
 	yesterday *YesterdaySource // Provides jobs for high priority yesterday
+	batches   BatchQueue       // Ad-hoc jobs.
+	retry     *retrySource     // Failed jobs.
+	scheduler *Scheduler       // Chooses among the job sources.
 }
 
 func (svc *Service) advanceDate() {
@@ -145,36 +160,66 @@ func (svc *Service) advanceDate() {
 		date = svc.startDate
 	}
 	svc.Date = date
-	svc.nextIndex = 0
+	svc.NextIndex = 0
 }
 
-// NextJob returns a tracker.Job to dispatch.
+// NextJob returns a tracker.Job to dispatch, chosen by the Scheduler.
+// Returns an empty JobWithTarget if no source has a job.
 func (svc *Service) NextJob(ctx context.Context) tracker.JobWithTarget {
 	svc.lock.Lock()
 	defer svc.lock.Unlock()
 
-	// Check whether there is yesterday work to do.
-	if j := svc.yesterday.nextJob(ctx); j != nil {
-		log.Println("Yesterday job:", j.Job)
+	if j := svc.scheduler.nextJob(ctx); j != nil {
 		return *j
 	}
+	return tracker.JobWithTarget{}
+}
+
+// SetSchedule replaces the default schedule of the job sources.
+func (svc *Service) SetSchedule(ctx context.Context, schedule []config.ScheduleConfig) error {
+	svc.lock.Lock()
+	defer svc.lock.Unlock()
+	return svc.initScheduler(ctx, schedule)
+}
+
+// initScheduler creates the Scheduler.
+// Caller must hold the lock.
+func (svc *Service) initScheduler(ctx context.Context, schedule []config.ScheduleConfig) error {
+	sources := map[string]jobSource{
+		DailySource:    svc.yesterday,
+		AdhocSource:    sourceFunc(svc.nextBatchJob),
+		BackfillSource: sourceFunc(svc.nextBackfillJob),
+		RetrySource:    svc.retry,
+		RequeueSource:  &requeueSource{tk: svc.jobAdder, jobSpecs: svc.jobSpecs},
+	}
+	scheduler, err := newScheduler(ctx, svc.saver, sources, schedule)
+	if err != nil {
+		return err
+	}
+	svc.scheduler = scheduler
+	return nil
+}
 
-	job := svc.jobSpecs[svc.nextIndex]
+// nextBackfillJob returns the next job in the cycle through the archive.
+// Not thread-safe.
+func (svc *Service) nextBackfillJob(ctx context.Context) *tracker.JobWithTarget {
+	job := svc.jobSpecs[svc.NextIndex]
 	job.Date = svc.Date
-	svc.nextIndex++
+	svc.NextIndex++
 
-	if svc.nextIndex >= len(svc.jobSpecs) {
+	if svc.NextIndex >= len(svc.jobSpecs) {
 		svc.advanceDate()
-		// Note that this will block other calls to NextJob
-		ctx, cf := context.WithTimeout(ctx, 5*time.Second)
-		defer cf()
-		log.Println("Saving", svc.GetName(), svc.GetKind(), svc.Date.Format("2006-01-02"))
-		err := svc.saver.Save(ctx, svc)
-		if err != nil {
-			log.Println(err)
-		}
 	}
-	return job
+	// Save the position after each job, so that a restart resumes here.
+	// Note that this will block other calls to NextJob
+	ctx, cf := context.WithTimeout(ctx, 5*time.Second)
+	defer cf()
+	log.Println("Saving", svc.GetName(), svc.GetKind(), svc.Date.Format("2006-01-02"), svc.NextIndex)
+	err := svc.saver.Save(ctx, svc)
+	if err != nil {
+		log.Println(err)
+	}
+	return &job
 }
 
 // JobHandler handle requests for new jobs.
@@ -186,6 +231,14 @@ func (svc *Service) JobHandler(resp http.ResponseWriter, req *http.Request) {
 		return
 	}
 	job := svc.NextJob(req.Context())
+	if job.Experiment == "" {
+		resp.WriteHeader(http.StatusServiceUnavailable)
+		_, err := resp.Write([]byte("No jobs available.  Try again."))
+		if err != nil {
+			log.Println(err)
+		}
+		return
+	}
 
 	// Check whether there are any files
 	if svc.sClient != nil {
@@ -216,7 +269,15 @@ func (svc *Service) JobHandler(resp http.ResponseWriter, req *http.Request) {
 	}
 
 	log.Printf("Dispatching %s\n", job.Job)
-	_, err = resp.Write(job.Marshal())
+	body := job.Marshal()
+	if status, err := svc.jobAdder.GetStatus(job.Job); err == nil && status.Lease.ID != "" {
+		// The parser must include the lease in its updates.
+		body, _ = json.Marshal(struct {
+			tracker.Job
+			Lease tracker.Lease
+		}{job.Job, status.Lease})
+	}
+	_, err = resp.Write(body)
 	if err != nil {
 		log.Println(err)
 		// This should precede the Write(), but the Write failed, so this
@@ -244,6 +305,21 @@ func (svc *Service) recoverDate(ctx context.Context) {
 	// Adjust if Date is too early.
 	if svc.Date.Before(svc.startDate) {
 		svc.Date = svc.startDate
+		svc.NextIndex = 0
+	}
+	if svc.NextIndex >= len(svc.jobSpecs) {
+		svc.NextIndex = 0
+	}
+}
+
+// Recover any pending batches.
+// Not thread-safe - should be called before activating service.
+func (svc *Service) recoverBatches(ctx context.Context) {
+	ctx, cf := context.WithTimeout(ctx, 5*time.Second)
+	defer cf()
+	err := svc.saver.Fetch(ctx, &svc.batches)
+	if err != nil {
+		log.Println(err, svc.batches.GetKind())
 	}
 }
 
@@ -275,10 +351,13 @@ func NewJobService(ctx context.Context, tk jobAdder, startDate time.Time,
 			Filter:     s.Filter,
 			Date:       time.Time{}, // This is not used.
 		}
-		// TODO - handle gs:// targets
-		jt, err := job.Target(targetBase + "." + s.Target)
+		target, _, _ := s.TableNames(targetBase)
+		if strings.HasPrefix(s.Target, "gs://") {
+			target = s.Target
+		}
+		jt, err := job.Target(target)
 		if err != nil {
-			log.Println(err, targetBase+s.Target)
+			log.Println(err, target)
 			continue
 		}
 		specs = append(specs, jt)
@@ -299,11 +378,16 @@ func NewJobService(ctx context.Context, tk jobAdder, startDate time.Time,
 		startDate: startDate,
 		sClient:   statsClient,
 		lock:      &sync.Mutex{},
-		nextIndex: 0,
+		NextIndex: 0,
 		yesterday: yesterday,
+		retry:     newRetrySource(tk, specs, time.Hour),
 	}
 
 	svc.recoverDate(ctx)
+	svc.recoverBatches(ctx)
+	if err := svc.initScheduler(ctx, DefaultSchedule); err != nil {
+		return nil, err
+	}
 
 	return &svc, nil
 }
@@ -46,6 +46,14 @@ func (nt *NullTracker) AddJob(job tracker.Job) error {
 	return nil
 }
 
+func (nt *NullTracker) GetStatus(job tracker.Job) (tracker.Status, error) {
+	return tracker.Status{}, tracker.ErrJobNotFound
+}
+
+func (nt *NullTracker) Jobs(f tracker.JobFilter) tracker.JobMap {
+	return tracker.JobMap{}
+}
+
 func (nt *NullTracker) LastJob() tracker.Job {
 	return tracker.Job{}
 }
@@ -206,6 +214,7 @@ func (fs *FakeSaver) Save(ctx context.Context, o persistence.StateObject) error
 		fs.Current = svc.Date
 	case *job.YesterdaySource:
 		fs.Yesterday = svc.Date
+	case *job.BatchQueue, *job.Scheduler:
 	default:
 		log.Fatal("Not implemented")
 	}
@@ -220,6 +229,7 @@ func (fs *FakeSaver) Fetch(ctx context.Context, o persistence.StateObject) error
 		to.Date = fs.Current
 	case *job.YesterdaySource:
 		to.Date = fs.Yesterday
+	case *job.BatchQueue, *job.Scheduler:
 	default:
 		log.Fatal("Not implemented")
 	}
@@ -0,0 +1,279 @@
+package job
+
+import (
+	"context"
+	"errors"
+	"log"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/m-lab/etl-gardener/config"
+	"github.com/m-lab/etl-gardener/persistence"
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+// Names of the kinds of job source, for the schedule config.
+const (
+	DailySource    = "daily"    // Yesterday's data.
+	AdhocSource    = "adhoc"    // Batches submitted with SubmitBatch.
+	BackfillSource = "backfill" // The cycle through the archive.
+	RetrySource    = "retry"    // Failed jobs.
+	RequeueSource  = "requeued" // Jobs whose parser lease expired.
+)
+
+// ErrUnknownJobSource is returned if the schedule config names an unknown source.
+var ErrUnknownJobSource = errors.New("unknown job source")
+
+// DefaultSchedule serves requeued jobs first, since they were already
+// dispatched, then yesterday's data, then ad-hoc batches, then the backfill
+// cycle.  Failed jobs are not retried.
+var DefaultSchedule = []config.ScheduleConfig{
+	{Source: RequeueSource, Priority: 0},
+	{Source: DailySource, Priority: 1},
+	{Source: AdhocSource, Priority: 2},
+	{Source: BackfillSource, Priority: 3},
+}
+
+// A jobSource provides jobs to the Scheduler.  nextJob returns nil if
+// the source has no jobs to dispatch.
+type jobSource interface {
+	nextJob(ctx context.Context) *tracker.JobWithTarget
+}
+
+// sourceFunc adapts a function to the jobSource interface.
+type sourceFunc func(ctx context.Context) *tracker.JobWithTarget
+
+func (f sourceFunc) nextJob(ctx context.Context) *tracker.JobWithTarget {
+	return f(ctx)
+}
+
+type scheduledSource struct {
+	name     string
+	source   jobSource
+	priority int
+	weight   int
+	credit   int
+}
+
+// SourceCredit records the weighted round robin credit of a source.
+type SourceCredit struct {
+	Name   string
+	Credit int
+}
+
+// JobRetries records the number of times a failed job has been retried.
+type JobRetries struct {
+	Job     tracker.Job
+	Retries int
+}
+
+// Scheduler dispatches jobs from several sources.  Sources are served in
+// strict priority order.  Sources with the same priority share the jobs in
+// proportion to their weights, using smooth weighted round robin, so that
+// no source can stall the others.
+type Scheduler struct {
+	saver persistence.Saver
+
+	// Credits are exported for persistence, so that a restart resumes fairly.
+	Credits []SourceCredit
+	// Retries are exported for persistence, so that a restart does not
+	// retry failed jobs more than maxRetries times.
+	Retries []JobRetries
+
+	levels [][]*scheduledSource // Sources grouped by increasing priority value.
+	retry  *retrySource         // nil if there is no retry source.
+}
+
+// GetName implements StateObject.GetName
+func (s Scheduler) GetName() string {
+	return "singleton" // There is only one job service.
+}
+
+// GetKind implements StateObject.GetKind
+func (s Scheduler) GetKind() string {
+	return reflect.TypeOf(s).String()
+}
+
+// newScheduler creates a Scheduler for the configured sources, and recovers
+// the credits and retry counts from the saver.
+func newScheduler(ctx context.Context, saver persistence.Saver, sources map[string]jobSource, schedule []config.ScheduleConfig) (*Scheduler, error) {
+	all := make([]*scheduledSource, 0, len(schedule))
+	for _, sc := range schedule {
+		src, ok := sources[sc.Source]
+		if !ok {
+			return nil, ErrUnknownJobSource
+		}
+		weight := sc.Weight
+		if weight <= 0 {
+			weight = 1
+		}
+		all = append(all, &scheduledSource{name: sc.Source, source: src, priority: sc.Priority, weight: weight})
+	}
+	sort.SliceStable(all, func(i, j int) bool { return all[i].priority < all[j].priority })
+
+	s := &Scheduler{saver: saver}
+	if r, ok := sources[RetrySource].(*retrySource); ok {
+		s.retry = r
+	}
+	for i, src := range all {
+		if i == 0 || src.priority != all[i-1].priority {
+			s.levels = append(s.levels, nil)
+		}
+		s.levels[len(s.levels)-1] = append(s.levels[len(s.levels)-1], src)
+	}
+
+	ctx, cf := context.WithTimeout(ctx, 5*time.Second)
+	defer cf()
+	if err := saver.Fetch(ctx, s); err != nil {
+		log.Println(err, s.GetKind())
+	}
+	for _, c := range s.Credits {
+		for _, src := range all {
+			if src.name == c.Name {
+				src.credit = c.Credit
+			}
+		}
+	}
+	if s.retry != nil {
+		for _, r := range s.Retries {
+			s.retry.retries[r.Job] = r.Retries
+		}
+	}
+	return s, nil
+}
+
+// nextJob returns a job from the highest priority source that has one.
+// Returns nil if no source has a job.
+// Not thread-safe.
+func (s *Scheduler) nextJob(ctx context.Context) *tracker.JobWithTarget {
+	for _, level := range s.levels {
+		active := append([]*scheduledSource{}, level...)
+		for len(active) > 0 {
+			total := 0
+			best := 0
+			for i, src := range active {
+				total += src.weight
+				src.credit += src.weight
+				if src.credit > active[best].credit {
+					best = i
+				}
+			}
+			chosen := active[best]
+			chosen.credit -= total
+			if j := chosen.source.nextJob(ctx); j != nil {
+				log.Println("Job from", chosen.name, "source:", j.Job)
+				s.save(ctx)
+				return j
+			}
+			// The source is empty, so undo this round, and try the others.
+			for _, src := range active {
+				src.credit -= src.weight
+			}
+			chosen.credit += total
+			active = append(active[:best], active[best+1:]...)
+		}
+	}
+	return nil
+}
+
+// save persists the credits and retry counts.
+func (s *Scheduler) save(ctx context.Context) {
+	s.Credits = s.Credits[:0]
+	for _, level := range s.levels {
+		for _, src := range level {
+			s.Credits = append(s.Credits, SourceCredit{src.name, src.credit})
+		}
+	}
+	s.Retries = s.Retries[:0]
+	if s.retry != nil {
+		s.Retries = s.retry.counts()
+	}
+	ctx, cf := context.WithTimeout(ctx, 5*time.Second)
+	defer cf()
+	if err := s.saver.Save(ctx, s); err != nil {
+		log.Println(err)
+	}
+}
+
+// retrySource provides jobs that have Failed, oldest date first.  Each job is
+// retried at most maxRetries times.
+type retrySource struct {
+	tk       jobAdder
+	jobSpecs []tracker.JobWithTarget
+	delay    time.Duration // Minimum time since failure before retrying.
+	retries  map[tracker.Job]int
+}
+
+const maxRetries = 3
+
+func newRetrySource(tk jobAdder, specs []tracker.JobWithTarget, delay time.Duration) *retrySource {
+	return &retrySource{tk: tk, jobSpecs: specs, delay: delay, retries: make(map[tracker.Job]int)}
+}
+
+// nextJob implements jobSource.nextJob
+func (r *retrySource) nextJob(ctx context.Context) *tracker.JobWithTarget {
+	next := oldestJob(r.tk, r.jobSpecs, tracker.Failed, func(j tracker.Job, s tracker.Status) bool {
+		return time.Since(s.DetailTime()) >= r.delay && r.retries[j] < maxRetries
+	})
+	if next != nil {
+		r.retries[next.Job]++
+		log.Println("Retrying failed job", next.Job, r.retries[next.Job])
+	}
+	return next
+}
+
+// counts returns the retry counts of the jobs that the tracker still has.
+// Counts of jobs that were removed from the tracker are dropped.
+func (r *retrySource) counts() []JobRetries {
+	counts := make([]JobRetries, 0, len(r.retries))
+	for j, n := range r.retries {
+		if _, err := r.tk.GetStatus(j); err != nil {
+			delete(r.retries, j)
+			continue
+		}
+		counts = append(counts, JobRetries{j, n})
+	}
+	return counts
+}
+
+// oldestJob returns the job with the oldest date among the tracker's jobs in
+// the given state that are accepted by the accept function, with the target
+// of its source.  Returns nil if there is no such job.
+func oldestJob(tk jobAdder, specs []tracker.JobWithTarget, state tracker.State,
+	accept func(j tracker.Job, s tracker.Status) bool) *tracker.JobWithTarget {
+	var next *tracker.JobWithTarget
+	for j, s := range tk.Jobs(tracker.JobFilter{State: state}) {
+		if !accept(j, s) {
+			continue
+		}
+		if next != nil && !j.Date.Before(next.Date) {
+			continue
+		}
+		for _, spec := range specs {
+			if spec.Experiment == j.Experiment && spec.Datatype == j.Datatype {
+				jt := spec
+				jt.Job = j
+				next = &jt
+				break
+			}
+		}
+	}
+	return next
+}
+
+// requeueSource provides jobs whose parser lease expired, oldest date first.
+// The Tracker fails jobs that lose too many leases, so these are not counted.
+type requeueSource struct {
+	tk       jobAdder
+	jobSpecs []tracker.JobWithTarget
+}
+
+// nextJob implements jobSource.nextJob
+func (r *requeueSource) nextJob(ctx context.Context) *tracker.JobWithTarget {
+	next := oldestJob(r.tk, r.jobSpecs, tracker.Requeued, func(tracker.Job, tracker.Status) bool { return true })
+	if next != nil {
+		log.Println("Redispatching requeued job", next.Job)
+	}
+	return next
+}
@@ -0,0 +1,169 @@
+package job_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/m-lab/go/rtx"
+
+	"github.com/m-lab/etl-gardener/config"
+	"github.com/m-lab/etl-gardener/job-service"
+	"github.com/m-lab/etl-gardener/persistence"
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+func TestScheduler(t *testing.T) {
+	ctx := context.Background()
+	tk, err := tracker.InitTracker(ctx, nil, nil, 0, 0, 0) // Only using jobmap.
+	rtx.Must(err, "tracker init")
+	sources := []config.SourceConfig{
+		{Bucket: "fake-bucket", Experiment: "ndt", Datatype: "ndt5", Target: "tmp_ndt.ndt5"},
+	}
+	start := time.Date(2011, 2, 3, 0, 0, 0, 0, time.UTC)
+	saver := persistence.NewMemorySaver()
+	svc, err := job.NewJobService(ctx, tk, start, "fake-bucket", sources, saver, nil)
+	rtx.Must(err, "NewJobService")
+
+	if err := svc.SetSchedule(ctx, []config.ScheduleConfig{{Source: "foobar"}}); err != job.ErrUnknownJobSource {
+		t.Error("Expected ErrUnknownJobSource:", err)
+	}
+	schedule := []config.ScheduleConfig{
+		{Source: job.AdhocSource, Priority: 0, Weight: 1},
+		{Source: job.BackfillSource, Priority: 0, Weight: 2},
+	}
+	rtx.Must(svc.SetSchedule(ctx, schedule), "SetSchedule")
+
+	// Without ad-hoc jobs, all jobs come from the backfill.
+	for i := 0; i < 3; i++ {
+		if j := svc.NextJob(ctx); !j.Date.Equal(start.AddDate(0, 0, i)) {
+			t.Error("Expected backfill job:", j)
+		}
+	}
+
+	// With ad-hoc jobs, one in three jobs is ad-hoc.
+	adhocDate := time.Date(2010, 1, 1, 0, 0, 0, 0, time.UTC)
+	_, err = svc.SubmitBatch(ctx, "ndt", "ndt5", adhocDate, adhocDate.AddDate(0, 0, 9), "")
+	rtx.Must(err, "SubmitBatch")
+	adhoc := 0
+	for i := 0; i < 9; i++ {
+		if j := svc.NextJob(ctx); j.Date.Year() == 2010 {
+			adhoc++
+		}
+	}
+	if adhoc != 3 {
+		t.Error("Expected 3 ad-hoc jobs, got", adhoc)
+	}
+
+	// A restarted service resumes both the ad-hoc and backfill positions.
+	next := svc.NextJob(ctx)
+	following := svc.NextJob(ctx)
+	restart, err := job.NewJobService(ctx, tk, start, "fake-bucket", sources, saver, nil)
+	rtx.Must(err, "NewJobService")
+	rtx.Must(restart.SetSchedule(ctx, schedule), "SetSchedule")
+	// Both should now dispatch the same jobs.
+	for i := 0; i < 3; i++ {
+		j1 := restart.NextJob(ctx)
+		j2 := svc.NextJob(ctx)
+		if j1.Date.Equal(next.Date) || j1.Date.Equal(following.Date) || !j1.Date.Equal(j2.Date) {
+			t.Error("Restart did not resume:", next, following, j1, j2)
+		}
+	}
+}
+
+func TestScheduler_StrictPriorityAndRetry(t *testing.T) {
+	ctx := context.Background()
+	tk, err := tracker.InitTracker(ctx, nil, nil, 0, 0, 0) // Only using jobmap.
+	rtx.Must(err, "tracker init")
+	sources := []config.SourceConfig{
+		{Bucket: "fake-bucket", Experiment: "ndt", Datatype: "ndt5", Target: "tmp_ndt.ndt5"},
+	}
+	start := time.Date(2011, 2, 3, 0, 0, 0, 0, time.UTC)
+	svc, err := job.NewJobService(ctx, tk, start, "fake-bucket", sources, persistence.NewMemorySaver(), nil)
+	rtx.Must(err, "NewJobService")
+	rtx.Must(svc.SetSchedule(ctx, []config.ScheduleConfig{
+		{Source: job.RetrySource, Priority: 0},
+		{Source: job.AdhocSource, Priority: 1},
+	}), "SetSchedule")
+
+	// No source has jobs.
+	if j := svc.NextJob(ctx); j.Experiment != "" {
+		t.Error("Expected no job:", j)
+	}
+
+	// Recently failed jobs are not retried immediately.
+	failed := tracker.NewJob("fake-bucket", "ndt", "ndt5", start)
+	rtx.Must(tk.AddJob(failed), "AddJob")
+	rtx.Must(tk.SetJobError(failed, "oops"), "SetJobError")
+	date := time.Date(2010, 1, 1, 0, 0, 0, 0, time.UTC)
+	_, err = svc.SubmitBatch(ctx, "ndt", "ndt5", date, date, "")
+	rtx.Must(err, "SubmitBatch")
+	if j := svc.NextJob(ctx); !j.Date.Equal(date) {
+		t.Error("Expected ad-hoc job:", j)
+	}
+	if j := svc.NextJob(ctx); j.Experiment != "" {
+		t.Error("Expected no job:", j)
+	}
+}
+
+func TestScheduler_Requeued(t *testing.T) {
+	ctx := context.Background()
+	tk, err := tracker.InitTracker(ctx, nil, nil, 0, 0, 0) // Only using jobmap.
+	rtx.Must(err, "tracker init")
+	sources := []config.SourceConfig{
+		{Bucket: "fake-bucket", Experiment: "ndt", Datatype: "ndt5", Target: "tmp_ndt.ndt5"},
+	}
+	start := time.Date(2011, 2, 3, 0, 0, 0, 0, time.UTC)
+	svc, err := job.NewJobService(ctx, tk, start, "fake-bucket", sources, persistence.NewMemorySaver(), nil)
+	rtx.Must(err, "NewJobService")
+
+	// A job whose lease expired is dispatched ahead of all other sources.
+	lost := tracker.NewJob("fake-bucket", "ndt", "ndt5", time.Date(2010, 1, 1, 0, 0, 0, 0, time.UTC))
+	rtx.Must(tk.AddJob(lost), "AddJob")
+	rtx.Must(tk.SetStatus(lost, tracker.Requeued, "lease expired in init"), "SetStatus")
+	j := svc.NextJob(ctx)
+	if j.Job != lost || j.TargetTable.Table != "ndt5" {
+		t.Error("Expected requeued job:", j)
+	}
+	rtx.Must(tk.AddJob(j.Job), "AddJob")
+	if j := svc.NextJob(ctx); j.Job == lost {
+		t.Error("Job was dispatched twice")
+	}
+}
+
+func TestScheduler_RetriesPersist(t *testing.T) {
+	ctx := context.Background()
+	tk, err := tracker.InitTracker(ctx, nil, nil, 0, 0, 0) // Only using jobmap.
+	rtx.Must(err, "tracker init")
+	sources := []config.SourceConfig{
+		{Bucket: "fake-bucket", Experiment: "ndt", Datatype: "ndt5", Target: "tmp_ndt.ndt5"},
+	}
+	start := time.Date(2011, 2, 3, 0, 0, 0, 0, time.UTC)
+	schedule := []config.ScheduleConfig{{Source: job.RetrySource, Priority: 0}}
+	saver := persistence.NewMemorySaver()
+	svc, err := job.NewJobService(ctx, tk, start, "fake-bucket", sources, saver, nil)
+	rtx.Must(err, "NewJobService")
+	svc.SetRetryDelay(0)
+	rtx.Must(svc.SetSchedule(ctx, schedule), "SetSchedule")
+
+	failed := tracker.NewJob("fake-bucket", "ndt", "ndt5", start)
+	rtx.Must(tk.AddJob(failed), "AddJob")
+	rtx.Must(tk.SetJobError(failed, "oops"), "SetJobError")
+	for i := 0; i < 2; i++ {
+		if j := svc.NextJob(ctx); j.Job != failed {
+			t.Error("Expected retry of failed job:", j)
+		}
+	}
+
+	// A restarted service retries the job only once more.
+	restart, err := job.NewJobService(ctx, tk, start, "fake-bucket", sources, saver, nil)
+	rtx.Must(err, "NewJobService")
+	restart.SetRetryDelay(0)
+	rtx.Must(restart.SetSchedule(ctx, schedule), "SetSchedule")
+	if j := restart.NextJob(ctx); j.Job != failed {
+		t.Error("Expected retry of failed job:", j)
+	}
+	if j := restart.NextJob(ctx); j.Experiment != "" {
+		t.Error("Expected no job after max retries:", j)
+	}
+}
@@ -64,6 +64,21 @@ var (
 		[]string{"experiment", "datatype", "status"}, // TODO change to warning
 	)
 
+	// NotificationCount counts the job notifications sent to each kind of
+	// receiver, by outcome: sent, retry, or dead-letter.
+	//
+	// Provides metrics:
+	//   gardener_notification_total{receiver, outcome}
+	// Example usage:
+	// metrics.NotificationCount.WithLabelValues("webhook", "sent").Inc()
+	NotificationCount = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gardener_notification_total",
+			Help: "Number of job notification attempts.",
+		},
+		[]string{"receiver", "outcome"},
+	)
+
 	// TasksInFlight maintains a count of the number of tasks in flight.
 	// TODO consider deprecating this and using Started - Completed.
 	//
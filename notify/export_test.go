@@ -0,0 +1,10 @@
+package notify
+
+import "time"
+
+const MaxDeliveries = maxDeliveries
+
+// SetTimeout sets the limit on each delivery attempt.
+func (n *Notifier) SetTimeout(d time.Duration) {
+	n.timeout = d
+}
@@ -0,0 +1,293 @@
+// Package notify sends notifications to webhooks and Pub/Sub topics when
+// jobs become complete or failed, so that downstream jobs do not need to
+// poll BigQuery to discover when a partition has been replaced.
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+
+	"github.com/m-lab/etl-gardener/config"
+	"github.com/m-lab/etl-gardener/metrics"
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+// ErrDelivery is returned when a receiver rejects a notification.
+var ErrDelivery = errors.New("notification not delivered")
+
+// A Notification describes a job that has become complete or failed.
+type Notification struct {
+	Job    tracker.Job
+	State  tracker.State // Complete or Failed.
+	Detail string
+
+	// Partition is the job's partition of the final table, e.g.
+	// "project.dataset.table$20200905", and Rows is its row count.
+	// Both are empty if they could not be determined.
+	Partition string `json:",omitempty"`
+	Rows      int64
+
+	Started        time.Time
+	Finished       time.Time
+	ElapsedSeconds float64
+}
+
+// A Sender delivers notifications to a receiver.
+type Sender interface {
+	// Kind returns the kind of receiver, e.g. "webhook", for metrics.
+	Kind() string
+	// Name identifies the receiver, e.g. the webhook URL, in logs.
+	Name() string
+	// Send delivers a notification, returning an error if it should be retried.
+	Send(ctx context.Context, n Notification) error
+}
+
+// PartitionFunc returns the job's partition of its final table, and the
+// number of rows in the partition.
+type PartitionFunc func(ctx context.Context, job tracker.Job) (string, int64, error)
+
+// maxDeliveries limits the number of notifications delivered concurrently.
+const maxDeliveries = 10
+
+// sendTimeout limits each delivery attempt, so that receivers that hang do
+// not hold the workers.
+const sendTimeout = 30 * time.Second
+
+// DefaultRetryPolicy applies to deliveries unless the config overrides it.
+var DefaultRetryPolicy = config.RetryPolicy{
+	MaxAttempts:  5,
+	InitialDelay: 10 * time.Second,
+	MaxDelay:     5 * time.Minute,
+	Jitter:       0.2,
+}
+
+// deadLetter is a record of a notification that could not be delivered.
+type deadLetter struct {
+	Receiver     string
+	Error        string
+	Attempts     int
+	Time         time.Time
+	Notification Notification
+}
+
+// Notifier sends a Notification to each Sender when a job becomes complete
+// or failed.  Deliveries that fail are retried according to the RetryPolicy,
+// and are then logged, and appended to the dead letter file, if any.
+type Notifier struct {
+	senders   []Sender
+	retry     config.RetryPolicy
+	timeout   time.Duration // Limits each delivery attempt.
+	partition PartitionFunc // Optional.
+
+	lock           sync.Mutex // protects the dead letter file
+	deadLetterFile string
+
+	queueLock sync.Mutex      // protects queue
+	queue     []tracker.Event // Events waiting for delivery.
+	wake      chan struct{}   // Signals that the queue is not empty.
+}
+
+// NewNotifier creates a Notifier that sends to the senders.
+func NewNotifier(retry config.RetryPolicy, senders ...Sender) *Notifier {
+	return &Notifier{senders: senders, retry: retry, timeout: sendTimeout, wake: make(chan struct{}, 1)}
+}
+
+// NewNotifierFromConfig creates a Notifier for the webhooks and topic in the
+// config.  The Pub/Sub client, if any, is created in project.
+func NewNotifierFromConfig(ctx context.Context, project string, nc config.NotificationConfig) (*Notifier, error) {
+	senders := []Sender{}
+	for _, url := range nc.Webhooks {
+		senders = append(senders, NewWebhookSender(url))
+	}
+	if nc.Topic != "" {
+		client, err := pubsub.NewClient(ctx, project)
+		if err != nil {
+			return nil, err
+		}
+		senders = append(senders, NewPubSubSender(client, nc.Topic))
+	}
+	n := NewNotifier(DefaultRetryPolicy.WithConfig(nc.Retry), senders...)
+	n.SetDeadLetterFile(nc.DeadLetterFile)
+	return n, nil
+}
+
+// SetPartitionFunc sets the function used to find the final partition and
+// row count of each job.  Without it, notifications have no partition.
+// It should be called before Watch.
+func (n *Notifier) SetPartitionFunc(f PartitionFunc) {
+	n.partition = f
+}
+
+// SetDeadLetterFile sets the file to which notifications that could not be
+// delivered are appended as json lines.  It should be called before Watch.
+func (n *Notifier) SetDeadLetterFile(path string) {
+	n.deadLetterFile = path
+}
+
+// Watch sends notifications for the jobs that become complete or failed,
+// until ctx is done.  The events are queued without limit, so that none are
+// lost, and delivered by up to maxDeliveries workers.  Notifications that
+// are still queued when ctx is done are dead lettered.
+func (n *Notifier) Watch(ctx context.Context, tk *tracker.Tracker) {
+	tk.SetFinishHook(n.enqueue)
+	wg := sync.WaitGroup{}
+	for i := 0; i < maxDeliveries; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			n.work(ctx)
+		}()
+	}
+	wg.Wait()
+	tk.SetFinishHook(nil)
+	for e, ok := n.next(); ok; e, ok = n.next() {
+		note := newNotification(e)
+		for _, s := range n.senders {
+			n.deadLetter(s, note, 0, ctx.Err())
+		}
+	}
+}
+
+// enqueue queues an event for delivery, without blocking.
+func (n *Notifier) enqueue(e tracker.Event) {
+	n.queueLock.Lock()
+	n.queue = append(n.queue, e)
+	n.queueLock.Unlock()
+	n.signal()
+}
+
+// signal wakes a worker, if any is waiting.
+func (n *Notifier) signal() {
+	select {
+	case n.wake <- struct{}{}:
+	default:
+	}
+}
+
+// next removes the next event from the queue, and wakes another worker if
+// more events remain.
+func (n *Notifier) next() (tracker.Event, bool) {
+	n.queueLock.Lock()
+	defer n.queueLock.Unlock()
+	if len(n.queue) == 0 {
+		return tracker.Event{}, false
+	}
+	e := n.queue[0]
+	n.queue = n.queue[1:]
+	if len(n.queue) > 0 {
+		n.signal()
+	}
+	return e, true
+}
+
+// work delivers queued notifications until ctx is done.
+func (n *Notifier) work(ctx context.Context) {
+	for ctx.Err() == nil {
+		if e, ok := n.next(); ok {
+			n.Notify(ctx, e)
+			continue
+		}
+		select {
+		case <-ctx.Done():
+		case <-n.wake:
+		}
+	}
+}
+
+func newNotification(e tracker.Event) Notification {
+	return Notification{
+		Job:            e.Job,
+		State:          e.NewState,
+		Detail:         e.Detail,
+		Started:        e.Started,
+		Finished:       e.Time,
+		ElapsedSeconds: e.Time.Sub(e.Started).Seconds(),
+	}
+}
+
+// Notify sends the notification for an event to all senders, and returns
+// when every delivery has succeeded or been dead lettered.
+func (n *Notifier) Notify(ctx context.Context, e tracker.Event) {
+	note := newNotification(e)
+	if n.partition != nil {
+		pctx, cancel := context.WithTimeout(ctx, time.Minute)
+		var err error
+		note.Partition, note.Rows, err = n.partition(pctx, e.Job)
+		cancel()
+		if err != nil {
+			log.Println(e.Job, "could not get final partition:", err)
+		}
+	}
+
+	wg := sync.WaitGroup{}
+	for _, s := range n.senders {
+		wg.Add(1)
+		go func(s Sender) {
+			defer wg.Done()
+			n.deliver(ctx, s, note)
+		}(s)
+	}
+	wg.Wait()
+}
+
+// deliver sends the notification to one sender, with retries.
+func (n *Notifier) deliver(ctx context.Context, s Sender, note Notification) {
+	for attempts := 1; ; attempts++ {
+		sctx, cancel := context.WithTimeout(ctx, n.timeout)
+		err := s.Send(sctx, note)
+		cancel()
+		if err == nil {
+			metrics.NotificationCount.WithLabelValues(s.Kind(), "sent").Inc()
+			return
+		}
+		log.Println(note.Job, s.Name(), "notification error:", err)
+		if n.retry.Exhausted(attempts) {
+			n.deadLetter(s, note, attempts, err)
+			return
+		}
+		metrics.NotificationCount.WithLabelValues(s.Kind(), "retry").Inc()
+		timer := time.NewTimer(n.retry.Delay(attempts))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			n.deadLetter(s, note, attempts, ctx.Err())
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// deadLetter logs a notification that could not be delivered, and appends
+// it to the dead letter file, if any.
+func (n *Notifier) deadLetter(s Sender, note Notification, attempts int, err error) {
+	metrics.NotificationCount.WithLabelValues(s.Kind(), "dead-letter").Inc()
+	b, jsonErr := json.Marshal(deadLetter{
+		Receiver: s.Name(), Error: err.Error(), Attempts: attempts,
+		Time: time.Now(), Notification: note})
+	if jsonErr != nil {
+		log.Println(jsonErr)
+		return
+	}
+	log.Println("Dead letter:", string(b))
+	if n.deadLetterFile == "" {
+		return
+	}
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	f, fileErr := os.OpenFile(n.deadLetterFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if fileErr != nil {
+		log.Println(fileErr)
+		return
+	}
+	defer f.Close()
+	if _, fileErr = f.Write(append(b, '\n')); fileErr != nil {
+		log.Println(fileErr)
+	}
+}
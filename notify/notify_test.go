@@ -0,0 +1,324 @@
+package notify_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/m-lab/etl-gardener/config"
+	"github.com/m-lab/etl-gardener/notify"
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+func init() {
+	// Always prepend the filename and line number.
+	log.SetFlags(log.LstdFlags | log.Lshortfile)
+}
+
+func must(t *testing.T, err error) {
+	if err != nil {
+		log.Output(2, err.Error())
+		t.Fatal(err)
+	}
+}
+
+var fastRetry = config.RetryPolicy{MaxAttempts: 3, InitialDelay: time.Millisecond, MaxDelay: time.Millisecond}
+
+// webhook records the notifications it receives, after failing the first
+// failures requests.
+type webhook struct {
+	lock     sync.Mutex
+	failures int
+	requests int
+	received []notify.Notification
+}
+
+func (wh *webhook) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	wh.lock.Lock()
+	defer wh.lock.Unlock()
+	wh.requests++
+	if wh.requests <= wh.failures {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	var n notify.Notification
+	if err := json.NewDecoder(r.Body).Decode(&n); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	wh.received = append(wh.received, n)
+}
+
+func TestNotifier_Webhooks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestNotifier")
+	must(t, err)
+	defer os.RemoveAll(dir)
+	deadLetters := filepath.Join(dir, "dead.jsonl")
+
+	flaky := &webhook{failures: 2}
+	broken := &webhook{failures: 100}
+	flakyServer := httptest.NewServer(flaky)
+	defer flakyServer.Close()
+	brokenServer := httptest.NewServer(broken)
+	defer brokenServer.Close()
+
+	n := notify.NewNotifier(fastRetry,
+		notify.NewWebhookSender(flakyServer.URL), notify.NewWebhookSender(brokenServer.URL))
+	n.SetDeadLetterFile(deadLetters)
+	n.SetPartitionFunc(func(ctx context.Context, job tracker.Job) (string, int64, error) {
+		return "proj.ndt.ndt7$20200905", 1234, nil
+	})
+
+	job := tracker.NewJob("bucket", "ndt", "ndt7", time.Date(2020, 9, 5, 0, 0, 0, 0, time.UTC))
+	start := time.Now().Add(-time.Hour)
+	n.Notify(context.Background(), tracker.Event{
+		Job: job, OldState: tracker.Joining, NewState: tracker.Complete,
+		Time: start.Add(time.Hour), Started: start})
+
+	if flaky.requests != 3 || len(flaky.received) != 1 {
+		t.Fatal("Expected delivery on the third attempt:", flaky.requests, flaky.received)
+	}
+	got := flaky.received[0]
+	if got.Job != job || got.State != tracker.Complete || got.Partition != "proj.ndt.ndt7$20200905" ||
+		got.Rows != 1234 || got.ElapsedSeconds != 3600 {
+		t.Errorf("Wrong notification: %+v", got)
+	}
+
+	// The broken webhook gives up after 3 attempts.
+	if broken.requests != 3 {
+		t.Error("Expected 3 attempts:", broken.requests)
+	}
+	f, err := os.Open(deadLetters)
+	must(t, err)
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	lines := 0
+	for scanner.Scan() {
+		lines++
+		var dl struct {
+			Receiver     string
+			Attempts     int
+			Notification notify.Notification
+		}
+		must(t, json.Unmarshal(scanner.Bytes(), &dl))
+		if dl.Receiver != brokenServer.URL || dl.Attempts != 3 || dl.Notification.Job != job {
+			t.Errorf("Wrong dead letter: %s", scanner.Text())
+		}
+	}
+	if lines != 1 {
+		t.Error("Expected 1 dead letter, got", lines)
+	}
+}
+
+type fakeSender struct {
+	notes chan notify.Notification
+}
+
+func (fs *fakeSender) Kind() string { return "fake" }
+func (fs *fakeSender) Name() string { return "fake" }
+func (fs *fakeSender) Send(ctx context.Context, n notify.Notification) error {
+	fs.notes <- n
+	return nil
+}
+
+func TestNotifier_Watch(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tk, err := tracker.NewTracker(ctx, nil, 0, 0, 0)
+	must(t, err)
+	fs := &fakeSender{notes: make(chan notify.Notification, 10)}
+	n := notify.NewNotifier(fastRetry, fs)
+	n.SetPartitionFunc(func(ctx context.Context, job tracker.Job) (string, int64, error) {
+		return "", 0, errors.New("no table")
+	})
+	go n.Watch(ctx, tk)
+	// Let Watch subscribe.
+	time.Sleep(10 * time.Millisecond)
+
+	done := tracker.NewJob("bucket", "ndt", "ndt7", time.Date(2020, 9, 5, 0, 0, 0, 0, time.UTC))
+	failed := tracker.NewJob("bucket", "ndt", "ndt7", time.Date(2020, 9, 6, 0, 0, 0, 0, time.UTC))
+	must(t, tk.AddJob(done))
+	must(t, tk.AddJob(failed))
+	must(t, tk.SetStatus(done, tracker.Parsing, ""))
+	must(t, tk.SetStatus(done, tracker.Complete, ""))
+	must(t, tk.SetJobError(failed, "bad"))
+
+	got := map[tracker.Job]tracker.State{}
+	for i := 0; i < 2; i++ {
+		select {
+		case note := <-fs.notes:
+			got[note.Job] = note.State
+			if note.Partition != "" || note.Started.IsZero() {
+				t.Errorf("Bad notification: %+v", note)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Missing notification")
+		}
+	}
+	if got[done] != tracker.Complete || got[failed] != tracker.Failed {
+		t.Error("Wrong notifications:", got)
+	}
+	select {
+	case note := <-fs.notes:
+		t.Error("Unexpected notification:", note)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+// blockingSender counts deliveries, blocking each one until release is
+// closed or ctx is done.
+type blockingSender struct {
+	release chan struct{}
+
+	lock      sync.Mutex
+	active    int
+	maxActive int
+	sent      int
+}
+
+func (bs *blockingSender) Kind() string { return "blocking" }
+func (bs *blockingSender) Name() string { return "blocking" }
+func (bs *blockingSender) Send(ctx context.Context, n notify.Notification) error {
+	bs.lock.Lock()
+	bs.active++
+	if bs.active > bs.maxActive {
+		bs.maxActive = bs.active
+	}
+	bs.lock.Unlock()
+	defer func() {
+		bs.lock.Lock()
+		bs.active--
+		bs.lock.Unlock()
+	}()
+	select {
+	case <-bs.release:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	bs.lock.Lock()
+	bs.sent++
+	bs.lock.Unlock()
+	return nil
+}
+
+func (bs *blockingSender) counts() (sent, maxActive int) {
+	bs.lock.Lock()
+	defer bs.lock.Unlock()
+	return bs.sent, bs.maxActive
+}
+
+// completeJobs adds and completes n jobs.
+func completeJobs(t *testing.T, tk *tracker.Tracker, n int) {
+	for i := 0; i < n; i++ {
+		job := tracker.NewJob("bucket", "ndt", "ndt7", time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC).AddDate(0, 0, i))
+		must(t, tk.AddJob(job))
+		must(t, tk.SetStatus(job, tracker.Complete, ""))
+	}
+}
+
+func TestNotifier_Backlog(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tk, err := tracker.NewTracker(ctx, nil, 0, 0, 0)
+	must(t, err)
+	bs := &blockingSender{release: make(chan struct{})}
+	n := notify.NewNotifier(fastRetry, bs)
+	go n.Watch(ctx, tk)
+	time.Sleep(10 * time.Millisecond)
+
+	// More events than an EventBus subscription would buffer.
+	completeJobs(t, tk, 2000)
+	close(bs.release)
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		if sent, _ := bs.counts(); sent == 2000 {
+			break
+		}
+	}
+	sent, maxActive := bs.counts()
+	if sent != 2000 {
+		t.Error("Expected 2000 notifications, got", sent)
+	}
+	if maxActive > notify.MaxDeliveries {
+		t.Error("Too many concurrent deliveries:", maxActive)
+	}
+}
+
+func TestNotifier_Shutdown(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestNotifier")
+	must(t, err)
+	defer os.RemoveAll(dir)
+	deadLetters := filepath.Join(dir, "dead.jsonl")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	tk, err := tracker.NewTracker(context.Background(), nil, 0, 0, 0)
+	must(t, err)
+	bs := &blockingSender{release: make(chan struct{})}
+	n := notify.NewNotifier(fastRetry, bs)
+	n.SetDeadLetterFile(deadLetters)
+	done := make(chan struct{})
+	go func() {
+		n.Watch(ctx, tk)
+		close(done)
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	// Pending and in flight notifications are dead lettered on shutdown.
+	completeJobs(t, tk, 20)
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Watch did not return")
+	}
+	b, err := ioutil.ReadFile(deadLetters)
+	must(t, err)
+	if lines := strings.Count(string(b), "\n"); lines != 20 {
+		t.Error("Expected 20 dead letters, got", lines)
+	}
+}
+
+func TestNotifier_Timeout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestNotifier")
+	must(t, err)
+	defer os.RemoveAll(dir)
+	deadLetters := filepath.Join(dir, "dead.jsonl")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tk, err := tracker.NewTracker(ctx, nil, 0, 0, 0)
+	must(t, err)
+	// The receiver never responds.
+	bs := &blockingSender{release: make(chan struct{})}
+	n := notify.NewNotifier(fastRetry, bs)
+	n.SetDeadLetterFile(deadLetters)
+	n.SetTimeout(time.Millisecond)
+	go n.Watch(ctx, tk)
+	time.Sleep(10 * time.Millisecond)
+
+	// More notifications than workers are dead lettered before shutdown.
+	completeJobs(t, tk, 2*notify.MaxDeliveries)
+	lines := 0
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		b, err := ioutil.ReadFile(deadLetters)
+		if err == nil {
+			lines = strings.Count(string(b), "\n")
+		}
+		if lines == 2*notify.MaxDeliveries {
+			break
+		}
+	}
+	if lines != 2*notify.MaxDeliveries {
+		t.Error("Expected", 2*notify.MaxDeliveries, "dead letters, got", lines)
+	}
+}
@@ -0,0 +1,57 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+
+	"cloud.google.com/go/pubsub"
+)
+
+// PubSubSender publishes notifications as json messages to a Pub/Sub topic.
+// Each message has experiment, datatype, date and state attributes, so that
+// subscriptions can filter them.
+type PubSubSender struct {
+	Topic *pubsub.Topic
+}
+
+// NewPubSubSender creates a PubSubSender for a topic, which is either a
+// topic ID in the client's project, or a full projects/<project>/topics/<id>
+// name.  To use the Pub/Sub emulator, set PUBSUB_EMULATOR_HOST before
+// creating the client.
+func NewPubSubSender(client *pubsub.Client, topic string) *PubSubSender {
+	parts := strings.Split(topic, "/")
+	if len(parts) == 4 && parts[0] == "projects" && parts[2] == "topics" {
+		return &PubSubSender{Topic: client.TopicInProject(parts[3], parts[1])}
+	}
+	return &PubSubSender{Topic: client.Topic(topic)}
+}
+
+// Kind implements Sender.Kind
+func (ps *PubSubSender) Kind() string {
+	return "pubsub"
+}
+
+// Name implements Sender.Name
+func (ps *PubSubSender) Name() string {
+	return ps.Topic.String()
+}
+
+// Send implements Sender.Send, and waits for the message to be published.
+func (ps *PubSubSender) Send(ctx context.Context, n Notification) error {
+	b, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	result := ps.Topic.Publish(ctx, &pubsub.Message{
+		Data: b,
+		Attributes: map[string]string{
+			"experiment": n.Job.Experiment,
+			"datatype":   n.Job.Datatype,
+			"date":       n.Job.Date.Format("2006-01-02"),
+			"state":      string(n.State),
+		},
+	})
+	_, err = result.Get(ctx)
+	return err
+}
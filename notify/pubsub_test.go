@@ -0,0 +1,58 @@
+package notify_test
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"cloud.google.com/go/pubsub/pstest"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+
+	"github.com/m-lab/etl-gardener/notify"
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+func TestPubSubSender(t *testing.T) {
+	ctx := context.Background()
+	srv := pstest.NewServer()
+	defer srv.Close()
+	conn, err := grpc.Dial(srv.Addr, grpc.WithInsecure())
+	must(t, err)
+	defer conn.Close()
+	client, err := pubsub.NewClient(ctx, "proj", option.WithGRPCConn(conn))
+	must(t, err)
+	_, err = client.CreateTopic(ctx, "jobs")
+	must(t, err)
+
+	ps := notify.NewPubSubSender(client, "projects/proj/topics/jobs")
+	if ps.Name() != "projects/proj/topics/jobs" {
+		t.Error("Wrong topic:", ps.Name())
+	}
+	defer ps.Topic.Stop()
+	job := tracker.NewJob("bucket", "ndt", "ndt7", time.Date(2020, 9, 5, 0, 0, 0, 0, time.UTC))
+	must(t, ps.Send(ctx, notify.Notification{Job: job, State: tracker.Failed, Detail: "bad"}))
+
+	msgs := srv.Messages()
+	if len(msgs) != 1 {
+		t.Fatal("Expected 1 message:", msgs)
+	}
+	attrs := msgs[0].Attributes
+	if attrs["datatype"] != "ndt7" || attrs["date"] != "2020-09-05" || attrs["state"] != "failed" {
+		t.Error("Wrong attributes:", attrs)
+	}
+	var n notify.Notification
+	must(t, json.Unmarshal(msgs[0].Data, &n))
+	if n.Job != job || n.Detail != "bad" {
+		t.Errorf("Wrong notification: %+v", n)
+	}
+
+	// Publishing to a missing topic fails.
+	missing := notify.NewPubSubSender(client, "missing")
+	defer missing.Topic.Stop()
+	if err := missing.Send(ctx, notify.Notification{Job: job}); err == nil {
+		t.Error("Expected error for missing topic")
+	}
+}
@@ -0,0 +1,53 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// WebhookSender POSTs notifications as json to a URL.
+type WebhookSender struct {
+	URL    string
+	Client *http.Client
+}
+
+// NewWebhookSender creates a WebhookSender using an HTTP client that times
+// out after sendTimeout.
+func NewWebhookSender(url string) *WebhookSender {
+	return &WebhookSender{URL: url, Client: &http.Client{Timeout: sendTimeout}}
+}
+
+// Kind implements Sender.Kind
+func (ws *WebhookSender) Kind() string {
+	return "webhook"
+}
+
+// Name implements Sender.Name
+func (ws *WebhookSender) Name() string {
+	return ws.URL
+}
+
+// Send implements Sender.Send.  Responses other than 2xx are errors.
+func (ws *WebhookSender) Send(ctx context.Context, n Notification) error {
+	b, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, ws.URL, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := ws.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%w: %s", ErrDelivery, resp.Status)
+	}
+	return nil
+}
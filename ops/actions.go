@@ -5,14 +5,12 @@ import (
 	"errors"
 	"fmt"
 	"log"
-	"net/http"
 	"os"
 	"strings"
 	"time"
 
 	"cloud.google.com/go/bigquery"
 	"github.com/googleapis/google-cloud-go-testing/bigquery/bqiface"
-	"google.golang.org/api/googleapi"
 
 	"github.com/m-lab/etl-gardener/cloud"
 	"github.com/m-lab/etl-gardener/cloud/bq"
@@ -26,94 +24,50 @@ func newStateFunc(detail string) ActionFunc {
 	}
 }
 
-// This returns a ConditionFunc that checks for completion of corresponding
-// annotation job in the tracker.  Used to gate the join action.
-func newJoinConditionFunc(tk *tracker.Tracker, detail string) ConditionFunc {
-	return func(ctx context.Context, j tracker.Job) bool {
-		if j.Datatype == "annotation" {
-			// Annotation does not require joining, so the check is
-			// not needed.
-			log.Println(j, "condition met")
-			return true
-		}
-		// All other types currently depend only on the annotation table.
-		// So, we check whether the annotation table is complete.
-		// (Technically, we only need to know whether the copy has completed.)
-		ann := j
-		ann.Datatype = "annotation"
-		status, err := tk.GetStatus(ann)
-		if err != nil {
-			// For early dates, there is no annotation job, so if the job
-			// is absent, we proceed with the join.
-			log.Println(ann, "is absent")
-			return true
-		}
-		log.Println(ann, status.LastStateInfo())
-		return status.State() == tracker.Complete
-	}
-}
-
 // NewStandardMonitor creates the standard monitor that handles several state transitions.
+// The default Pipeline is Loading, Deduplicating, Validating, Copying, Deleting, Joining.
+// Exporting is added to the pipelines of sources with an export.
 func NewStandardMonitor(ctx context.Context, config cloud.BQConfig, tk *tracker.Tracker) (*Monitor, error) {
 	m, err := NewMonitor(ctx, config, tk)
 	if err != nil {
 		return nil, err
 	}
-	m.AddAction(tracker.ParseComplete,
-		nil,
-		newStateFunc("-"),
-		tracker.Loading)
-	m.AddAction(tracker.Loading,
-		nil,
-		loadFunc,
-		tracker.Deduplicating)
-	m.AddAction(tracker.Deduplicating,
-		nil,
-		dedupFunc,
-		tracker.Copying)
-	m.AddAction(tracker.Copying,
-		nil,
-		copyFunc,
-		tracker.Deleting)
-	m.AddAction(tracker.Deleting,
-		nil,
-		deleteFunc,
+	m.actions, err = m.StandardPipeline(
+		tracker.Loading,
+		tracker.Deduplicating,
+		tracker.Validating,
+		tracker.Copying,
+		tracker.Deleting,
 		tracker.Joining)
-	m.AddAction(tracker.Joining,
-		newJoinConditionFunc(tk, "Join condition"),
-		joinFunc,
-		tracker.Complete)
+	if err != nil {
+		return nil, err
+	}
 	return m, nil
 }
 
-// Waits for bqjob to complete, handles backoff and job updates.
+// Waits for bqjob to complete, and classifies any error as retryable or fatal.
 // Returns non-nil status if successful.
 func waitAndCheck(ctx context.Context, bqJob bqiface.Job, j tracker.Job, label string) (*bigquery.JobStatus, *Outcome) {
 	status, err := bqJob.Wait(ctx)
 	if err != nil {
-		switch typedErr := err.(type) {
-		case *googleapi.Error:
-			if typedErr.Code == http.StatusBadRequest &&
-				strings.Contains(typedErr.Error(), "streaming buffer") {
-				log.Println(typedErr)
-				metrics.WarningCount.WithLabelValues(
-					j.Experiment, j.Datatype,
-					label+"WaitingForStreamingBuffer").Inc()
-
-				// Leave in current state, Wait a while and try again.
-				return nil, Retry(j, err, "waiting for empty streaming buffer")
-			}
-			log.Println(typedErr, typedErr.Code)
-		default:
-			// We don't know the problem...
+		c := ClassifyError(err)
+		if c == StreamingBuffer {
+			log.Println(err)
+			metrics.WarningCount.WithLabelValues(
+				j.Experiment, j.Datatype,
+				label+"WaitingForStreamingBuffer").Inc()
+
+			// Leave in current state, Wait a while and try again.
+			return nil, Retry(j, err, "waiting for empty streaming buffer")
 		}
-		// Not googleapi.Error, OR not streaming buffer problem.
 		log.Println(j, label, err)
-		metrics.WarningCount.WithLabelValues(
-			j.Experiment, j.Datatype,
-			label+"UnknownError").Inc()
-		// This will terminate this job.
-		return status, Failure(j, err, "unknown error")
+		if c == UnknownError {
+			metrics.WarningCount.WithLabelValues(
+				j.Experiment, j.Datatype,
+				label+"UnknownError").Inc()
+		}
+		// Fatal errors will terminate this job.
+		return status, withQueryStats(errorOutcome(j, err, false), status)
 	}
 	if status.Err() != nil {
 		err := status.Err()
@@ -121,16 +75,26 @@ func waitAndCheck(ctx context.Context, bqJob bqiface.Job, j tracker.Job, label s
 		for i := range status.Errors {
 			log.Println("---", j, label, status.Errors[i])
 		}
-		metrics.WarningCount.WithLabelValues(
-			j.Experiment, j.Datatype,
-			label+"UnknownStatusError").Inc()
+		if ClassifyError(err) == UnknownError {
+			metrics.WarningCount.WithLabelValues(
+				j.Experiment, j.Datatype,
+				label+"UnknownStatusError").Inc()
+		}
 
-		// This will terminate this job.
-		return status, Failure(j, err, "unknown error")
+		// Fatal errors will terminate this job.
+		return status, withQueryStats(errorOutcome(j, err, false), status)
 	}
 	return status, Success(j, "-")
 }
 
+// dryRunOutcome logs the estimated bytes of a dry run, and returns a
+// successful Outcome, so that the job advances without mutating any tables.
+func dryRunOutcome(j tracker.Job, op string, status *bigquery.JobStatus) *Outcome {
+	msg := fmt.Sprintf("Dry run %s: estimated %d MB processed", op, bq.EstimatedBytes(status)/1000000)
+	log.Println(j, msg)
+	return Success(j, msg)
+}
+
 // TODO - would be nice to persist this object, instead of creating it
 // repeatedly.  If we end up with separate state machine per job, that
 // would be a good place for the TableOps object.
@@ -177,16 +141,19 @@ func dedupFunc(ctx context.Context, j tracker.Job, stateChangeTime time.Time) *O
 		// This terminates this job.
 		return Failure(j, err, "-")
 	}
-	bqJob, err := qp.Dedup(ctx, false)
+	bqJob, err := qp.Dedup(ctx, isDryRun(ctx))
 	if err != nil {
 		log.Println(j, err)
-		// Try again soon.
-		return Retry(j, err, "-")
+		// Try again soon, unless the error is fatal.
+		return errorOutcome(j, err, true)
 	}
 	status, outcome := waitAndCheck(ctx, bqJob, j, "Dedup")
 	if !outcome.IsDone() {
 		return outcome
 	}
+	if isDryRun(ctx) {
+		return dryRunOutcome(j, "Dedup", status)
+	}
 	if status == nil {
 		// Nil status means the job failed.
 		return Failure(j, errors.New("nil status"), "-")
@@ -194,6 +161,40 @@ func dedupFunc(ctx context.Context, j tracker.Job, stateChangeTime time.Time) *O
 
 	// Dedup job was successful.  Handle the statistics, metrics, tracker update.
 	msg := interpretStatus("Dedup", j, status, delay)
+	return querySuccess(j, msg, status)
+}
+
+// validateFunc checks the deduplicated partition before it is copied over
+// the raw partition.  Jobs that fail validation are failed, so that the raw
+// partition is not replaced.
+func validateFunc(ctx context.Context, j tracker.Job, stateChangeTime time.Time) *Outcome {
+	to, err := tableOps(ctx, j)
+	if err != nil {
+		log.Println(j, err)
+		// This terminates this job.
+		return Failure(j, err, "-")
+	}
+	if to.Validation.IsZero() {
+		return Success(j, "no validation checks")
+	}
+	if isDryRun(ctx) {
+		return Success(j, "Dry run: validation skipped")
+	}
+	stats, err := to.Validate(ctx)
+	if errors.Is(err, bq.ErrValidationFailed) {
+		log.Println(j, err)
+		metrics.WarningCount.WithLabelValues(
+			j.Experiment, j.Datatype,
+			"ValidationFailed").Inc()
+		return Failure(j, err, "-")
+	}
+	if err != nil {
+		log.Println(j, err)
+		// Try again soon, unless the error is fatal.
+		return errorOutcome(j, err, true)
+	}
+	msg := fmt.Sprintf("Validated %d rows", stats.Rows)
+	log.Println(j, msg)
 	return Success(j, msg)
 }
 
@@ -242,6 +243,21 @@ func handleWaitError(label string, j tracker.Job, status *bigquery.JobStatus) *O
 	return Failure(j, err, "unknown error")
 }
 
+// missingField returns true if a load failed because the loaded files have
+// fields that are not in the table schema.
+func missingField(status *bigquery.JobStatus) bool {
+	if status == nil {
+		return false
+	}
+	for _, e := range status.Errors {
+		if e != nil && strings.Contains(e.Message, "No such field") {
+			return true
+		}
+	}
+	err := status.Err()
+	return err != nil && strings.Contains(err.Error(), "No such field")
+}
+
 // Returns non-nil Outcome even if successful.
 func waitForLoad(ctx context.Context, bqJob bqiface.Job, j tracker.Job, label string) (*bigquery.JobStatus, *Outcome) {
 	status, err := bqJob.Wait(ctx)
@@ -271,16 +287,39 @@ func loadFunc(ctx context.Context, j tracker.Job, stateChangeTime time.Time) *Ou
 		// This terminates this job.
 		return Failure(j, err, "-")
 	}
-	bqJob, err := qp.LoadToTmp(ctx, false)
+	// Create the tables, or update their schemas, if necessary.
+	if err := qp.EnsureTables(ctx, isDryRun(ctx)); err != nil {
+		log.Println(j, err)
+		return errorOutcome(j, err, true)
+	}
+	bqJob, err := qp.LoadToTmp(ctx, isDryRun(ctx))
 	if err != nil {
 		log.Println(j, err)
-		// Try again soon.
-		return Retry(j, err, "-")
+		// Try again soon, unless the error is fatal.
+		return errorOutcome(j, err, true)
 	}
 	status, outcome := waitAndCheck(ctx, bqJob, j, "Load")
+	if !outcome.IsDone() && missingField(status) && qp.Load.AllowsFieldAddition() && qp.Schema.Schema != nil {
+		// Failed loads do not change the table, so load again, adding the
+		// new fields of the configured schema to the table schema.
+		log.Println(j, "Load failed with missing field, loading with schema relaxation")
+		metrics.WarningCount.WithLabelValues(
+			j.Experiment, j.Datatype,
+			"LoadSchemaRelaxed").Inc()
+		qp.RelaxSchema = true
+		bqJob, err = qp.LoadToTmp(ctx, isDryRun(ctx))
+		if err != nil {
+			log.Println(j, err)
+			return errorOutcome(j, err, true)
+		}
+		status, outcome = waitAndCheck(ctx, bqJob, j, "Load")
+	}
 	if !outcome.IsDone() {
 		return outcome
 	}
+	if isDryRun(ctx) {
+		return dryRunOutcome(j, "Load", status)
+	}
 
 	msg := "nil stats" // In case stats are nil.
 	stats := status.Statistics
@@ -319,16 +358,20 @@ func copyFunc(ctx context.Context, j tracker.Job, stateChangeTime time.Time) *Ou
 		// This terminates this job.
 		return Failure(j, err, "-")
 	}
-	bqJob, err := qp.CopyToRaw(ctx, false)
+	qp.BackupSince = stateChangeTime
+	bqJob, err := qp.CopyToRaw(ctx, isDryRun(ctx))
 	if err != nil {
 		log.Println(j, err)
-		// Try again soon.
-		return Retry(j, err, "-")
+		// Try again soon, unless the error is fatal.
+		return errorOutcome(j, err, true)
 	}
 	status, outcome := waitAndCheck(ctx, bqJob, j, "Copy")
 	if !outcome.IsDone() {
 		return outcome
 	}
+	if isDryRun(ctx) {
+		return dryRunOutcome(j, "Copy", status)
+	}
 
 	msg := "nil stats"
 	stats := status.Statistics
@@ -352,22 +395,21 @@ func deleteFunc(ctx context.Context, j tracker.Job, stateChangeTime time.Time) *
 		// This terminates this job.
 		return Failure(j, err, "-")
 	}
-	err = qp.DeleteTmp(ctx)
+	err = qp.DeleteTmp(ctx, isDryRun(ctx))
 	if err != nil {
 		log.Println(j, err)
-		// Try again soon.
-		return Retry(j, err, "-")
+		// Try again soon, unless the error is fatal.
+		return errorOutcome(j, err, true)
 	}
 
+	if isDryRun(ctx) {
+		return Success(j, "Dry run: partition would be deleted")
+	}
 	// TODO - add elapsed time to message.
 	return Success(j, "Successfully deleted partition")
 }
 
 func joinFunc(ctx context.Context, j tracker.Job, stateChangeTime time.Time) *Outcome {
-	if j.Datatype == "annotation" {
-		// annotation should not be annotated.
-		return Success(j, "Annotation does not require join")
-	}
 	delay := time.Since(stateChangeTime).Round(time.Minute)
 	to, err := tableOps(ctx, j)
 	if err != nil {
@@ -375,12 +417,17 @@ func joinFunc(ctx context.Context, j tracker.Job, stateChangeTime time.Time) *Ou
 		// This terminates this job.
 		return Failure(j, err, "-")
 	}
+	if !to.NeedsJoin {
+		// e.g. annotation should not be annotated.
+		return Success(j, j.Datatype+" does not require join")
+	}
 
-	bqJob, err := to.Join(ctx, false)
+	to.BackupSince = stateChangeTime
+	bqJob, err := to.Join(ctx, isDryRun(ctx))
 	if err != nil {
 		log.Println(j, err)
-		// Try again soon.
-		return Retry(j, err, "-")
+		// Try again soon, unless the error is fatal.
+		return errorOutcome(j, err, true)
 	}
 	status, outcome := waitAndCheck(ctx, bqJob, j, "Join")
 	if !outcome.IsDone() {
@@ -388,8 +435,60 @@ func joinFunc(ctx context.Context, j tracker.Job, stateChangeTime time.Time) *Ou
 		// https://github.com/m-lab/etl-gardener/issues/315
 		return outcome
 	}
+	if isDryRun(ctx) {
+		return dryRunOutcome(j, "Join", status)
+	}
 
 	// Join job was successful.  Handle the statistics, metrics, tracker update.
 	msg := interpretStatus("Join", j, status, delay)
+	return querySuccess(j, msg, status)
+}
+
+// exportFunc exports the job's final partition to the source's export prefix
+// in GCS, and verifies that the exported files are present.
+func (m *Monitor) exportFunc(ctx context.Context, j tracker.Job, stateChangeTime time.Time) *Outcome {
+	delay := time.Since(stateChangeTime).Round(time.Minute)
+	to, err := tableOps(ctx, j)
+	if err != nil {
+		log.Println(j, err)
+		// This terminates this job.
+		return Failure(j, err, "-")
+	}
+	bqJob, err := to.Export(ctx, isDryRun(ctx))
+	if errors.Is(err, bq.ErrNoExport) {
+		return Failure(j, err, "-")
+	}
+	if err != nil {
+		log.Println(j, err)
+		// Try again soon, unless the error is fatal.
+		return errorOutcome(j, err, true)
+	}
+	status, outcome := waitAndCheck(ctx, bqJob, j, "Export")
+	if !outcome.IsDone() {
+		return outcome
+	}
+	if isDryRun(ctx) {
+		return dryRunOutcome(j, "Export", status)
+	}
+
+	stats := status.Statistics
+	if stats == nil {
+		return Failure(j, errors.New("nil stats"), "-")
+	}
+	opTime := stats.EndTime.Sub(stats.StartTime)
+	msg := fmt.Sprintf("Export to %s took %s (after %s waiting)",
+		to.ExportPrefix(), opTime.Round(100*time.Millisecond), delay)
+	if m.sClient != nil {
+		files, bytes, err := to.VerifyExport(ctx, m.sClient, status)
+		if err != nil {
+			log.Println(j, err)
+			metrics.WarningCount.WithLabelValues(
+				j.Experiment, j.Datatype, "ExportIncomplete").Inc()
+			// Export again.
+			return Retry(j, err, "-")
+		}
+		msg += fmt.Sprintf(", %d files with %d bytes", files, bytes)
+	}
+	log.Println(j, msg)
 	return Success(j, msg)
 }
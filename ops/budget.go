@@ -0,0 +1,229 @@
+package ops
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/m-lab/etl-gardener/config"
+	"github.com/m-lab/etl-gardener/persistence"
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+// budgetUsage reports the fraction of each datatype's budget used in the
+// current window.
+var budgetUsage = promauto.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "gardener_budget_usage_ratio",
+		Help: "Fraction of the BigQuery budget used in the rolling window",
+	},
+	[]string{"datatype", "resource"},
+)
+
+// A Budget limits the BigQuery resources used by the queries of a datatype
+// in a rolling window.  Zero values are unlimited.
+type Budget struct {
+	SlotHours float64
+	Bytes     int64 // Bytes processed.
+}
+
+type queryCost struct {
+	time       time.Time
+	slotMillis int64
+	bytes      int64
+}
+
+// QueryCost is the saved cost of a query.
+type QueryCost struct {
+	Datatype   string
+	Time       time.Time
+	SlotMillis int64
+	Bytes      int64
+}
+
+// BudgetUsage holds the costs in a BudgetManager's window, so that usage
+// survives restarts.
+type BudgetUsage struct {
+	persistence.Base
+	Costs []QueryCost
+}
+
+// GetKind implements StateObject.GetKind
+func (u BudgetUsage) GetKind() string {
+	return "BudgetUsage"
+}
+
+// BudgetManager tracks the slot time and bytes processed by the queries of
+// each datatype over a rolling window, and reports when a datatype has
+// exceeded its Budget.
+type BudgetManager struct {
+	window time.Duration
+
+	lock    sync.Mutex
+	budgets map[string]Budget // by datatype.  "" is the default budget.
+	costs   map[string][]queryCost
+
+	saver    persistence.Saver // Optional.
+	saveLock sync.Mutex        // serializes saves, so that they are not reordered.
+}
+
+// NewBudgetManager creates a BudgetManager with no budgets.
+func NewBudgetManager(window time.Duration) *BudgetManager {
+	return &BudgetManager{
+		window:  window,
+		budgets: make(map[string]Budget),
+		costs:   make(map[string][]queryCost),
+	}
+}
+
+// SetBudget sets the budget of a datatype.  The budget of datatype ""
+// applies to datatypes without their own budget.
+func (b *BudgetManager) SetBudget(datatype string, budget Budget) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.budgets[datatype] = budget
+}
+
+// SetSaver restores the usage saved by a previous instance, and saves the
+// usage after each recorded query.  It should be called before Record.
+func (b *BudgetManager) SetSaver(ctx context.Context, saver persistence.Saver) {
+	u := BudgetUsage{Base: persistence.NewBase("singleton")}
+	ctx, cf := context.WithTimeout(ctx, 5*time.Second)
+	defer cf()
+	if err := saver.Fetch(ctx, &u); err != nil {
+		log.Println(err, u.GetKind())
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.saver = saver
+	start := time.Now().Add(-b.window)
+	for _, c := range u.Costs {
+		if c.Time.After(start) {
+			b.costs[c.Datatype] = append(b.costs[c.Datatype], queryCost{c.Time, c.SlotMillis, c.Bytes})
+		}
+	}
+}
+
+// Record adds the cost of a query to the datatype's usage.
+func (b *BudgetManager) Record(datatype string, stats *bigquery.QueryStatistics) {
+	b.saveLock.Lock()
+	defer b.saveLock.Unlock()
+	b.lock.Lock()
+	b.costs[datatype] = append(b.costs[datatype],
+		queryCost{time.Now(), stats.SlotMillis, stats.TotalBytesProcessed})
+	if b.saver == nil {
+		b.lock.Unlock()
+		return
+	}
+	u := BudgetUsage{Base: persistence.NewBase("singleton")}
+	for dt := range b.costs {
+		b.usage(dt) // Prune the expired costs.
+		for _, c := range b.costs[dt] {
+			u.Costs = append(u.Costs, QueryCost{dt, c.time, c.slotMillis, c.bytes})
+		}
+	}
+	b.lock.Unlock()
+
+	ctx, cf := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cf()
+	if err := b.saver.Save(ctx, &u); err != nil {
+		log.Println(err)
+	}
+}
+
+// usage prunes the expired costs and returns the usage in the window.
+// Caller must hold the lock.
+func (b *BudgetManager) usage(datatype string) (slotHours float64, bytes int64) {
+	costs := b.costs[datatype]
+	start := time.Now().Add(-b.window)
+	for len(costs) > 0 && costs[0].time.Before(start) {
+		costs = costs[1:]
+	}
+	b.costs[datatype] = costs
+	var slotMillis int64
+	for _, c := range costs {
+		slotMillis += c.slotMillis
+		bytes += c.bytes
+	}
+	return float64(slotMillis) / float64(time.Hour/time.Millisecond), bytes
+}
+
+// Usage returns the slot hours and bytes processed by the datatype's queries
+// in the current window.
+func (b *BudgetManager) Usage(datatype string) (slotHours float64, bytes int64) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.usage(datatype)
+}
+
+// Exceeded returns true if the datatype has used its budget.
+func (b *BudgetManager) Exceeded(datatype string) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	budget, ok := b.budgets[datatype]
+	if !ok {
+		budget = b.budgets[""]
+	}
+	slotHours, bytes := b.usage(datatype)
+	exceeded := false
+	if budget.SlotHours > 0 {
+		budgetUsage.WithLabelValues(datatype, "slot_hours").Set(slotHours / budget.SlotHours)
+		exceeded = slotHours >= budget.SlotHours
+	}
+	if budget.Bytes > 0 {
+		budgetUsage.WithLabelValues(datatype, "bytes").Set(float64(bytes) / float64(budget.Bytes))
+		exceeded = exceeded || bytes >= budget.Bytes
+	}
+	return exceeded
+}
+
+// NewBudgetManagerFromConfig creates a BudgetManager with the configured
+// window and budgets.
+func NewBudgetManagerFromConfig(window time.Duration, budgets []config.BudgetConfig) *BudgetManager {
+	b := NewBudgetManager(window)
+	for _, bc := range budgets {
+		b.SetBudget(bc.Datatype, Budget{SlotHours: bc.SlotHours, Bytes: bc.Bytes})
+	}
+	return b
+}
+
+// SetBudgetManager pauses dedup and join actions for datatypes that exceed
+// their budget, and records the cost of all queries.  It should be called
+// before Watch.
+func (m *Monitor) SetBudgetManager(b *BudgetManager) {
+	m.budget = b
+}
+
+// withinBudget is a ConditionFunc that checks whether the job's datatype
+// is within its budget.
+func (m *Monitor) withinBudget(ctx context.Context, j tracker.Job) bool {
+	if m.budget == nil || !m.budget.Exceeded(j.Datatype) {
+		return true
+	}
+	debug.Println(j, "paused, budget exceeded for", j.Datatype)
+	return false
+}
+
+// recordCost records the cost of the query in an Outcome, if any.
+func (m *Monitor) recordCost(j tracker.Job, o *Outcome) {
+	if m.budget != nil && o.queryStats != nil {
+		m.budget.Record(j.Datatype, o.queryStats)
+	}
+}
+
+// allConditions combines ConditionFuncs, which may be nil.
+func allConditions(conds ...ConditionFunc) ConditionFunc {
+	return func(ctx context.Context, j tracker.Job) bool {
+		for _, cond := range conds {
+			if cond != nil && !cond(ctx, j) {
+				return false
+			}
+		}
+		return true
+	}
+}
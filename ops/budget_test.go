@@ -0,0 +1,126 @@
+package ops_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/googleapis/google-cloud-go-testing/bigquery/bqiface"
+	"github.com/m-lab/go/rtx"
+
+	"github.com/m-lab/etl-gardener/cloud"
+	"github.com/m-lab/etl-gardener/config"
+	"github.com/m-lab/etl-gardener/ops"
+	"github.com/m-lab/etl-gardener/persistence"
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+func TestBudgetManager(t *testing.T) {
+	b := ops.NewBudgetManagerFromConfig(50*time.Millisecond, []config.BudgetConfig{
+		{SlotHours: 2},
+		{Datatype: "tcpinfo", SlotHours: 1, Bytes: 1000},
+	})
+	hour := int64(time.Hour / time.Millisecond)
+
+	b.Record("tcpinfo", &bigquery.QueryStatistics{SlotMillis: hour / 2, TotalBytesProcessed: 100})
+	if b.Exceeded("tcpinfo") {
+		t.Error("Budget should not be exceeded")
+	}
+	b.Record("tcpinfo", &bigquery.QueryStatistics{SlotMillis: hour / 2, TotalBytesProcessed: 100})
+	if slotHours, bytes := b.Usage("tcpinfo"); slotHours != 1 || bytes != 200 {
+		t.Error("Wrong usage:", slotHours, bytes)
+	}
+	if !b.Exceeded("tcpinfo") {
+		t.Error("Slot budget should be exceeded")
+	}
+
+	// Other datatypes use the default budget.
+	b.Record("ndt7", &bigquery.QueryStatistics{SlotMillis: hour})
+	if b.Exceeded("ndt7") {
+		t.Error("Default budget should not be exceeded")
+	}
+
+	// Costs expire after the window.
+	time.Sleep(60 * time.Millisecond)
+	if b.Exceeded("tcpinfo") {
+		t.Error("Budget should have recovered")
+	}
+	b.Record("tcpinfo", &bigquery.QueryStatistics{TotalBytesProcessed: 1000})
+	if !b.Exceeded("tcpinfo") {
+		t.Error("Byte budget should be exceeded")
+	}
+}
+
+func TestMonitor_WithinBudget(t *testing.T) {
+	tk, err := tracker.InitTracker(context.Background(), nil, nil, 0, 0, 0)
+	rtx.Must(err, "tk init")
+	m, err := ops.NewMonitor(context.Background(), cloud.BQConfig{}, tk)
+	rtx.Must(err, "NewMonitor failure")
+	job := tracker.NewJob("bucket", "ndt", "tcpinfo", time.Now())
+
+	if !ops.WithinBudget(m, context.Background(), job) {
+		t.Error("Jobs should not be paused without a budget")
+	}
+	b := ops.NewBudgetManager(time.Hour)
+	b.SetBudget("tcpinfo", ops.Budget{Bytes: 10})
+	m.SetBudgetManager(b)
+	b.Record("tcpinfo", &bigquery.QueryStatistics{TotalBytesProcessed: 10})
+	if ops.WithinBudget(m, context.Background(), job) {
+		t.Error("Job should be paused")
+	}
+	other := tracker.NewJob("bucket", "ndt", "ndt7", time.Now())
+	if !ops.WithinBudget(m, context.Background(), other) {
+		t.Error("Other datatypes should not be paused")
+	}
+}
+
+func TestBudgetManager_SetSaver(t *testing.T) {
+	saver := persistence.NewMemorySaver()
+	b := ops.NewBudgetManager(time.Hour)
+	b.SetSaver(context.Background(), saver)
+	b.Record("tcpinfo", &bigquery.QueryStatistics{SlotMillis: 10, TotalBytesProcessed: 100})
+	b.Record("ndt7", &bigquery.QueryStatistics{TotalBytesProcessed: 5})
+
+	// Usage survives a restart.
+	b = ops.NewBudgetManager(time.Hour)
+	b.SetSaver(context.Background(), saver)
+	if _, bytes := b.Usage("tcpinfo"); bytes != 100 {
+		t.Error("Wrong tcpinfo usage:", bytes)
+	}
+	if _, bytes := b.Usage("ndt7"); bytes != 5 {
+		t.Error("Wrong ndt7 usage:", bytes)
+	}
+}
+
+// failedJob is a query job that failed after consuming resources.
+type failedJob struct {
+	bqiface.Job
+	status *bigquery.JobStatus
+}
+
+func (j failedJob) Wait(ctx context.Context) (*bigquery.JobStatus, error) {
+	return j.status, errors.New("query failed")
+}
+
+func TestMonitor_RecordFailedCost(t *testing.T) {
+	tk, err := tracker.InitTracker(context.Background(), nil, nil, 0, 0, 0)
+	rtx.Must(err, "tk init")
+	m, err := ops.NewMonitor(context.Background(), cloud.BQConfig{}, tk)
+	rtx.Must(err, "NewMonitor failure")
+	b := ops.NewBudgetManager(time.Hour)
+	m.SetBudgetManager(b)
+	job := tracker.NewJob("bucket", "ndt", "tcpinfo", time.Now())
+
+	status := &bigquery.JobStatus{Statistics: &bigquery.JobStatistics{
+		Details: &bigquery.QueryStatistics{SlotMillis: 1000, TotalBytesProcessed: 100}}}
+	_, outcome := ops.WaitAndCheck(context.Background(), failedJob{status: status}, job, "Dedup")
+	if outcome.IsDone() {
+		t.Fatal("Expected failure")
+	}
+	ops.RecordCost(m, job, outcome)
+	if _, bytes := b.Usage("tcpinfo"); bytes != 100 {
+		t.Error("Failed query cost was not recorded:", bytes)
+	}
+}
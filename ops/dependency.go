@@ -0,0 +1,103 @@
+package ops
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/m-lab/etl-gardener/config"
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+// A Dependency declares that jobs must wait for the jobs of another
+// experiment/datatype, for one or more dates, to be Complete.
+// Dependencies are checked before the Joining action.
+type Dependency struct {
+	Experiment string
+	Datatype   string
+	// DateOffsets are the dates, in days relative to the dependent job's date,
+	// of the jobs that must be complete.  If empty, only the same date is required.
+	DateOffsets []int
+}
+
+// jobs returns the jobs that the dependent job j must wait for.
+func (d Dependency) jobs(j tracker.Job) []tracker.Job {
+	offsets := d.DateOffsets
+	if len(offsets) == 0 {
+		offsets = []int{0}
+	}
+	jobs := make([]tracker.Job, 0, len(offsets))
+	for _, offset := range offsets {
+		dep := j
+		dep.Experiment = d.Experiment
+		dep.Datatype = d.Datatype
+		dep.Date = j.Date.AddDate(0, 0, offset)
+		jobs = append(jobs, dep)
+	}
+	return jobs
+}
+
+// AddDependencies declares the dependencies for jobs with the given experiment and datatype.
+// It should be called before Watch.
+func (m *Monitor) AddDependencies(experiment, datatype string, deps ...Dependency) {
+	key := pipelineKey(experiment, datatype)
+	m.dependencies[key] = append(m.dependencies[key], deps...)
+}
+
+// AddSourceDependencies adds the dependencies declared for each source in the config.
+// If a dependency does not specify an experiment, the source's experiment is used.
+func (m *Monitor) AddSourceDependencies(sources []config.SourceConfig) {
+	for _, src := range sources {
+		for _, dc := range src.DependsOn {
+			dep := Dependency{
+				Experiment:  dc.Experiment,
+				Datatype:    dc.Datatype,
+				DateOffsets: dc.DateOffsets,
+			}
+			if dep.Experiment == "" {
+				dep.Experiment = src.Experiment
+			}
+			m.AddDependencies(src.Experiment, src.Datatype, dep)
+		}
+	}
+}
+
+// unmetDependencies returns a description of each dependency job that is not yet Complete.
+func (m *Monitor) unmetDependencies(j tracker.Job) []string {
+	unmet := []string{}
+	for _, d := range m.dependencies[pipelineKey(j.Experiment, j.Datatype)] {
+		for _, dep := range d.jobs(j) {
+			status, err := m.tk.GetStatus(dep)
+			if err != nil {
+				// For early dates, dependency jobs may not exist, and completed
+				// jobs are eventually removed, so absent jobs do not block.
+				debug.Println(dep, "is absent")
+				continue
+			}
+			if status.State() != tracker.Complete {
+				unmet = append(unmet, fmt.Sprintf("%s (%s)", dep, status.State()))
+			}
+		}
+	}
+	return unmet
+}
+
+// dependenciesMet is a ConditionFunc that checks whether all of the job's
+// dependencies are Complete.  If they are not, the unmet dependencies are
+// reported in the job's detail.
+func (m *Monitor) dependenciesMet(ctx context.Context, j tracker.Job) bool {
+	unmet := m.unmetDependencies(j)
+	if len(unmet) == 0 {
+		debug.Println(j, "dependencies met")
+		return true
+	}
+	detail := "Waiting for " + strings.Join(unmet, ", ")
+	// Only update the detail when it changes, as updates also prevent job expiration.
+	if status, err := m.tk.GetStatus(j); err == nil && status.Detail() != detail {
+		if err := m.tk.SetClaimedDetail(claimFrom(ctx, j), detail); err != nil {
+			log.Println(j, err)
+		}
+	}
+	return false
+}
@@ -0,0 +1,73 @@
+package ops_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/m-lab/go/rtx"
+
+	"github.com/m-lab/etl-gardener/cloud"
+	"github.com/m-lab/etl-gardener/config"
+	"github.com/m-lab/etl-gardener/ops"
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+func TestDependencies(t *testing.T) {
+	ctx := context.Background()
+	tk, err := tracker.InitTracker(ctx, nil, nil, 0, 0, time.Minute)
+	rtx.Must(err, "tk init")
+	m, err := ops.NewMonitor(ctx, cloud.BQConfig{}, tk)
+	rtx.Must(err, "NewMonitor failure")
+	m.AddSourceDependencies([]config.SourceConfig{
+		{Experiment: "ndt", Datatype: "ndt7",
+			DependsOn: []config.DependencyConfig{{Datatype: "annotation", DateOffsets: []int{-1, 0}}}},
+	})
+
+	date := time.Date(2021, 3, 4, 0, 0, 0, 0, time.UTC)
+	ndt7 := tracker.NewJob("bucket", "ndt", "ndt7", date)
+	annToday := tracker.NewJob("bucket", "ndt", "annotation", date)
+	annYesterday := tracker.NewJob("bucket", "ndt", "annotation", date.AddDate(0, 0, -1))
+	must(t, tk.AddJob(ndt7))
+
+	// Absent dependencies do not block.
+	if !ops.DependenciesMet(m, ctx, ndt7) {
+		t.Error("Absent dependencies should be met")
+	}
+
+	must(t, tk.AddJob(annToday))
+	must(t, tk.AddJob(annYesterday))
+	must(t, tk.SetStatus(annYesterday, tracker.Loading, ""))
+	if ops.DependenciesMet(m, ctx, ndt7) {
+		t.Error("Dependencies should not be met")
+	}
+	status, err := tk.GetStatus(ndt7)
+	must(t, err)
+	if !strings.Contains(status.Detail(), "20210303:ndt/annotation (loading)") ||
+		!strings.Contains(status.Detail(), "20210304:ndt/annotation (init)") {
+		t.Error("Detail should list unmet dependencies:", status.Detail())
+	}
+
+	// Repeated checks should not update the job.
+	ops.DependenciesMet(m, ctx, ndt7)
+	again, err := tk.GetStatus(ndt7)
+	must(t, err)
+	if again.UpdateCount != status.UpdateCount {
+		t.Error("Unchanged detail should not be updated", again.UpdateCount, status.UpdateCount)
+	}
+
+	must(t, tk.SetStatus(annToday, tracker.Complete, ""))
+	if ops.DependenciesMet(m, ctx, ndt7) {
+		t.Error("Dependencies should not be met")
+	}
+	must(t, tk.SetStatus(annYesterday, tracker.Complete, ""))
+	if !ops.DependenciesMet(m, ctx, ndt7) {
+		t.Error("Dependencies should be met")
+	}
+
+	// Annotation has no dependencies.
+	if !ops.DependenciesMet(m, ctx, annToday) {
+		t.Error("annotation should not have dependencies")
+	}
+}
@@ -3,6 +3,8 @@ package ops
 import (
 	"fmt"
 
+	"cloud.google.com/go/bigquery"
+
 	"github.com/m-lab/etl-gardener/tracker"
 )
 
@@ -14,6 +16,9 @@ type Outcome struct {
 	error  // possibly nil
 	retry  bool
 	detail string
+	claim  int64 // Token of the Claim the action ran under, if any.
+
+	queryStats *bigquery.QueryStatistics // Cost of the action's query, if any.
 }
 
 // ShouldRetry indicates of the operation should be retried later.
@@ -55,3 +60,17 @@ func Retry(job tracker.Job, err error, detail string) *Outcome {
 func Success(job tracker.Job, detail string) *Outcome {
 	return &Outcome{job: job, detail: detail}
 }
+
+// querySuccess returns a successful outcome that records the query statistics.
+func querySuccess(job tracker.Job, detail string, status *bigquery.JobStatus) *Outcome {
+	return withQueryStats(Success(job, detail), status)
+}
+
+// withQueryStats adds the query statistics in status, if any, to the
+// Outcome, so that the cost of failed queries is also recorded.
+func withQueryStats(o *Outcome, status *bigquery.JobStatus) *Outcome {
+	if status != nil && status.Statistics != nil {
+		o.queryStats, _ = status.Statistics.Details.(*bigquery.QueryStatistics)
+	}
+	return o
+}
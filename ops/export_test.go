@@ -1,4 +1,11 @@
 package ops
 
-var NewJoinConditionFunc = newJoinConditionFunc
+var DependenciesMet = (*Monitor).dependenciesMet
 var JoinFunc = joinFunc
+var WithinBudget = (*Monitor).withinBudget
+var IsDryRun = isDryRun
+var MissingField = missingField
+var WaitAndCheck = waitAndCheck
+var RecordCost = (*Monitor).recordCost
+var ApplyActions = (*Monitor).applyActions
+var WaitingJobs = waitingJobs
@@ -4,15 +4,19 @@ package ops
 
 import (
 	"context"
+	"fmt"
 	"log"
+	"sort"
 	"sync"
 	"time"
 
+	"github.com/googleapis/google-cloud-go-testing/storage/stiface"
 	"github.com/m-lab/go/logx"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 
 	"github.com/m-lab/etl-gardener/cloud"
+	"github.com/m-lab/etl-gardener/config"
 	"github.com/m-lab/etl-gardener/tracker"
 )
 
@@ -24,11 +28,13 @@ ultimately update the Job's State.
 
 A Monitor is initialized by adding Actions for each State that should be handled.  The client
 code should then invoke "go Watch(...)" to start watching the tracker for eligible Jobs.
+Actions added directly to the Monitor form the default Pipeline.  Jobs of experiments and
+datatypes that need a different sequence of Actions can be given their own Pipeline.
 
-The package assumes that there is only one Action associated with a State, and
-that States with Actions are never operated on independently by some other agent,
-such as the Parser.  Should this cease to be true, then the claim mechanism
-should be moved into the tracker.
+The package assumes that there is only one Action associated with a State.  Jobs
+are claimed in the tracker while an Action runs, and the Action's updates carry the
+claim's token, so that they are rejected if the job was changed by an operator, or
+removed and added again, in the meantime.
 
 Note that when Gardener restarts, it fetches the current state from datastore, and
 creates the monitor.  In the new monitor, none of the tracker items will have leases,
@@ -58,8 +64,19 @@ var actionDuration = promauto.NewHistogramVec(
 	[]string{"action", "outcome"},
 )
 
+// waitingJobs counts the jobs that are eligible for an action, and meet its
+// condition, but are waiting because of a concurrency limit.
+var waitingJobs = promauto.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "gardener_monitor_waiting_jobs",
+		Help: "Number of jobs waiting for a concurrency limit, by action",
+	},
+	[]string{"action"},
+)
+
 // A ConditionFunc checks whether a Job meets some condition.
-// These functions may take a long time to complete, but should NOT use a lot of resources.
+// These functions are checked in the Monitor loop, before the job takes any
+// concurrency limit, so they should complete quickly.
 type ConditionFunc = func(ctx context.Context, job tracker.Job) bool
 
 // An ActionFunc performs an operation on a job, and updates its state.
@@ -93,47 +110,169 @@ type Monitor struct {
 	// TODO add bqClient, to allow fakes for testing.
 	bqconfig cloud.BQConfig // static after creation
 
-	// TODO allow different action map for each datatype?
-	actions map[tracker.State]Action // static after creation
+	actions   *Pipeline            // default pipeline, static after creation
+	pipelines map[string]*Pipeline // pipelines by experiment/datatype, static after creation
+
+	dependencies map[string][]Dependency // dependencies by experiment/datatype, static after creation
+
+	retryPolicies map[tracker.State]config.RetryPolicy // static after creation
+
+	// Concurrency limits, static after creation.  Zero or missing means unlimited.
+	actionLimits   map[tracker.State]int // by action state
+	datatypeLimits map[string]int        // by datatype, for all actions
+
+	budget *BudgetManager // Optional, static after creation.
+
+	dryRun bool // static after creation
+
+	sClient stiface.Client // Optional, used to verify exports.  Static after creation.
 
 	tk *tracker.Tracker
 
-	lock      sync.Mutex               // protects jobClaims
-	jobClaims map[tracker.Job]struct{} // Claimed jobs currently being acted on.
+	lock sync.Mutex // protects running counts
+
+	runningActions   map[tracker.State]int // Running actions by state.
+	runningDatatypes map[string]int        // Running actions by datatype.
 }
 
 // releaser creates a function that releases the claim on a job.
-func (m *Monitor) releaser(j tracker.Job) func() {
+func (m *Monitor) releaser(c tracker.Claim) func() {
 	return func() {
-		m.lock.Lock()
-		defer m.lock.Unlock()
-		delete(m.jobClaims, j)
+		if err := m.tk.ReleaseClaim(c); err != nil {
+			debug.Println(c.Job, "release claim:", err)
+		}
+	}
+}
+
+// Returns the claim and its releaser if successful, nil otherwise.
+func (m *Monitor) tryClaimJob(j tracker.Job, state tracker.State) (tracker.Claim, func()) {
+	c, err := m.tk.ClaimJob(j, state)
+	if err != nil {
+		return c, nil
+	}
+	return c, m.releaser(c)
+}
+
+// startAction counts a claimed job as a running action, until endAction is
+// called.  Returns false if the job must wait for a concurrency limit.
+func (m *Monitor) startAction(j tracker.Job, state tracker.State) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if limit := m.actionLimits[state]; limit > 0 && m.runningActions[state] >= limit {
+		return false
 	}
+	if limit := m.datatypeLimits[j.Datatype]; limit > 0 && m.runningDatatypes[j.Datatype] >= limit {
+		return false
+	}
+	m.runningActions[state]++
+	m.runningDatatypes[j.Datatype]++
+	return true
 }
 
-// Returns releaser if successful, nil otherwise.
-func (m *Monitor) tryClaimJob(j tracker.Job) func() {
+// endAction releases the concurrency limits held by a claimed job.  The claim
+// itself may be held longer, e.g. while waiting to retry.
+func (m *Monitor) endAction(j tracker.Job, state tracker.State) {
 	m.lock.Lock()
 	defer m.lock.Unlock()
-	if _, ok := m.jobClaims[j]; ok {
-		return nil
+	m.runningActions[state]--
+	m.runningDatatypes[j.Datatype]--
+}
+
+// SetActionLimit limits the number of jobs that may run the Action of a
+// state concurrently.
+func (m *Monitor) SetActionLimit(state tracker.State, limit int) {
+	m.actionLimits[state] = limit
+}
+
+// SetDatatypeLimit limits the number of jobs of a datatype that may run any
+// Action concurrently.
+func (m *Monitor) SetDatatypeLimit(datatype string, limit int) {
+	m.datatypeLimits[datatype] = limit
+}
+
+// AddConcurrencyLimits sets the action and datatype limits from the config.
+func (m *Monitor) AddConcurrencyLimits(actions map[string]int, datatypes map[string]int) {
+	for state, limit := range actions {
+		m.SetActionLimit(tracker.State(state), limit)
+	}
+	for dt, limit := range datatypes {
+		m.SetDatatypeLimit(dt, limit)
 	}
-	m.jobClaims[j] = struct{}{}
-	return m.releaser(j)
 }
 
-// AddAction adds a specific action to the Monitor.
+// AddAction adds a specific action to the Monitor's default Pipeline.
 func (m *Monitor) AddAction(state tracker.State, cond ConditionFunc, op ActionFunc,
 	successState tracker.State) {
-	m.actions[state] = Action{
-		fromState: state,
-		nextState: successState,
-		condition: cond,
-		action:    op,
+	m.actions.AddAction(state, cond, op, successState)
+}
+
+// SetRetryPolicy sets the RetryPolicy for the Action of a state.  States
+// without a RetryPolicy use the DefaultRetryPolicy.
+func (m *Monitor) SetRetryPolicy(state tracker.State, p config.RetryPolicy) {
+	m.retryPolicies[state] = p
+}
+
+// AddRetryPolicies sets the retry policies from the config.
+func (m *Monitor) AddRetryPolicies(policies []config.RetryConfig) {
+	for _, rc := range policies {
+		m.SetRetryPolicy(tracker.State(rc.State), DefaultRetryPolicy.WithConfig(rc))
+	}
+}
+
+// retryPolicy returns the RetryPolicy for a state.
+func (m *Monitor) retryPolicy(state tracker.State) config.RetryPolicy {
+	if p, ok := m.retryPolicies[state]; ok {
+		return p
 	}
+	return DefaultRetryPolicy
+}
+
+// dryRunKey is the context key that marks actions as dry runs.
+type dryRunKey struct{}
+
+// SetDryRun puts the Monitor in dry run mode, in which actions validate
+// their BigQuery jobs with dry runs, log the estimated bytes, and advance
+// the job state without mutating any tables.  It should be called before Watch.
+func (m *Monitor) SetDryRun(dryRun bool) {
+	m.dryRun = dryRun
 }
 
-// UpdateJob updates the tracker state with the outcome.
+// SetStorageClient sets the storage client used to verify that exports are
+// complete.  Without a storage client, exports are not verified.  It should be
+// called before Watch.
+func (m *Monitor) SetStorageClient(sClient stiface.Client) {
+	m.sClient = sClient
+}
+
+// claimKey is the context key for the Claim that an action runs under.
+type claimKey struct{}
+
+// claimFrom returns the Claim that the action context runs under, or a
+// zero Claim for the job if there is none.
+func claimFrom(ctx context.Context, j tracker.Job) tracker.Claim {
+	if c, ok := ctx.Value(claimKey{}).(tracker.Claim); ok && c.Job == j {
+		return c
+	}
+	return tracker.Claim{Job: j}
+}
+
+// isDryRun returns true if the action context is a dry run.
+func isDryRun(ctx context.Context) bool {
+	dryRun, _ := ctx.Value(dryRunKey{}).(bool)
+	return dryRun
+}
+
+// pipeline returns the Pipeline that applies to a job.
+func (m *Monitor) pipeline(j tracker.Job) *Pipeline {
+	if p, ok := m.pipelines[pipelineKey(j.Experiment, j.Datatype)]; ok {
+		return p
+	}
+	return m.actions
+}
+
+// UpdateJob updates the tracker state with the outcome.  Retries are counted
+// in the job's Status, and the job is failed, with a summary of the attempts,
+// when the RetryPolicy for its current state is exhausted.
 func (m *Monitor) UpdateJob(o *Outcome, state tracker.State) (string, error) {
 	// Allow error to override implicit (-) detail.
 	detail := o.detail
@@ -141,52 +280,98 @@ func (m *Monitor) UpdateJob(o *Outcome, state tracker.State) (string, error) {
 		detail = o.error.Error()
 	}
 
+	c := tracker.Claim{Job: o.job, Token: o.claim}
 	switch {
 	case o.IsDone():
-		if err := m.tk.SetStatus(o.job, state, detail); err != nil {
+		if err := m.tk.SetClaimedStatus(c, state, detail); err != nil {
 			return "set status error", err
 		}
 		return "done", nil
 	case o.ShouldRetry():
-		if err := m.tk.SetDetail(o.job, detail); err != nil {
+		status, err := m.tk.RecordClaimedAttempt(c, detail)
+		if err != nil {
 			return "set status error", err
 		}
+		if m.retryPolicy(status.State()).Exhausted(status.Attempts) {
+			summary := fmt.Sprintf("gave up after %d attempts in %v, last error: %s",
+				status.Attempts, time.Since(status.StateChangeTime()).Round(time.Second), detail)
+			if err := m.tk.SetClaimedJobError(c, summary); err != nil {
+				return "set status error", err
+			}
+			return "fail", nil
+		}
 		return "retry", nil
 	default:
-		if err := m.tk.SetJobError(o.job, detail); err != nil {
+		if err := m.tk.SetClaimedJobError(c, detail); err != nil {
 			return "set status error", err
 		}
 		return "fail", nil
 	}
 }
 
-// applyAction tries to claim a job and apply an action.  Returns false if the job is already claimed.
-func (m *Monitor) tryApplyAction(ctx context.Context, a Action, j tracker.Job, s tracker.Status) bool {
+// tryApplyAction tries to claim a job and apply an action.  Returns false if
+// the job is already claimed or does not meet the action's condition, and
+// limited = true if the job must wait for a concurrency limit.  The condition
+// is checked before the concurrency limits, so that jobs that cannot run do
+// not hold limits that other jobs are waiting for.
+func (m *Monitor) tryApplyAction(ctx context.Context, a Action, j tracker.Job, s tracker.Status) (claimed bool, limited bool) {
 	// If job is not already claimed.
-	releaser := m.tryClaimJob(j)
+	claim, releaser := m.tryClaimJob(j, a.fromState)
 	if releaser == nil {
-		return false
+		return false, false
+	}
+	ctx = context.WithValue(ctx, claimKey{}, claim)
+	if m.dryRun {
+		ctx = context.WithValue(ctx, dryRunKey{}, true)
+	}
+	if a.condition != nil && !a.condition(ctx, j) {
+		releaser()
+		return false, false
+	}
+	if !m.startAction(j, a.fromState) {
+		releaser()
+		return false, true
 	}
 	go func(j tracker.Job, s tracker.Status, a Action, releaser func()) {
 		defer releaser()
-		if a.condition == nil || a.condition(ctx, j) {
-			// These jobs may be deleted by other calls to GetAll, so tk.UpdateJob may fail.
-			if a.action != nil {
-				start := time.Now()
-				outcome := a.action(ctx, j, s.StateChangeTime())
-				if outcome.ShouldRetry() {
-					time.Sleep(2 * time.Minute)
-				}
-				// nextState will be applied only if the outcome was successful
-				status, err := m.UpdateJob(outcome, a.nextState)
-				if err != nil {
-					log.Println("Error updating job:", err)
-				}
-				actionDuration.WithLabelValues(a.Name(), status).Observe(time.Since(start).Seconds())
+		running := true
+		endAction := func() {
+			if running {
+				m.endAction(j, a.fromState)
+				running = false
+			}
+		}
+		defer endAction()
+		// These jobs may be deleted by other calls to GetAll, so tk.UpdateJob may fail.
+		if a.action != nil {
+			start := time.Now()
+			outcome := a.action(ctx, j, s.StateChangeTime())
+			outcome.claim = claim.Token
+			m.recordCost(j, outcome)
+			// nextState will be applied only if the outcome was successful
+			status, err := m.UpdateJob(outcome, a.nextState)
+			if err != nil {
+				log.Println("Error updating job:", err)
+			}
+			actionDuration.WithLabelValues(a.Name(), status).Observe(time.Since(start).Seconds())
+			endAction()
+			if status == "retry" {
+				// Hold the claim until the job may be retried.
+				m.backoff(ctx, a.fromState, s.Attempts+1)
 			}
 		}
 	}(j, s, a, releaser)
-	return true
+	return true, false
+}
+
+// backoff waits for the RetryPolicy delay after the given number of attempts.
+func (m *Monitor) backoff(ctx context.Context, state tracker.State, attempts int) {
+	timer := time.NewTimer(m.retryPolicy(state).Delay(attempts))
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+	case <-timer.C:
+	}
 }
 
 // Watch polls the tracker, and takes appropriate actions.
@@ -204,20 +389,61 @@ func (m *Monitor) Watch(ctx context.Context, period time.Duration) {
 			debug.Println("===== Monitor Loop Starting =====")
 			// These jobs may be deleted by other calls to GetAll, so tk.UpdateJob may fail.
 			jobs, _, _ := m.tk.GetState()
-			// Iterate over the job/status map...
-			for j, s := range jobs {
-				// If job is in a state that has an associated action...
-				if a, ok := m.actions[s.LastStateInfo().State]; ok {
-					m.tryApplyAction(ctx, a, j, s)
-				}
-			}
+			m.applyActions(ctx, jobs)
 		}
 	}
 }
 
+// applyActions applies the actions to all eligible jobs, oldest date first, so
+// that jobs waiting for a concurrency limit are served fairly.
+func (m *Monitor) applyActions(ctx context.Context, jobs tracker.JobMap) {
+	type eligible struct {
+		job    tracker.Job
+		status tracker.Status
+		action Action
+	}
+	ready := make([]eligible, 0, len(jobs))
+	for j, s := range jobs {
+		// If job is in a state that has an associated action...
+		if a, ok := m.pipeline(j).action(s.LastStateInfo().State); ok {
+			ready = append(ready, eligible{j, s, a})
+		}
+	}
+	sort.Slice(ready, func(i, k int) bool {
+		if !ready[i].job.Date.Equal(ready[k].job.Date) {
+			return ready[i].job.Date.Before(ready[k].job.Date)
+		}
+		return ready[i].job.String() < ready[k].job.String()
+	})
+
+	waiting := make(map[string]int)
+	for _, e := range ready {
+		waiting[e.action.Name()] += 0 // Report zero for unblocked actions.
+		if _, limited := m.tryApplyAction(ctx, e.action, e.job, e.status); limited {
+			waiting[e.action.Name()]++
+		}
+	}
+	waitingJobs.Reset()
+	for name, n := range waiting {
+		waitingJobs.WithLabelValues(name).Set(float64(n))
+	}
+}
+
 // NewMonitor creates a Monitor with no Actions
-func NewMonitor(clientCtx context.Context, config cloud.BQConfig, tk *tracker.Tracker) (*Monitor, error) {
-	m := Monitor{bqconfig: config, actions: make(map[tracker.State]Action),
-		tk: tk, jobClaims: make(map[tracker.Job]struct{})}
+func NewMonitor(clientCtx context.Context, bqConfig cloud.BQConfig, tk *tracker.Tracker) (*Monitor, error) {
+	m := Monitor{
+		bqconfig:     bqConfig,
+		actions:      NewPipeline(),
+		pipelines:    make(map[string]*Pipeline),
+		dependencies: make(map[string][]Dependency),
+		tk:           tk,
+
+		retryPolicies: make(map[tracker.State]config.RetryPolicy),
+
+		actionLimits:     make(map[tracker.State]int),
+		datatypeLimits:   make(map[string]int),
+		runningActions:   make(map[tracker.State]int),
+		runningDatatypes: make(map[string]int),
+	}
 	return &m, nil
 }
@@ -5,11 +5,13 @@ import (
 	"context"
 	"errors"
 	"log"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/m-lab/go/logx"
 	"github.com/m-lab/go/rtx"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 
 	"github.com/m-lab/etl-gardener/cloud"
 	"github.com/m-lab/etl-gardener/ops"
@@ -100,3 +102,185 @@ func TestOutcomeUpdate(t *testing.T) {
 		t.Error(status.Detail())
 	}
 }
+
+func TestMonitor_ConcurrencyLimits(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tk, err := tracker.InitTracker(ctx, nil, nil, 0, 0, 0)
+	rtx.Must(err, "tk init")
+	start := time.Date(2021, 3, 4, 0, 0, 0, 0, time.UTC)
+	for i := 4; i >= 0; i-- {
+		must(t, tk.AddJob(tracker.NewJob("bucket", "exp", "type", start.AddDate(0, 0, i))))
+		must(t, tk.AddJob(tracker.NewJob("bucket", "exp", "type2", start.AddDate(0, 0, i))))
+	}
+
+	var lock sync.Mutex
+	running := map[string]int{}
+	maxRunning := map[string]int{}
+	order := []time.Time{}
+	m, err := ops.NewMonitor(ctx, cloud.BQConfig{}, tk)
+	must(t, err)
+	m.AddAction(tracker.Init, nil,
+		func(ctx context.Context, j tracker.Job, stateChangeTime time.Time) *ops.Outcome {
+			lock.Lock()
+			running["all"]++
+			running[j.Datatype]++
+			for k, v := range running {
+				if v > maxRunning[k] {
+					maxRunning[k] = v
+				}
+			}
+			if j.Datatype == "type" {
+				order = append(order, j.Date)
+			}
+			lock.Unlock()
+			time.Sleep(30 * time.Millisecond)
+			lock.Lock()
+			running["all"]--
+			running[j.Datatype]--
+			lock.Unlock()
+			return ops.Success(j, "")
+		},
+		tracker.Complete)
+	m.AddConcurrencyLimits(map[string]int{"init": 2}, map[string]int{"type": 1})
+	go m.Watch(ctx, 10*time.Millisecond)
+
+	failTime := time.Now().Add(5 * time.Second)
+	for time.Now().Before(failTime) && tk.NumJobs() > 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if tk.NumJobs() != 0 {
+		t.Fatal("Jobs not completed:", tk.NumJobs())
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if maxRunning["all"] != 2 || maxRunning["type"] != 1 {
+		t.Error("Wrong concurrency:", maxRunning)
+	}
+	for i := range order {
+		if !order[i].Equal(start.AddDate(0, 0, i)) {
+			t.Error("Jobs not served oldest first:", order)
+			break
+		}
+	}
+}
+
+func TestMonitor_ConditionBeforeLimits(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tk, err := tracker.InitTracker(ctx, nil, nil, 0, 0, 0)
+	rtx.Must(err, "tk init")
+	start := time.Date(2021, 3, 4, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 3; i++ {
+		must(t, tk.AddJob(tracker.NewJob("bucket", "exp", "type", start.AddDate(0, 0, i))))
+	}
+
+	m, err := ops.NewMonitor(ctx, cloud.BQConfig{}, tk)
+	must(t, err)
+	started := make(chan time.Time, 3)
+	done := make(chan struct{})
+	m.AddAction(tracker.Init,
+		func(ctx context.Context, j tracker.Job) bool {
+			// The oldest job is blocked, e.g. by its dependencies.
+			return !j.Date.Equal(start)
+		},
+		func(ctx context.Context, j tracker.Job, stateChangeTime time.Time) *ops.Outcome {
+			started <- j.Date
+			<-done
+			return ops.Success(j, "")
+		},
+		tracker.Complete)
+	m.SetActionLimit(tracker.Init, 1)
+	defer close(done)
+
+	jobs, _, _ := tk.GetState()
+	ops.ApplyActions(m, ctx, jobs)
+	select {
+	case date := <-started:
+		if !date.Equal(start.AddDate(0, 0, 1)) {
+			t.Error("Expected the oldest runnable job, got", date)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("A blocked job held the concurrency limit")
+	}
+	// Only the youngest job waits for the limit.  The blocked job does not.
+	if n := testutil.ToFloat64(ops.WaitingJobs.WithLabelValues("init")); n != 1 {
+		t.Error("Expected 1 waiting job, got", n)
+	}
+}
+
+func TestMonitor_DryRun(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tk, err := tracker.InitTracker(ctx, nil, nil, 0, 0, 0)
+	rtx.Must(err, "tk init")
+	must(t, tk.AddJob(tracker.NewJob("bucket", "exp", "type", time.Now())))
+
+	m, err := ops.NewMonitor(ctx, cloud.BQConfig{}, tk)
+	must(t, err)
+	m.SetDryRun(true)
+	dryRuns := make(chan bool, 2)
+	m.AddAction(tracker.Init,
+		func(ctx context.Context, j tracker.Job) bool {
+			dryRuns <- ops.IsDryRun(ctx)
+			return true
+		},
+		func(ctx context.Context, j tracker.Job, stateChangeTime time.Time) *ops.Outcome {
+			dryRuns <- ops.IsDryRun(ctx)
+			return ops.Success(j, "")
+		},
+		tracker.Complete)
+	go m.Watch(ctx, 10*time.Millisecond)
+
+	for i := 0; i < 2; i++ {
+		select {
+		case dryRun := <-dryRuns:
+			if !dryRun {
+				t.Error("Expected dry run context")
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timeout")
+		}
+	}
+}
+
+func TestMonitor_StaleClaim(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tk, err := tracker.InitTracker(ctx, nil, nil, 0, 0, 0)
+	rtx.Must(err, "tk init")
+	job := tracker.NewJob("bucket", "exp", "type", time.Now())
+	must(t, tk.AddJob(job))
+	must(t, tk.SetStatus(job, tracker.Loading, ""))
+
+	started := make(chan struct{}, 1)
+	proceed := make(chan struct{})
+	m, err := ops.NewMonitor(ctx, cloud.BQConfig{}, tk)
+	must(t, err)
+	m.AddAction(tracker.Loading, nil,
+		func(ctx context.Context, j tracker.Job, stateChangeTime time.Time) *ops.Outcome {
+			select {
+			case started <- struct{}{}:
+			default:
+			}
+			<-proceed
+			return ops.Success(j, "stale")
+		},
+		tracker.Deduplicating)
+	go m.Watch(ctx, 10*time.Millisecond)
+
+	<-started
+	// The job is claimed while the action runs.
+	if _, err := tk.ClaimJob(job, tracker.Loading); err != tracker.ErrJobClaimed {
+		t.Error("Expected ErrJobClaimed, got", err)
+	}
+	// An operator resets the job, so the running action's update is stale.
+	must(t, tk.ResetJob(job, tracker.Stabilizing, "redo"))
+	close(proceed)
+	time.Sleep(50 * time.Millisecond)
+	status, err := tk.GetStatus(job)
+	must(t, err)
+	if status.State() != tracker.Stabilizing {
+		t.Errorf("Stale action clobbered the job: %+v", status)
+	}
+}
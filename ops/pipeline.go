@@ -0,0 +1,162 @@
+package ops
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/m-lab/etl-gardener/config"
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+// ErrNoStandardAction is returned when a pipeline refers to a State that
+// has no standard Action.
+var ErrNoStandardAction = errors.New("no standard action for state")
+
+// Parsers drive jobs through these transitions, so they are implicit in
+// every Pipeline.
+var parserTransitions = map[tracker.State]tracker.State{
+	tracker.Init:    tracker.Parsing,
+	tracker.Parsing: tracker.ParseComplete,
+}
+
+// A Pipeline is the ordered sequence of Actions applied to jobs of a
+// particular experiment and datatype.
+type Pipeline struct {
+	actions map[tracker.State]Action
+}
+
+// NewPipeline creates a Pipeline with no Actions.
+func NewPipeline() *Pipeline {
+	return &Pipeline{actions: make(map[tracker.State]Action)}
+}
+
+// AddAction adds a specific action to the Pipeline.
+func (p *Pipeline) AddAction(state tracker.State, cond ConditionFunc, op ActionFunc,
+	successState tracker.State) {
+	p.actions[state] = Action{
+		fromState: state,
+		nextState: successState,
+		condition: cond,
+		action:    op,
+	}
+}
+
+// action returns the Action for a state, if there is one.
+func (p *Pipeline) action(state tracker.State) (Action, bool) {
+	a, ok := p.actions[state]
+	return a, ok
+}
+
+// States returns the ordered list of states that jobs pass through,
+// starting with Init, and following the parser transitions and Actions.
+func (p *Pipeline) States() tracker.Pipeline {
+	states := tracker.Pipeline{}
+	visited := make(map[tracker.State]bool)
+	for s, ok := tracker.Init, true; ok && !visited[s]; {
+		visited[s] = true
+		states = append(states, s)
+		var next tracker.State
+		if a, found := p.actions[s]; found {
+			next = a.nextState
+		} else {
+			next, ok = parserTransitions[s]
+		}
+		s = next
+	}
+	return states
+}
+
+// postProcessingStates returns the states after ParseComplete and before
+// Complete, in the form accepted by StandardPipeline.
+func (p *Pipeline) postProcessingStates() []tracker.State {
+	var states []tracker.State
+	after := false
+	for _, s := range p.States() {
+		switch {
+		case s == tracker.ParseComplete:
+			after = true
+		case s == tracker.Complete:
+			return states
+		case after:
+			states = append(states, s)
+		}
+	}
+	return states
+}
+
+// StandardPipeline creates a Pipeline that applies the standard Action
+// for each of the listed states in order, starting after ParseComplete
+// and ending in Complete.
+func (m *Monitor) StandardPipeline(states ...tracker.State) (*Pipeline, error) {
+	p := NewPipeline()
+	from := tracker.ParseComplete
+	op := newStateFunc("-")
+	var cond ConditionFunc
+	for _, s := range states {
+		p.AddAction(from, cond, op, s)
+		switch s {
+		case tracker.Loading:
+			cond, op = nil, loadFunc
+		case tracker.Deduplicating:
+			cond, op = m.withinBudget, dedupFunc
+		case tracker.Validating:
+			cond, op = nil, validateFunc
+		case tracker.Copying:
+			cond, op = nil, copyFunc
+		case tracker.Deleting:
+			cond, op = nil, deleteFunc
+		case tracker.Joining:
+			cond, op = allConditions(m.dependenciesMet, m.withinBudget), joinFunc
+		case tracker.Exporting:
+			cond, op = nil, m.exportFunc
+		default:
+			return nil, fmt.Errorf("%w: %s", ErrNoStandardAction, s)
+		}
+		from = s
+	}
+	p.AddAction(from, cond, op, tracker.Complete)
+	return p, nil
+}
+
+// AddPipeline sets the Pipeline for jobs with the given experiment and datatype,
+// and constrains the tracker to the state transitions of the Pipeline.
+// It should be called before Watch.
+func (m *Monitor) AddPipeline(experiment, datatype string, p *Pipeline) {
+	m.pipelines[pipelineKey(experiment, datatype)] = p
+	m.tk.SetPipeline(experiment, datatype, p.States())
+}
+
+// DefaultStates returns the states of the default Pipeline, for jobs
+// without their own Pipeline.
+func (m *Monitor) DefaultStates() tracker.Pipeline {
+	return m.actions.States()
+}
+
+// AddSourcePipelines adds a standard Pipeline for each source that
+// specifies a pipeline in the config.  Sources with an export and no
+// pipeline get the default pipeline, followed by Exporting.
+func (m *Monitor) AddSourcePipelines(sources []config.SourceConfig) error {
+	for _, src := range sources {
+		var states []tracker.State
+		switch {
+		case len(src.Pipeline) > 0:
+			for i := range src.Pipeline {
+				states = append(states, tracker.State(src.Pipeline[i]))
+			}
+		case src.Export != "":
+			states = append(m.actions.postProcessingStates(), tracker.Exporting)
+		default:
+			continue
+		}
+		p, err := m.StandardPipeline(states...)
+		if err != nil {
+			return err
+		}
+		m.AddPipeline(src.Experiment, src.Datatype, p)
+	}
+	return nil
+}
+
+func pipelineKey(experiment, datatype string) string {
+	return experiment + "/" + datatype
+}
@@ -0,0 +1,111 @@
+package ops_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/go-test/deep"
+	"github.com/m-lab/go/rtx"
+
+	"github.com/m-lab/etl-gardener/cloud"
+	"github.com/m-lab/etl-gardener/config"
+	"github.com/m-lab/etl-gardener/ops"
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+func TestStandardPipeline(t *testing.T) {
+	tk, err := tracker.InitTracker(context.Background(), nil, nil, 0, 0, 0)
+	rtx.Must(err, "tk init")
+	m, err := ops.NewMonitor(context.Background(), cloud.BQConfig{}, tk)
+	rtx.Must(err, "NewMonitor failure")
+
+	p, err := m.StandardPipeline(tracker.Loading, tracker.Deduplicating, tracker.Copying)
+	must(t, err)
+	want := tracker.Pipeline{tracker.Init, tracker.Parsing, tracker.ParseComplete,
+		tracker.Loading, tracker.Deduplicating, tracker.Copying, tracker.Complete}
+	if diff := deep.Equal(want, p.States()); diff != nil {
+		t.Error(diff)
+	}
+
+	_, err = m.StandardPipeline(tracker.Loading, tracker.Stabilizing)
+	if !errors.Is(err, ops.ErrNoStandardAction) {
+		t.Error("Expected ErrNoStandardAction:", err)
+	}
+
+	err = m.AddSourcePipelines([]config.SourceConfig{
+		{Experiment: "ndt", Datatype: "annotation", Pipeline: []string{"loading", "foobar"}},
+	})
+	if !errors.Is(err, ops.ErrNoStandardAction) {
+		t.Error("Expected ErrNoStandardAction:", err)
+	}
+}
+
+func TestAddSourcePipelines_Export(t *testing.T) {
+	ctx := context.Background()
+	tk, err := tracker.InitTracker(ctx, nil, nil, 0, 0, 0)
+	rtx.Must(err, "tk init")
+	m, err := ops.NewStandardMonitor(ctx, cloud.BQConfig{}, tk)
+	rtx.Must(err, "NewStandardMonitor failure")
+	must(t, m.AddSourcePipelines([]config.SourceConfig{
+		{Experiment: "ndt", Datatype: "ndt7", Export: "gs://bucket/prefix"},
+	}))
+
+	exported := tracker.NewJob("bucket", "ndt", "ndt7", time.Now())
+	must(t, tk.AddJob(exported))
+	must(t, tk.SetStatus(exported, tracker.Joining, ""))
+	must(t, tk.SetStatus(exported, tracker.Exporting, ""))
+	must(t, tk.SetStatus(exported, tracker.Complete, ""))
+}
+
+func TestMonitor_Pipelines(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tk, err := tracker.InitTracker(ctx, nil, nil, 0, 0, time.Minute)
+	rtx.Must(err, "tk init")
+	full := tracker.NewJob("bucket", "exp", "full", time.Now())
+	short := tracker.NewJob("bucket", "exp", "short", time.Now())
+	must(t, tk.AddJob(full))
+	must(t, tk.AddJob(short))
+
+	m, err := ops.NewMonitor(ctx, cloud.BQConfig{}, tk)
+	rtx.Must(err, "NewMonitor failure")
+	m.AddAction(tracker.Init, nil, newStateFunc(""), tracker.Loading)
+	m.AddAction(tracker.Loading, nil, newStateFunc(""), tracker.Joining)
+	m.AddAction(tracker.Joining, nil, newStateFunc(""), tracker.Complete)
+
+	p := ops.NewPipeline()
+	p.AddAction(tracker.Init, nil, newStateFunc(""), tracker.Loading)
+	p.AddAction(tracker.Loading, nil, newStateFunc(""), tracker.Complete)
+	m.AddPipeline("exp", "short", p)
+
+	go m.Watch(ctx, 10*time.Millisecond)
+
+	failTime := time.Now().Add(5 * time.Second)
+	for time.Now().Before(failTime) {
+		fs, _ := tk.GetStatus(full)
+		ss, _ := tk.GetStatus(short)
+		if fs.State() == tracker.Complete && ss.State() == tracker.Complete {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	fs, err := tk.GetStatus(full)
+	must(t, err)
+	if fs.State() != tracker.Complete || len(fs.History) != 4 {
+		t.Error("full job should pass through Joining:", fs.History)
+	}
+	ss, err := tk.GetStatus(short)
+	must(t, err)
+	if ss.State() != tracker.Complete || len(ss.History) != 3 {
+		t.Error("short job should skip Joining:", ss.History)
+	}
+
+	// The tracker should now reject transitions outside of the pipeline.
+	short.Date = short.Date.AddDate(0, 0, -1)
+	must(t, tk.AddJob(short))
+	if err := tk.SetStatus(short, tracker.Joining, ""); err != tracker.ErrInvalidStateTransition {
+		t.Error("Expected ErrInvalidStateTransition:", err)
+	}
+}
@@ -0,0 +1,114 @@
+package ops
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"google.golang.org/api/googleapi"
+
+	"github.com/m-lab/etl-gardener/config"
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+// DefaultRetryPolicy applies to states without their own RetryPolicy.
+var DefaultRetryPolicy = config.RetryPolicy{
+	MaxAttempts:  10,
+	InitialDelay: 2 * time.Minute,
+	MaxDelay:     time.Hour,
+	Jitter:       0.2,
+}
+
+// ErrorClass describes a kind of BigQuery error, and whether it is retryable.
+type ErrorClass struct {
+	Name      string
+	Retryable bool
+}
+
+// Error classes returned by ClassifyError.
+var (
+	RateLimited     = ErrorClass{"rateLimitExceeded", true}
+	StreamingBuffer = ErrorClass{"streamingBuffer", true}
+	ServerError     = ErrorClass{"serverError", true}
+	SchemaMismatch  = ErrorClass{"schemaMismatch", false}
+	UnknownError    = ErrorClass{"unknown", false}
+)
+
+// schemaMessages are the known messages of "invalid" errors that are caused
+// by a mismatch between the data, the query, or the table schema.
+var schemaMessages = []string{
+	"No such field",
+	"Provided Schema does not match Table",
+	"Invalid schema update",
+}
+
+// isSchemaMismatch returns true if an error reason and message indicate a
+// schema mismatch.
+func isSchemaMismatch(reason, message string) bool {
+	if reason != "invalid" {
+		return false
+	}
+	for _, m := range schemaMessages {
+		if strings.Contains(message, m) {
+			return true
+		}
+	}
+	return false
+}
+
+// classifyReason classifies a BigQuery error reason and message.
+func classifyReason(reason, message string) (ErrorClass, bool) {
+	switch {
+	case strings.Contains(message, "streaming buffer"):
+		return StreamingBuffer, true
+	case reason == "rateLimitExceeded":
+		return RateLimited, true
+	case reason == "backendError" || reason == "internalError":
+		return ServerError, true
+	case isSchemaMismatch(reason, message):
+		return SchemaMismatch, true
+	}
+	return UnknownError, false
+}
+
+// ClassifyError classifies an error returned by the BigQuery API, or a
+// BigQuery job status error.
+func ClassifyError(err error) ErrorClass {
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		if c, ok := classifyReason("", apiErr.Message); ok {
+			return c
+		}
+		for _, item := range apiErr.Errors {
+			if c, ok := classifyReason(item.Reason, item.Message); ok {
+				return c
+			}
+		}
+		switch {
+		case apiErr.Code == http.StatusTooManyRequests:
+			return RateLimited
+		case apiErr.Code >= 500:
+			return ServerError
+		}
+		return UnknownError
+	}
+	var bqErr *bigquery.Error
+	if errors.As(err, &bqErr) {
+		c, _ := classifyReason(bqErr.Reason, bqErr.Message)
+		return c
+	}
+	return UnknownError
+}
+
+// errorOutcome returns a Retry or Failure Outcome, according to the class of
+// the error.  Unclassified errors are retried only if retryUnknown is true.
+func errorOutcome(j tracker.Job, err error, retryUnknown bool) *Outcome {
+	c := ClassifyError(err)
+	detail := c.Name + ": " + err.Error()
+	if c.Retryable || (c == UnknownError && retryUnknown) {
+		return Retry(j, err, detail)
+	}
+	return Failure(j, err, detail)
+}
@@ -0,0 +1,89 @@
+package ops_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/m-lab/go/rtx"
+	"google.golang.org/api/googleapi"
+
+	"github.com/m-lab/etl-gardener/cloud"
+	"github.com/m-lab/etl-gardener/config"
+	"github.com/m-lab/etl-gardener/ops"
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want ops.ErrorClass
+	}{
+		{"rate limit", &googleapi.Error{Code: 403, Errors: []googleapi.ErrorItem{{Reason: "rateLimitExceeded"}}}, ops.RateLimited},
+		{"too many requests", &googleapi.Error{Code: http.StatusTooManyRequests}, ops.RateLimited},
+		{"streaming buffer", &googleapi.Error{Code: 400, Message: "UPDATE or DELETE statement over table would affect rows in the streaming buffer"}, ops.StreamingBuffer},
+		{"server", &googleapi.Error{Code: 503}, ops.ServerError},
+		{"bad request", &googleapi.Error{Code: 400, Message: "bad"}, ops.UnknownError},
+		{"backend", &bigquery.Error{Reason: "backendError"}, ops.ServerError},
+		{"schema", &bigquery.Error{Reason: "invalid", Message: "No such field: foo"}, ops.SchemaMismatch},
+		{"schema in api error", &googleapi.Error{Code: 400, Errors: []googleapi.ErrorItem{{Reason: "invalid",
+			Message: "Provided Schema does not match Table p:d.t. Field x has changed type from STRING to INTEGER"}}}, ops.SchemaMismatch},
+		{"schema update", &bigquery.Error{Reason: "invalid", Message: "Invalid schema update. Field x has changed mode"}, ops.SchemaMismatch},
+		{"mentions schema", &bigquery.Error{Reason: "notFound", Message: "Not found: Table p:schema_x.t"}, ops.UnknownError},
+		{"invalid mentions schema", &bigquery.Error{Reason: "invalid", Message: "Schema cache is stale"}, ops.UnknownError},
+		{"other", errors.New("other"), ops.UnknownError},
+	}
+	for _, tt := range tests {
+		if got := ops.ClassifyError(tt.err); got != tt.want {
+			t.Errorf("%s: ClassifyError() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestUpdateJob_RetriesExhausted(t *testing.T) {
+	tk, err := tracker.InitTracker(context.Background(), nil, nil, 0, 0, 0)
+	rtx.Must(err, "tk init")
+	job := tracker.NewJob("bucket", "exp", "type", time.Now())
+	must(t, tk.AddJob(job))
+	must(t, tk.SetStatus(job, tracker.Loading, ""))
+
+	m, err := ops.NewMonitor(context.Background(), cloud.BQConfig{}, tk)
+	must(t, err)
+	m.AddRetryPolicies([]config.RetryConfig{{State: "loading", MaxAttempts: 2}})
+
+	retry := ops.Retry(job, errors.New("error"), "rateLimitExceeded")
+	if result, err := m.UpdateJob(retry, tracker.Deduplicating); err != nil || result != "retry" {
+		t.Fatal("Expected retry:", result, err)
+	}
+	status, err := tk.GetStatus(job)
+	must(t, err)
+	if status.Attempts != 1 || status.State() != tracker.Loading {
+		t.Fatalf("Bad status: %+v", status)
+	}
+	if result, err := m.UpdateJob(retry, tracker.Deduplicating); err != nil || result != "fail" {
+		t.Fatal("Expected fail:", result, err)
+	}
+	status, err = tk.GetStatus(job)
+	must(t, err)
+	if status.State() != tracker.Failed || !strings.Contains(status.Detail(), "gave up after 2 attempts") {
+		t.Errorf("Bad status: %+v", status)
+	}
+}
+
+func TestMissingField(t *testing.T) {
+	if ops.MissingField(nil) || ops.MissingField(&bigquery.JobStatus{}) {
+		t.Error("Expected false for no errors")
+	}
+	status := &bigquery.JobStatus{Errors: []*bigquery.Error{
+		{Reason: "invalid", Message: "Error while reading data"},
+		{Reason: "invalid", Message: "No such field: foo.bar"},
+	}}
+	if !ops.MissingField(status) {
+		t.Error("Expected missing field")
+	}
+}
@@ -0,0 +1,279 @@
+package persistence
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"syscall"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// ErrLeaseHeld is returned when the lease is held by another instance.
+var ErrLeaseHeld = errors.New("lease is held by another instance")
+
+// Lease is the leadership lease shared by the instances of a service.
+type Lease struct {
+	Base
+	Holder  string    // Empty if the lease has been released.
+	Expires time.Time // The lease is free after this time.
+}
+
+// GetKind implements StateObject.GetKind
+func (l Lease) GetKind() string {
+	return "Lease"
+}
+
+// claim acquires or renews the lease for holder, if it is free, expired, or
+// already held by holder.
+func (l *Lease) claim(holder string, ttl time.Duration, now time.Time) error {
+	if l.Holder != "" && l.Holder != holder && now.Before(l.Expires) {
+		return ErrLeaseHeld
+	}
+	l.Holder = holder
+	l.Expires = now.Add(ttl)
+	return nil
+}
+
+// release frees the lease, if it is held by holder.
+func (l *Lease) release(holder string) bool {
+	if l.Holder != holder {
+		return false
+	}
+	l.Holder = ""
+	l.Expires = time.Time{}
+	return true
+}
+
+// Elector provides atomic operations on a Lease.
+type Elector interface {
+	// Acquire acquires the lease for holder, or renews it if holder already
+	// holds it, until ttl from now, and returns the expiry time that was
+	// saved.  It returns ErrLeaseHeld if another holder's lease has not
+	// expired.
+	Acquire(ctx context.Context, holder string, ttl time.Duration) (time.Time, error)
+	// Release releases the lease, if it is held by holder.
+	Release(ctx context.Context, holder string) error
+	// Current returns the current state of the lease.
+	Current(ctx context.Context) (Lease, error)
+}
+
+// DatastoreElector implements an Elector with a Lease entity in Datastore,
+// updated in transactions.
+type DatastoreElector struct {
+	Client    *datastore.Client
+	Namespace string
+	Name      string // The name of the lease.
+}
+
+// NewDatastoreElector creates a DatastoreElector for the named lease.
+func NewDatastoreElector(ctx context.Context, project, name string) (*DatastoreElector, error) {
+	client, err := datastore.NewClient(ctx, project)
+	if err != nil {
+		return nil, err
+	}
+	return &DatastoreElector{Client: client, Namespace: "gardener", Name: name}, nil
+}
+
+func (de *DatastoreElector) key() *datastore.Key {
+	k := datastore.NameKey(Lease{}.GetKind(), de.Name, nil)
+	k.Namespace = de.Namespace
+	return k
+}
+
+// update applies f to the lease within a transaction, saving it if f
+// returns true.
+func (de *DatastoreElector) update(ctx context.Context, f func(l *Lease) (bool, error)) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	_, err := de.Client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		l := Lease{Base: NewBase(de.Name)}
+		if err := tx.Get(de.key(), &l); err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		save, err := f(&l)
+		if err != nil || !save {
+			return err
+		}
+		_, err = tx.Put(de.key(), &l)
+		return err
+	})
+	return err
+}
+
+// Acquire implements Elector.Acquire using Datastore.
+func (de *DatastoreElector) Acquire(ctx context.Context, holder string, ttl time.Duration) (time.Time, error) {
+	var expires time.Time
+	err := de.update(ctx, func(l *Lease) (bool, error) {
+		err := l.claim(holder, ttl, time.Now())
+		expires = l.Expires
+		return true, err
+	})
+	return expires, err
+}
+
+// Release implements Elector.Release using Datastore.
+func (de *DatastoreElector) Release(ctx context.Context, holder string) error {
+	return de.update(ctx, func(l *Lease) (bool, error) {
+		return l.release(holder), nil
+	})
+}
+
+// Current implements Elector.Current using Datastore.
+func (de *DatastoreElector) Current(ctx context.Context) (Lease, error) {
+	l := Lease{Base: NewBase(de.Name)}
+	err := de.Client.Get(ctx, de.key(), &l)
+	if err == datastore.ErrNoSuchEntity {
+		err = nil
+	}
+	return l, err
+}
+
+// FileElector implements an Elector with a json encoded Lease in a local
+// file.  Updates are serialized with an exclusive lock on the file, so
+// instances sharing the file must be on the same host.  Intended for tests
+// and local deployments.
+type FileElector struct {
+	Path string
+}
+
+// NewFileElector creates a FileElector that keeps the lease in path.
+func NewFileElector(path string) *FileElector {
+	return &FileElector{Path: path}
+}
+
+// update applies f to the lease while holding the file lock, saving it if
+// f returns true.
+func (fe *FileElector) update(f func(l *Lease) (bool, error)) error {
+	file, err := os.OpenFile(fe.Path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX); err != nil {
+		return err
+	}
+	defer syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+
+	l := Lease{}
+	b, err := ioutil.ReadAll(file)
+	if err != nil {
+		return err
+	}
+	if len(b) > 0 {
+		if err := json.Unmarshal(b, &l); err != nil {
+			return err
+		}
+	}
+	save, err := f(&l)
+	if err != nil || !save {
+		return err
+	}
+	if b, err = json.Marshal(l); err != nil {
+		return err
+	}
+	if err := file.Truncate(0); err != nil {
+		return err
+	}
+	_, err = file.WriteAt(b, 0)
+	return err
+}
+
+// Acquire implements Elector.Acquire using a local file.
+func (fe *FileElector) Acquire(ctx context.Context, holder string, ttl time.Duration) (time.Time, error) {
+	var expires time.Time
+	err := fe.update(func(l *Lease) (bool, error) {
+		err := l.claim(holder, ttl, time.Now())
+		expires = l.Expires
+		return true, err
+	})
+	return expires, err
+}
+
+// Release implements Elector.Release using a local file.
+func (fe *FileElector) Release(ctx context.Context, holder string) error {
+	return fe.update(func(l *Lease) (bool, error) {
+		return l.release(holder), nil
+	})
+}
+
+// Current implements Elector.Current using a local file.
+func (fe *FileElector) Current(ctx context.Context) (Lease, error) {
+	l := Lease{}
+	err := fe.update(func(lease *Lease) (bool, error) {
+		l = *lease
+		return false, nil
+	})
+	return l, err
+}
+
+// Campaign blocks until holder acquires the lease, or ctx is done.  Once
+// acquired, the lease is renewed every ttl/3, and the returned context is
+// canceled when the lease is lost, either because another instance took it,
+// or because it could not be renewed.  Leadership ends ttl/3 before the
+// saved expiry time, so that the leader stops before another instance can
+// acquire the lease.  The lease is released when ctx is done.
+func Campaign(ctx context.Context, e Elector, holder string, ttl time.Duration) (context.Context, error) {
+	interval := ttl / 3
+	var expires time.Time
+	for {
+		var err error
+		expires, err = e.Acquire(ctx, holder, ttl)
+		if err == nil {
+			break
+		}
+		if err != ErrLeaseHeld {
+			log.Println("Lease error:", err)
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(interval):
+		}
+	}
+	log.Println(holder, "acquired the lease")
+
+	leaderCtx, cancel := context.WithCancel(ctx)
+	go func() {
+		defer cancel()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			stepDown := expires.Add(-interval)
+			timer := time.NewTimer(time.Until(stepDown))
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				defer cancel()
+				if err := e.Release(ctx, holder); err != nil {
+					log.Println("Lease release error:", err)
+				}
+				return
+			case <-timer.C:
+				log.Println(holder, "lease expiring")
+				return
+			case <-ticker.C:
+				timer.Stop()
+			}
+			// The renewal must not outlast the lease.
+			renewCtx, renewCancel := context.WithDeadline(ctx, stepDown)
+			renewed, err := e.Acquire(renewCtx, holder, ttl)
+			renewCancel()
+			switch {
+			case err == nil:
+				expires = renewed
+			case err == ErrLeaseHeld:
+				log.Println(holder, "lost the lease")
+				return
+			default:
+				log.Println("Lease renewal error:", err)
+			}
+		}
+	}()
+	return leaderCtx, nil
+}
@@ -0,0 +1,192 @@
+package persistence_test
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/m-lab/etl-gardener/persistence"
+)
+
+func newFileElector(t *testing.T) (*persistence.FileElector, func()) {
+	dir, err := ioutil.TempDir("", "TestFileElector")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return persistence.NewFileElector(filepath.Join(dir, "leader.lock")),
+		func() { os.RemoveAll(dir) }
+}
+
+func TestFileElector(t *testing.T) {
+	ctx := context.Background()
+	e, cleanup := newFileElector(t)
+	defer cleanup()
+
+	if _, err := e.Acquire(ctx, "a", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.Acquire(ctx, "b", time.Hour); err != persistence.ErrLeaseHeld {
+		t.Error("Expected ErrLeaseHeld:", err)
+	}
+	// Renewal by the holder succeeds.
+	if _, err := e.Acquire(ctx, "a", time.Hour); err != nil {
+		t.Error(err)
+	}
+	l, err := e.Current(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.Holder != "a" || time.Until(l.Expires) < 59*time.Minute {
+		t.Error("Wrong lease", l)
+	}
+
+	// Release by another holder is ignored.
+	if err := e.Release(ctx, "b"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.Acquire(ctx, "b", time.Hour); err != persistence.ErrLeaseHeld {
+		t.Error("Expected ErrLeaseHeld:", err)
+	}
+	if err := e.Release(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.Acquire(ctx, "b", time.Hour); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestFileElector_Expiry(t *testing.T) {
+	ctx := context.Background()
+	e, cleanup := newFileElector(t)
+	defer cleanup()
+
+	if _, err := e.Acquire(ctx, "a", time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(2 * time.Millisecond)
+	if _, err := e.Acquire(ctx, "b", time.Hour); err != nil {
+		t.Error("Expired lease should be acquired:", err)
+	}
+}
+
+func TestCampaign(t *testing.T) {
+	e, cleanup := newFileElector(t)
+	defer cleanup()
+
+	ctxA, cancelA := context.WithCancel(context.Background())
+	leaderA, err := persistence.Campaign(ctxA, e, "a", 60*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// b stands by until a releases the lease.
+	ctxB, cancelB := context.WithCancel(context.Background())
+	defer cancelB()
+	elected := make(chan context.Context)
+	go func() {
+		leaderB, err := persistence.Campaign(ctxB, e, "b", 60*time.Millisecond)
+		if err != nil {
+			t.Error(err)
+		}
+		elected <- leaderB
+	}()
+	select {
+	case <-elected:
+		t.Fatal("b should not be elected while a holds the lease")
+	case <-time.After(150 * time.Millisecond):
+	}
+
+	cancelA()
+	<-leaderA.Done()
+	var leaderB context.Context
+	select {
+	case leaderB = <-elected:
+	case <-time.After(time.Second):
+		t.Fatal("b should be elected after a releases the lease")
+	}
+
+	// a's lease is gone, so b keeps the lease until it is taken over.
+	if _, err := e.Acquire(context.Background(), "c", time.Hour); err != persistence.ErrLeaseHeld {
+		t.Error("Expected ErrLeaseHeld:", err)
+	}
+	if leaderB.Err() != nil {
+		t.Error("b should still be leader")
+	}
+}
+
+func TestCampaign_Canceled(t *testing.T) {
+	e, cleanup := newFileElector(t)
+	defer cleanup()
+	if _, err := e.Acquire(context.Background(), "a", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := persistence.Campaign(ctx, e, "b", time.Hour); err != context.DeadlineExceeded {
+		t.Error("Expected DeadlineExceeded:", err)
+	}
+}
+
+func TestCampaign_Lost(t *testing.T) {
+	e, cleanup := newFileElector(t)
+	defer cleanup()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	leader, err := persistence.Campaign(ctx, e, "a", 30*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Another instance takes over the lease.
+	if err := e.Release(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.Acquire(ctx, "b", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-leader.Done():
+	case <-time.After(time.Second):
+		t.Fatal("a should lose leadership")
+	}
+}
+
+// failingElector grants the lease once, and then fails to renew it.
+type failingElector struct {
+	persistence.Elector
+	expires time.Time
+}
+
+func (fe *failingElector) Acquire(ctx context.Context, holder string, ttl time.Duration) (time.Time, error) {
+	if fe.expires.IsZero() {
+		fe.expires = time.Now().Add(ttl)
+		return fe.expires, nil
+	}
+	return time.Time{}, errors.New("unavailable")
+}
+
+func (fe *failingElector) Release(ctx context.Context, holder string) error {
+	return nil
+}
+
+func TestCampaign_Expiry(t *testing.T) {
+	e := &failingElector{}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	leader, err := persistence.Campaign(ctx, e, "a", 300*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-leader.Done():
+	case <-time.After(time.Second):
+		t.Fatal("a should lose leadership")
+	}
+	// Leadership must end before another instance could acquire the lease.
+	if !time.Now().Before(e.expires) {
+		t.Error("Leadership ended after the lease expired")
+	}
+}
@@ -0,0 +1,112 @@
+package persistence
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// MemorySaver implements a Saver that keeps json encoded state objects in memory.
+type MemorySaver struct {
+	lock sync.Mutex
+	objs map[string][]byte
+}
+
+// NewMemorySaver creates an empty MemorySaver.
+func NewMemorySaver() *MemorySaver {
+	return &MemorySaver{objs: make(map[string][]byte)}
+}
+
+func memoryKey(o StateObject) string {
+	return o.GetKind() + "/" + o.GetName()
+}
+
+// Save implements Saver.Save in memory.
+func (ms *MemorySaver) Save(ctx context.Context, o StateObject) error {
+	b, err := json.Marshal(o)
+	if err != nil {
+		return err
+	}
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	ms.objs[memoryKey(o)] = b
+	return nil
+}
+
+// Delete implements Saver.Delete in memory.
+func (ms *MemorySaver) Delete(ctx context.Context, o StateObject) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	delete(ms.objs, memoryKey(o))
+	return nil
+}
+
+// Fetch implements Saver.Fetch from memory.
+func (ms *MemorySaver) Fetch(ctx context.Context, o StateObject) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	b, ok := ms.objs[memoryKey(o)]
+	if !ok {
+		return os.ErrNotExist
+	}
+	return json.Unmarshal(b, o)
+}
+
+// FileSaver implements a Saver that stores json encoded state objects in
+// files in a local directory, one file per object.
+type FileSaver struct {
+	Dir string
+}
+
+// NewFileSaver creates a FileSaver, creating the directory if needed.
+func NewFileSaver(dir string) (*FileSaver, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &FileSaver{Dir: dir}, nil
+}
+
+func (fs *FileSaver) path(o StateObject) string {
+	return filepath.Join(fs.Dir, o.GetKind()+"."+o.GetName()+".json")
+}
+
+// Save implements Saver.Save using local files.  Each save writes its own
+// temporary file, and renames it, so concurrent saves of an object do not
+// interleave.
+func (fs *FileSaver) Save(ctx context.Context, o StateObject) error {
+	b, err := json.Marshal(o)
+	if err != nil {
+		return err
+	}
+	path := fs.path(o)
+	tmp, err := ioutil.TempFile(fs.Dir, filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // Fails harmlessly after successful Rename.
+	if _, err = tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Delete implements Saver.Delete using local files.
+func (fs *FileSaver) Delete(ctx context.Context, o StateObject) error {
+	return os.Remove(fs.path(o))
+}
+
+// Fetch implements Saver.Fetch using local files.
+func (fs *FileSaver) Fetch(ctx context.Context, o StateObject) error {
+	b, err := ioutil.ReadFile(fs.path(o))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, o)
+}
@@ -0,0 +1,92 @@
+package persistence_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/m-lab/etl-gardener/persistence"
+)
+
+type localObj struct {
+	persistence.Base
+
+	Integer int32
+}
+
+func (o localObj) GetKind() string {
+	return "localObj"
+}
+
+func testLocalSaver(t *testing.T, saver persistence.Saver) {
+	ctx := context.Background()
+	o := localObj{Base: persistence.NewBase("foobar"), Integer: 1234}
+	if err := saver.Save(ctx, &o); err != nil {
+		t.Fatal(err)
+	}
+
+	got := localObj{Base: persistence.NewBase("foobar")}
+	if err := saver.Fetch(ctx, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Integer != 1234 {
+		t.Error("Fetch failed", got)
+	}
+
+	if err := saver.Delete(ctx, &o); err != nil {
+		t.Fatal(err)
+	}
+	if err := saver.Fetch(ctx, &got); !os.IsNotExist(err) {
+		t.Error("Expected IsNotExist:", err)
+	}
+}
+
+func TestMemorySaver(t *testing.T) {
+	testLocalSaver(t, persistence.NewMemorySaver())
+}
+
+func TestFileSaver(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestFileSaver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	saver, err := persistence.NewFileSaver(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testLocalSaver(t, saver)
+
+	// Concurrent saves of the same object should all succeed, and leave
+	// one complete object.
+	ctx := context.Background()
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs <- saver.Save(ctx, &localObj{Base: persistence.NewBase("foobar"), Integer: int32(i)})
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	got := localObj{Base: persistence.NewBase("foobar")}
+	if err := saver.Fetch(ctx, &got); err != nil {
+		t.Error(err)
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Error("Expected only the saved object:", len(files))
+	}
+}
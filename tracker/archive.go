@@ -0,0 +1,200 @@
+package tracker
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+// ErrNoArchive is returned when history is requested from a Tracker without an Archive.
+var ErrNoArchive = errors.New("no history archive")
+
+// ArchivedJob is the final Status of a finished job, as stored in an Archive.
+type ArchivedJob struct {
+	Job    Job
+	Status Status
+}
+
+// An Archive durably records the history of finished jobs, so that it is
+// available after the jobs are removed from the Tracker.
+type Archive interface {
+	Append(ctx context.Context, job Job, status Status) error
+	// Query returns all archived jobs that match the filter, oldest first.
+	Query(ctx context.Context, f JobFilter) ([]ArchivedJob, error)
+}
+
+// JobFilter selects jobs by experiment, datatype, date range and state.
+// Zero valued fields match all jobs.
+type JobFilter struct {
+	Experiment string
+	Datatype   string
+	State      State
+	Start      time.Time // Inclusive
+	End        time.Time // Inclusive
+}
+
+const filterDateFormat = "2006-01-02"
+
+// ParseJobFilter parses a JobFilter from url parameters experiment,
+// datatype, state, start and end.  Dates use YYYY-MM-DD format.
+func ParseJobFilter(v url.Values) (JobFilter, error) {
+	f := JobFilter{
+		Experiment: v.Get("experiment"),
+		Datatype:   v.Get("datatype"),
+		State:      State(v.Get("state")),
+	}
+	var err error
+	if s := v.Get("start"); s != "" {
+		if f.Start, err = time.Parse(filterDateFormat, s); err != nil {
+			return f, fmt.Errorf("bad start date: %w", err)
+		}
+	}
+	if s := v.Get("end"); s != "" {
+		if f.End, err = time.Parse(filterDateFormat, s); err != nil {
+			return f, fmt.Errorf("bad end date: %w", err)
+		}
+	}
+	return f, nil
+}
+
+// Values returns the url parameters that ParseJobFilter parses to f.
+func (f JobFilter) Values() url.Values {
+	v := make(url.Values, 5)
+	if f.Experiment != "" {
+		v.Set("experiment", f.Experiment)
+	}
+	if f.Datatype != "" {
+		v.Set("datatype", f.Datatype)
+	}
+	if f.State != "" {
+		v.Set("state", string(f.State))
+	}
+	if !f.Start.IsZero() {
+		v.Set("start", f.Start.Format(filterDateFormat))
+	}
+	if !f.End.IsZero() {
+		v.Set("end", f.End.Format(filterDateFormat))
+	}
+	return v
+}
+
+// Matches returns true if the job and status satisfy the filter.
+func (f JobFilter) Matches(job Job, status Status) bool {
+	switch {
+	case f.Experiment != "" && f.Experiment != job.Experiment:
+		return false
+	case f.Datatype != "" && f.Datatype != job.Datatype:
+		return false
+	case f.State != "" && f.State != status.State():
+		return false
+	case !f.Start.IsZero() && job.Date.Before(f.Start):
+		return false
+	case !f.End.IsZero() && job.Date.After(f.End):
+		return false
+	}
+	return true
+}
+
+/////////////////////////////////////////////////////////////
+//                   MemoryArchive                         //
+/////////////////////////////////////////////////////////////
+
+// MemoryArchive keeps the archived jobs in memory.  It is useful for testing.
+type MemoryArchive struct {
+	lock sync.Mutex
+	jobs []ArchivedJob
+}
+
+// NewMemoryArchive creates an empty MemoryArchive.
+func NewMemoryArchive() *MemoryArchive {
+	return &MemoryArchive{}
+}
+
+// Append implements Archive.Append
+func (ma *MemoryArchive) Append(ctx context.Context, job Job, status Status) error {
+	ma.lock.Lock()
+	defer ma.lock.Unlock()
+	ma.jobs = append(ma.jobs, ArchivedJob{job, status})
+	return nil
+}
+
+// Query implements Archive.Query
+func (ma *MemoryArchive) Query(ctx context.Context, f JobFilter) ([]ArchivedJob, error) {
+	ma.lock.Lock()
+	defer ma.lock.Unlock()
+	result := make([]ArchivedJob, 0, 10)
+	for _, aj := range ma.jobs {
+		if f.Matches(aj.Job, aj.Status) {
+			result = append(result, aj)
+		}
+	}
+	return result, nil
+}
+
+/////////////////////////////////////////////////////////////
+//                   FileArchive                           //
+/////////////////////////////////////////////////////////////
+
+// FileArchive appends archived jobs to a local file, one json object per line.
+type FileArchive struct {
+	lock sync.Mutex
+	path string
+}
+
+// NewFileArchive creates an Archive that uses the file at path.
+func NewFileArchive(path string) *FileArchive {
+	return &FileArchive{path: path}
+}
+
+// Append implements Archive.Append
+func (fa *FileArchive) Append(ctx context.Context, job Job, status Status) error {
+	b, err := json.Marshal(ArchivedJob{job, status})
+	if err != nil {
+		return err
+	}
+	fa.lock.Lock()
+	defer fa.lock.Unlock()
+	f, err := os.OpenFile(fa.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(append(b, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Query implements Archive.Query.  It scans the entire file.
+func (fa *FileArchive) Query(ctx context.Context, f JobFilter) ([]ArchivedJob, error) {
+	fa.lock.Lock()
+	defer fa.lock.Unlock()
+	result := make([]ArchivedJob, 0, 10)
+	file, err := os.Open(fa.path)
+	if os.IsNotExist(err) {
+		return result, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		aj := ArchivedJob{}
+		if err := json.Unmarshal(scanner.Bytes(), &aj); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrCorruptSnapshot, err)
+		}
+		if f.Matches(aj.Job, aj.Status) {
+			result = append(result, aj)
+		}
+	}
+	return result, scanner.Err()
+}
@@ -0,0 +1,104 @@
+package tracker_test
+
+import (
+	"context"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+func TestParseJobFilter(t *testing.T) {
+	f, err := tracker.ParseJobFilter(url.Values{
+		"experiment": {"ndt"}, "datatype": {"ndt7"}, "state": {"complete"},
+		"start": {"2021-03-01"}, "end": {"2021-03-04"}})
+	must(t, err)
+	want := tracker.JobFilter{Experiment: "ndt", Datatype: "ndt7", State: tracker.Complete,
+		Start: time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC), End: time.Date(2021, 3, 4, 0, 0, 0, 0, time.UTC)}
+	if f != want {
+		t.Errorf("Wrong filter: %+v", f)
+	}
+	if got, err := tracker.ParseJobFilter(want.Values()); err != nil || got != want {
+		t.Errorf("Values round trip failed: %+v %v", got, err)
+	}
+	if _, err := tracker.ParseJobFilter(url.Values{"end": {"20210304"}}); err == nil {
+		t.Error("Expected error for bad date")
+	}
+}
+
+func testArchive(t *testing.T, a tracker.Archive) {
+	ctx := context.Background()
+	tk, err := tracker.NewTracker(ctx, nil, 0, 0, 0)
+	must(t, err)
+	tk.SetArchive(a)
+
+	date := time.Date(2021, 3, 4, 0, 0, 0, 0, time.UTC)
+	done := tracker.NewJob("bucket", "ndt", "ndt7", date)
+	failed := tracker.NewJob("bucket", "ndt", "annotation", date.AddDate(0, 0, 1))
+	running := tracker.NewJob("bucket", "ndt", "ndt7", date.AddDate(0, 0, 2))
+	for _, j := range []tracker.Job{done, failed, running} {
+		must(t, tk.AddJob(j))
+	}
+	must(t, tk.SetStatus(done, tracker.Deduplicating, "dedup"))
+	must(t, tk.SetStatus(done, tracker.Complete, ""))
+	must(t, tk.SetJobError(failed, "oops"))
+	must(t, tk.SetStatus(running, tracker.Parsing, ""))
+
+	all, err := tk.History(ctx, tracker.JobFilter{})
+	must(t, err)
+	if len(all) != 2 {
+		t.Fatal("Expected 2 archived jobs:", all)
+	}
+	if all[0].Job != done || all[0].Status.History[1].State != tracker.Deduplicating {
+		t.Error("Wrong history:", all[0])
+	}
+
+	tests := []struct {
+		name   string
+		filter tracker.JobFilter
+		want   int
+	}{
+		{"datatype", tracker.JobFilter{Datatype: "annotation"}, 1},
+		{"state", tracker.JobFilter{State: tracker.Failed}, 1},
+		{"start", tracker.JobFilter{Start: date.AddDate(0, 0, 1)}, 1},
+		{"end", tracker.JobFilter{End: date}, 1},
+		{"none", tracker.JobFilter{Experiment: "foo"}, 0},
+	}
+	for _, tt := range tests {
+		got, err := tk.History(ctx, tt.filter)
+		must(t, err)
+		if len(got) != tt.want {
+			t.Errorf("%s: got %d jobs, want %d", tt.name, len(got), tt.want)
+		}
+	}
+}
+
+func TestMemoryArchive(t *testing.T) {
+	testArchive(t, tracker.NewMemoryArchive())
+}
+
+func TestFileArchive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestFileArchive")
+	must(t, err)
+	defer os.RemoveAll(dir)
+
+	a := tracker.NewFileArchive(filepath.Join(dir, "history.jsonl"))
+	jobs, err := a.Query(context.Background(), tracker.JobFilter{})
+	must(t, err)
+	if len(jobs) != 0 {
+		t.Error("Expected empty archive:", jobs)
+	}
+	testArchive(t, a)
+}
+
+func TestHistory_NoArchive(t *testing.T) {
+	tk, err := tracker.NewTracker(context.Background(), nil, 0, 0, 0)
+	must(t, err)
+	if _, err := tk.History(context.Background(), tracker.JobFilter{}); err != tracker.ErrNoArchive {
+		t.Error("Expected ErrNoArchive:", err)
+	}
+}
@@ -0,0 +1,84 @@
+package tracker
+
+import (
+	"time"
+)
+
+// A Claim grants an agent, such as the ops.Monitor, exclusive ownership of a
+// job while it acts on the job's current state.  The Token fences updates:
+// once the claim is released, revoked by an operator, or the job is removed
+// and added again, updates made with the old Token are rejected with
+// ErrStaleClaim.
+type Claim struct {
+	Job   Job
+	Token int64 // Zero for updates made without a claim.
+}
+
+// nextClaimToken returns a new claim token.  Tokens are seeded from the
+// clock, so that they keep increasing across restarts.  Caller must hold
+// the lock.
+func (tr *Tracker) nextClaimToken() int64 {
+	now := time.Now().UnixNano()
+	if tr.claimToken < now {
+		tr.claimToken = now
+	} else {
+		tr.claimToken++
+	}
+	return tr.claimToken
+}
+
+// ClaimJob claims a job in the given state.  Returns ErrJobClaimed if the
+// job is already claimed, ErrStaleClaim if it is no longer in the state, or
+// ErrJobIsObsolete if it was cancelled or skipped.
+func (tr *Tracker) ClaimJob(job Job, state State) (Claim, error) {
+	tr.lock.Lock()
+	defer tr.lock.Unlock()
+	status, ok := tr.jobs[job]
+	if !ok {
+		return Claim{}, ErrJobNotFound
+	}
+	if err := checkUpdate(&status); err != nil {
+		return Claim{}, err
+	}
+	if status.Claim != 0 {
+		return Claim{}, ErrJobClaimed
+	}
+	if status.State() != state {
+		return Claim{}, ErrStaleClaim
+	}
+	status.Claim = tr.nextClaimToken()
+	tr.jobs[job] = status
+	return Claim{Job: job, Token: status.Claim}, nil
+}
+
+// ReleaseClaim releases a claim.  Returns ErrStaleClaim if the claim is no
+// longer current, in which case there is nothing to release.
+func (tr *Tracker) ReleaseClaim(c Claim) error {
+	tr.lock.Lock()
+	defer tr.lock.Unlock()
+	status, ok := tr.jobs[c.Job]
+	if !ok {
+		return ErrJobNotFound
+	}
+	if status.Claim != c.Token {
+		return ErrStaleClaim
+	}
+	status.Claim = 0
+	tr.jobs[c.Job] = status
+	return nil
+}
+
+// checkClaim returns a check that rejects updates to a job that is not
+// claimed with token.  A zero token matches any claim, for updates that are
+// not made under a claim.
+func checkClaim(token int64) func(old *Status) error {
+	return func(old *Status) error {
+		if err := checkUpdate(old); err != nil {
+			return err
+		}
+		if token != 0 && old.Claim != token {
+			return ErrStaleClaim
+		}
+		return nil
+	}
+}
@@ -0,0 +1,98 @@
+package tracker_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+func TestClaims(t *testing.T) {
+	tk, err := tracker.NewTracker(context.Background(), nil, 0, 0, 0)
+	must(t, err)
+	job := tracker.NewJob("bucket", "exp", "type", time.Date(2021, 3, 4, 0, 0, 0, 0, time.UTC))
+	if _, err := tk.ClaimJob(job, tracker.Loading); err != tracker.ErrJobNotFound {
+		t.Error("Expected ErrJobNotFound, got", err)
+	}
+	must(t, tk.AddJob(job))
+	must(t, tk.SetStatus(job, tracker.Loading, ""))
+	if _, err := tk.ClaimJob(job, tracker.Deduplicating); err != tracker.ErrStaleClaim {
+		t.Error("Expected ErrStaleClaim, got", err)
+	}
+
+	c1, err := tk.ClaimJob(job, tracker.Loading)
+	must(t, err)
+	if _, err := tk.ClaimJob(job, tracker.Loading); err != tracker.ErrJobClaimed {
+		t.Error("Expected ErrJobClaimed, got", err)
+	}
+	// Updates without a claim keep the claim.
+	must(t, tk.SetDetail(job, "unclaimed"))
+	must(t, tk.SetClaimedStatus(c1, tracker.Deduplicating, "loaded"))
+	status, err := tk.GetStatus(job)
+	must(t, err)
+	if status.Claim != c1.Token || status.State() != tracker.Deduplicating {
+		t.Fatalf("Bad status: %+v", status)
+	}
+	must(t, tk.ReleaseClaim(c1))
+	if err := tk.ReleaseClaim(c1); err != tracker.ErrStaleClaim {
+		t.Error("Expected ErrStaleClaim, got", err)
+	}
+
+	// Tokens increase.
+	c2, err := tk.ClaimJob(job, tracker.Deduplicating)
+	must(t, err)
+	if c2.Token <= c1.Token {
+		t.Error("Token did not increase", c1, c2)
+	}
+	if err := tk.SetClaimedDetail(c1, "stale"); err != tracker.ErrStaleClaim {
+		t.Error("Expected ErrStaleClaim, got", err)
+	}
+
+	// Operator actions revoke the claim.
+	must(t, tk.ResetJob(job, tracker.Loading, "retry"))
+	if err := tk.SetClaimedStatus(c2, tracker.Copying, ""); err != tracker.ErrStaleClaim {
+		t.Error("Expected ErrStaleClaim, got", err)
+	}
+	if _, err := tk.RecordClaimedAttempt(c2, "stale"); err != tracker.ErrStaleClaim {
+		t.Error("Expected ErrStaleClaim, got", err)
+	}
+
+	// A job that is removed and added again is not clobbered by the old claim.
+	c3, err := tk.ClaimJob(job, tracker.Loading)
+	must(t, err)
+	must(t, tk.SetStatus(job, tracker.Complete, ""))
+	must(t, tk.AddJob(job))
+	if err := tk.SetClaimedJobError(c3, "stale"); err != tracker.ErrStaleClaim {
+		t.Error("Expected ErrStaleClaim, got", err)
+	}
+	status, err = tk.GetStatus(job)
+	must(t, err)
+	if status.State() != tracker.Init {
+		t.Errorf("Bad status: %+v", status)
+	}
+}
+
+func TestClaims_Restart(t *testing.T) {
+	saver := tracker.NewMemorySaver()
+	tk, err := tracker.NewTracker(context.Background(), saver, 0, 0, 0)
+	must(t, err)
+	job := tracker.NewJob("bucket", "exp", "type", time.Date(2021, 3, 4, 0, 0, 0, 0, time.UTC))
+	must(t, tk.AddJob(job))
+	c1, err := tk.ClaimJob(job, tracker.Init)
+	must(t, err)
+	_, err = tk.Sync(context.Background(), time.Time{})
+	must(t, err)
+
+	// Claims are released on restart, and old tokens are stale.
+	tk, err = tracker.NewTracker(context.Background(), saver, 0, 0, 0)
+	must(t, err)
+	c2, err := tk.ClaimJob(job, tracker.Init)
+	must(t, err)
+	if c2.Token <= c1.Token {
+		t.Error("Token did not increase", c1, c2)
+	}
+	if err := tk.SetClaimedStatus(c1, tracker.Parsing, ""); err != tracker.ErrStaleClaim {
+		t.Error("Expected ErrStaleClaim, got", err)
+	}
+}
@@ -0,0 +1,99 @@
+package tracker
+
+import (
+	"sync"
+	"time"
+
+	"github.com/m-lab/etl-gardener/metrics"
+)
+
+// An Event records a job's transition from one State to another.
+type Event struct {
+	Job      Job
+	OldState State // Empty when the job is added.
+	NewState State
+	Detail   string
+	Time     time.Time
+	Started  time.Time // When the job was added.
+}
+
+// MatchesEvent returns true if the event's job and new state satisfy the
+// filter.
+func (f JobFilter) MatchesEvent(e Event) bool {
+	if f.State != "" && f.State != e.NewState {
+		return false
+	}
+	// The state is already checked, so Matches does not need a Status.
+	f.State = ""
+	return f.Matches(e.Job, Status{})
+}
+
+type subscription struct {
+	filter JobFilter
+	events chan Event
+}
+
+// EventBus delivers Events to in-process subscribers.
+type EventBus struct {
+	lock sync.Mutex
+	subs map[*subscription]struct{}
+}
+
+// NewEventBus creates an EventBus with no subscribers.
+func NewEventBus() *EventBus {
+	return &EventBus{subs: make(map[*subscription]struct{})}
+}
+
+// Subscribe returns a channel that receives the events that match the
+// filter, and a function that ends the subscription and closes the channel.
+// The channel has the given buffer size.  Events are dropped for a
+// subscriber whose buffer is full, so that slow subscribers never block
+// the tracker.
+func (b *EventBus) Subscribe(f JobFilter, buffer int) (<-chan Event, func()) {
+	s := &subscription{filter: f, events: make(chan Event, buffer)}
+	b.lock.Lock()
+	b.subs[s] = struct{}{}
+	b.lock.Unlock()
+
+	var once sync.Once
+	return s.events, func() {
+		once.Do(func() {
+			b.lock.Lock()
+			defer b.lock.Unlock()
+			delete(b.subs, s)
+			close(s.events)
+		})
+	}
+}
+
+// Publish delivers an event to all matching subscribers.
+func (b *EventBus) Publish(e Event) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for s := range b.subs {
+		if !s.filter.MatchesEvent(e) {
+			continue
+		}
+		select {
+		case s.events <- e:
+		default:
+			metrics.WarningCount.WithLabelValues(e.Job.Experiment, e.Job.Datatype, "EventDropped").Inc()
+		}
+	}
+}
+
+// SetFinishHook sets a function that is called with the Event of each job
+// that becomes Complete or Failed.  Unlike subscriptions, these events are
+// never dropped.  The function is called while holding the tracker lock, so
+// it must not block or call the tracker.
+func (tr *Tracker) SetFinishHook(f func(Event)) {
+	tr.lock.Lock()
+	defer tr.lock.Unlock()
+	tr.finishHook = f
+}
+
+// Subscribe subscribes to the state transitions of the tracker's jobs.
+// See EventBus.Subscribe.
+func (tr *Tracker) Subscribe(f JobFilter, buffer int) (<-chan Event, func()) {
+	return tr.events.Subscribe(f, buffer)
+}
@@ -0,0 +1,130 @@
+package tracker_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+func TestEventBus(t *testing.T) {
+	bus := tracker.NewEventBus()
+	job := tracker.NewJob("bucket", "exp", "type", time.Date(2021, 3, 4, 0, 0, 0, 0, time.UTC))
+	other := tracker.NewJob("bucket", "exp", "other", job.Date)
+
+	all, cancelAll := bus.Subscribe(tracker.JobFilter{}, 1)
+	complete, cancelComplete := bus.Subscribe(tracker.JobFilter{Datatype: "type", State: tracker.Complete}, 10)
+	defer cancelComplete()
+
+	bus.Publish(tracker.Event{Job: job, OldState: tracker.Joining, NewState: tracker.Complete})
+	// Dropped by the full subscriber, and filtered out by the other.
+	bus.Publish(tracker.Event{Job: other, OldState: tracker.Joining, NewState: tracker.Complete})
+	bus.Publish(tracker.Event{Job: job, OldState: tracker.Init, NewState: tracker.Parsing})
+
+	if e := <-all; e.Job != job || e.NewState != tracker.Complete {
+		t.Error("Wrong event", e)
+	}
+	cancelAll()
+	cancelAll() // Multiple cancels are harmless.
+	if e, ok := <-all; ok {
+		t.Error("Expected closed channel, got", e)
+	}
+	bus.Publish(tracker.Event{Job: job, NewState: tracker.Init})
+
+	if e := <-complete; e.Job != job || e.NewState != tracker.Complete {
+		t.Error("Wrong event", e)
+	}
+	select {
+	case e := <-complete:
+		t.Error("Unexpected event", e)
+	default:
+	}
+}
+
+func TestTracker_Subscribe(t *testing.T) {
+	tk, err := tracker.NewTracker(context.Background(), nil, 0, 0, 0)
+	must(t, err)
+	events, cancel := tk.Subscribe(tracker.JobFilter{}, 10)
+	defer cancel()
+
+	job := tracker.NewJob("bucket", "exp", "type", time.Date(2021, 3, 4, 0, 0, 0, 0, time.UTC))
+	must(t, tk.AddJob(job))
+	must(t, tk.SetStatus(job, tracker.Parsing, "started"))
+	must(t, tk.SetDetail(job, "no transition"))
+	must(t, tk.SetJobError(job, "bad file"))
+
+	want := []tracker.Event{
+		{Job: job, NewState: tracker.Init},
+		{Job: job, OldState: tracker.Init, NewState: tracker.Parsing, Detail: "started"},
+		{Job: job, OldState: tracker.Parsing, NewState: tracker.Failed, Detail: "parsing: bad file"},
+	}
+	for _, w := range want {
+		select {
+		case e := <-events:
+			if e.Job != w.Job || e.OldState != w.OldState || e.NewState != w.NewState ||
+				e.Detail != w.Detail || e.Time.IsZero() {
+				t.Errorf("Got %+v, want %+v", e, w)
+			}
+		default:
+			t.Fatal("Missing event", w)
+		}
+	}
+	select {
+	case e := <-events:
+		t.Error("Unexpected event", e)
+	default:
+	}
+}
+
+func TestEventsHandler(t *testing.T) {
+	tk, err := tracker.NewTracker(context.Background(), nil, 0, 0, 0)
+	must(t, err)
+	job := tracker.NewJob("bucket", "exp", "type", time.Date(2021, 3, 4, 0, 0, 0, 0, time.UTC))
+	must(t, tk.AddJob(job))
+
+	mux := http.NewServeMux()
+	tracker.NewHandler(tk).Register(mux)
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+	base, err := url.Parse(ts.URL)
+	must(t, err)
+
+	postAndExpect(t, tracker.EventsURL(*base, tracker.JobFilter{}), http.StatusMethodNotAllowed)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		tracker.EventsURL(*base, tracker.JobFilter{State: tracker.ParseComplete}).String(), nil)
+	must(t, err)
+	resp, err := http.DefaultClient.Do(req)
+	must(t, err)
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatal("Wrong content type", resp.Header)
+	}
+
+	// The subscription exists once the headers are received.
+	must(t, tk.SetStatus(job, tracker.Parsing, ""))
+	must(t, tk.SetStatus(job, tracker.ParseComplete, "done"))
+
+	scanner := bufio.NewScanner(resp.Body)
+	lines := []string{}
+	for len(lines) < 2 && scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if len(lines) != 2 || lines[0] != "event: transition" || !strings.HasPrefix(lines[1], "data: ") {
+		t.Fatal("Bad event", lines)
+	}
+	var e tracker.Event
+	must(t, json.Unmarshal([]byte(strings.TrimPrefix(lines[1], "data: ")), &e))
+	if e.Job != job || e.OldState != tracker.Parsing || e.NewState != tracker.ParseComplete || e.Detail != "done" {
+		t.Errorf("Wrong event %+v", e)
+	}
+}
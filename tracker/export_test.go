@@ -0,0 +1,8 @@
+package tracker
+
+import "time"
+
+// ExpireLeasesAt expires the leases as if the time were now.
+func (tr *Tracker) ExpireLeasesAt(now time.Time) int {
+	return tr.expireLeases(now)
+}
@@ -1,11 +1,14 @@
 package tracker
 
 import (
+	"crypto/subtle"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"log"
 	"net/http"
 	"net/url"
+	"time"
 
 	"github.com/m-lab/go/logx"
 )
@@ -43,14 +46,87 @@ func ErrorURL(base url.URL, job Job, errString string) *url.URL {
 	return &base
 }
 
+// WithLease adds a lease ID to a heartbeat, update or error request URL.
+// The request is then rejected with 412 Precondition Failed if the job is
+// no longer leased with that ID.
+func WithLease(u *url.URL, leaseID string) *url.URL {
+	params := u.Query()
+	params.Set("lease", leaseID)
+	u.RawQuery = params.Encode()
+	return u
+}
+
+// HistoryURL makes a history request URL.
+func HistoryURL(base url.URL, f JobFilter) *url.URL {
+	base.Path += "history"
+	base.RawQuery = f.Values().Encode()
+	return &base
+}
+
+// JobsURL makes a request URL for the jobs matching the filter.
+func JobsURL(base url.URL, f JobFilter) *url.URL {
+	base.Path += "v1/jobs"
+	base.RawQuery = f.Values().Encode()
+	return &base
+}
+
+// JobURL makes a request URL for a single job.
+func JobURL(base url.URL, job Job) *url.URL {
+	base.Path += "v1/job"
+	params := make(url.Values, 1)
+	params.Add("job", string(job.Marshal()))
+
+	base.RawQuery = params.Encode()
+	return &base
+}
+
+// SummaryURL makes a request URL for the job counts per state.
+func SummaryURL(base url.URL, f JobFilter) *url.URL {
+	base.Path += "v1/summary"
+	base.RawQuery = f.Values().Encode()
+	return &base
+}
+
+// EventsURL makes a request URL for the stream of state transitions of the
+// jobs matching the filter.  The filter's State matches the new state.
+func EventsURL(base url.URL, f JobFilter) *url.URL {
+	base.Path += "v1/events"
+	base.RawQuery = f.Values().Encode()
+	return &base
+}
+
+// OperatorURL makes a request URL for an operator action, i.e. "reset",
+// "cancel", or "skip".  The state is only used by "reset".
+func OperatorURL(base url.URL, action string, job Job, state State, reason string) *url.URL {
+	base.Path += "v1/job/" + action
+	params := make(url.Values, 3)
+	params.Add("job", string(job.Marshal()))
+	if state != "" {
+		params.Add("state", string(state))
+	}
+	params.Add("reason", reason)
+
+	base.RawQuery = params.Encode()
+	return &base
+}
+
 // Handler provides handlers for update, heartbeat, etc.
 type Handler struct {
 	tracker *Tracker
+	// Bearer token required for operator actions.  If empty, operator
+	// actions are disabled.
+	operatorToken string
 }
 
 // NewHandler returns a Handler that sends updates to provided Tracker.
 func NewHandler(tr *Tracker) *Handler {
-	return &Handler{tr}
+	return &Handler{tracker: tr}
+}
+
+// SetOperatorToken enables the operator endpoints, which require requests
+// to include an "Authorization: Bearer <token>" header.
+func (h *Handler) SetOperatorToken(token string) {
+	h.operatorToken = token
 }
 
 func getJob(jobString string) (Job, error) {
@@ -76,8 +152,12 @@ func (h *Handler) heartbeat(resp http.ResponseWriter, req *http.Request) {
 		resp.WriteHeader(http.StatusUnprocessableEntity)
 		return
 	}
-	if err := h.tracker.Heartbeat(job); err != nil {
+	if err := h.tracker.LeasedHeartbeat(job, req.Form.Get("lease")); err != nil {
 		logx.Debug.Printf("%v %+v\n", err, job)
+		if err == ErrStaleLease {
+			resp.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
 		resp.WriteHeader(http.StatusGone)
 		return
 	}
@@ -105,7 +185,15 @@ func (h *Handler) update(resp http.ResponseWriter, req *http.Request) {
 	}
 	detail := req.Form.Get("detail")
 
-	if err := h.tracker.SetStatus(job, State(state), detail); err != nil {
+	if err := h.tracker.SetLeasedStatus(job, req.Form.Get("lease"), State(state), detail); err != nil {
+		if err == ErrInvalidStateTransition {
+			resp.WriteHeader(http.StatusConflict)
+			return
+		}
+		if err == ErrStaleLease {
+			resp.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
 		log.Printf("Not found %+v\n", job)
 		resp.WriteHeader(http.StatusGone)
 		return
@@ -132,16 +220,235 @@ func (h *Handler) errorFunc(resp http.ResponseWriter, req *http.Request) {
 		resp.WriteHeader(http.StatusFailedDependency)
 		return
 	}
-	if err := h.tracker.SetStatus(job, ParseError, jobErr); err != nil {
+	if err := h.tracker.SetLeasedStatus(job, req.Form.Get("lease"), ParseError, jobErr); err != nil {
+		if err == ErrStaleLease {
+			resp.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
 		resp.WriteHeader(http.StatusGone)
 		return
 	}
 	resp.WriteHeader(http.StatusOK)
 }
 
+// history writes the archived jobs matching the request's filter as json.
+func (h *Handler) history(resp http.ResponseWriter, req *http.Request) {
+	filter, ok := getFilter(resp, req)
+	if !ok {
+		return
+	}
+	jobs, err := h.tracker.History(req.Context(), filter)
+	if err == ErrNoArchive {
+		resp.WriteHeader(http.StatusNotImplemented)
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	writeJSON(resp, jobs)
+}
+
+// writeJSON writes v to the response as json.
+func writeJSON(resp http.ResponseWriter, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		log.Println(err)
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	resp.Write(b)
+}
+
+// getFilter parses the JobFilter from a GET request.  It writes an error
+// response and returns false if the request is invalid.
+func getFilter(resp http.ResponseWriter, req *http.Request) (JobFilter, bool) {
+	if req.Method != http.MethodGet {
+		resp.WriteHeader(http.StatusMethodNotAllowed)
+		return JobFilter{}, false
+	}
+	if err := req.ParseForm(); err != nil {
+		resp.WriteHeader(http.StatusBadRequest)
+		return JobFilter{}, false
+	}
+	filter, err := ParseJobFilter(req.Form)
+	if err != nil {
+		resp.WriteHeader(http.StatusBadRequest)
+		return JobFilter{}, false
+	}
+	return filter, true
+}
+
+// jobs writes the jobs matching the request's filter as json.
+func (h *Handler) jobs(resp http.ResponseWriter, req *http.Request) {
+	filter, ok := getFilter(resp, req)
+	if !ok {
+		return
+	}
+	// JobMap.MarshalJSON encodes the jobs as a list of Job/State pairs.
+	writeJSON(resp, h.tracker.Jobs(filter))
+}
+
+// job writes a single job, with its full History, as json.
+func (h *Handler) job(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		resp.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if err := req.ParseForm(); err != nil {
+		resp.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	job, err := getJob(req.Form.Get("job"))
+	if err != nil {
+		resp.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	}
+	status, err := h.tracker.GetStatus(job)
+	if err != nil {
+		resp.WriteHeader(http.StatusNotFound)
+		return
+	}
+	// Same fields as the JobMap pairs.
+	writeJSON(resp, struct {
+		Job   Job
+		State Status
+	}{job, status})
+}
+
+// summary writes the number of jobs matching the request's filter in each state.
+func (h *Handler) summary(resp http.ResponseWriter, req *http.Request) {
+	filter, ok := getFilter(resp, req)
+	if !ok {
+		return
+	}
+	writeJSON(resp, h.tracker.Summary(filter))
+}
+
+// eventKeepalive is the interval between comments sent to keep idle event
+// streams open through proxies.
+var eventKeepalive = 30 * time.Second
+
+// events streams the state transitions of the jobs matching the request's
+// filter as Server-Sent Events, until the client disconnects.  Each event
+// has type "transition", and a json encoded Event as data.
+func (h *Handler) events(resp http.ResponseWriter, req *http.Request) {
+	filter, ok := getFilter(resp, req)
+	if !ok {
+		return
+	}
+	flusher, ok := resp.(http.Flusher)
+	if !ok {
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	events, cancel := h.tracker.Subscribe(filter, 100)
+	defer cancel()
+
+	resp.Header().Set("Content-Type", "text/event-stream")
+	resp.Header().Set("Cache-Control", "no-cache")
+	resp.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepalive := time.NewTicker(eventKeepalive)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-req.Context().Done():
+			return
+		case <-keepalive.C:
+			fmt.Fprint(resp, ": keepalive\n\n")
+		case e := <-events:
+			b, err := json.Marshal(e)
+			if err != nil {
+				log.Println(err)
+				continue
+			}
+			fmt.Fprintf(resp, "event: transition\ndata: %s\n\n", b)
+		}
+		flusher.Flush()
+	}
+}
+
+// authorized checks the operator bearer token.  It writes an error response
+// and returns false if the request is not authorized.
+func (h *Handler) authorized(resp http.ResponseWriter, req *http.Request) bool {
+	return CheckBearerToken(resp, req, h.operatorToken)
+}
+
+// CheckBearerToken checks that the request has an "Authorization: Bearer
+// <token>" header.  It writes an error response and returns false if the
+// request is not authorized, or if token is empty.
+func CheckBearerToken(resp http.ResponseWriter, req *http.Request, token string) bool {
+	if token == "" {
+		resp.WriteHeader(http.StatusForbidden)
+		return false
+	}
+	want := "Bearer " + token
+	got := req.Header.Get("Authorization")
+	if subtle.ConstantTimeCompare([]byte(got), []byte(want)) != 1 {
+		resp.WriteHeader(http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// operatorHandler returns a handler for an operator action.
+func (h *Handler) operatorHandler(action func(job Job, state State, reason string) error) http.HandlerFunc {
+	return func(resp http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			resp.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if !h.authorized(resp, req) {
+			return
+		}
+		if err := req.ParseForm(); err != nil {
+			resp.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		job, err := getJob(req.Form.Get("job"))
+		if err != nil {
+			resp.WriteHeader(http.StatusUnprocessableEntity)
+			return
+		}
+		reason := req.Form.Get("reason")
+		if reason == "" {
+			resp.WriteHeader(http.StatusFailedDependency)
+			return
+		}
+		switch err := action(job, State(req.Form.Get("state")), reason); err {
+		case nil:
+			resp.WriteHeader(http.StatusOK)
+		case ErrInvalidStateTransition:
+			resp.WriteHeader(http.StatusConflict)
+		default:
+			resp.WriteHeader(http.StatusGone)
+		}
+	}
+}
+
 // Register registers the handlers on the server.
 func (h *Handler) Register(mux *http.ServeMux) {
 	mux.HandleFunc("/heartbeat", h.heartbeat)
 	mux.HandleFunc("/update", h.update)
 	mux.HandleFunc("/error", h.errorFunc)
+	h.RegisterReadOnly(mux)
+	mux.HandleFunc("/v1/events", h.events)
+	mux.HandleFunc("/v1/job/reset", h.operatorHandler(h.tracker.ResetJob))
+	mux.HandleFunc("/v1/job/cancel", h.operatorHandler(
+		func(job Job, _ State, reason string) error { return h.tracker.CancelJob(job, reason) }))
+	mux.HandleFunc("/v1/job/skip", h.operatorHandler(
+		func(job Job, _ State, reason string) error { return h.tracker.SkipJob(job, reason) }))
+}
+
+// RegisterReadOnly registers only the handlers that do not modify the
+// tracker, as served by standby instances.
+func (h *Handler) RegisterReadOnly(mux *http.ServeMux) {
+	mux.HandleFunc("/history", h.history)
+	mux.HandleFunc("/v1/jobs", h.jobs)
+	mux.HandleFunc("/v1/job", h.job)
+	mux.HandleFunc("/v1/summary", h.summary)
 }
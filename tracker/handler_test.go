@@ -2,6 +2,7 @@ package tracker_test
 
 import (
 	"context"
+	"encoding/json"
 	"log"
 	"net/http"
 	"net/http/httptest"
@@ -13,7 +14,6 @@ import (
 
 	"cloud.google.com/go/datastore"
 	"github.com/m-lab/etl-gardener/tracker"
-	"github.com/m-lab/go/cloudtest/dsfake"
 )
 
 func init() {
@@ -22,7 +22,7 @@ func init() {
 }
 
 func testSetup(t *testing.T) (url.URL, *tracker.Tracker, tracker.Job) {
-	client := dsfake.NewClient()
+	client := newQueryClient()
 	dsKey := datastore.NameKey("TestTrackerAddDelete", "jobs", nil)
 	dsKey.Namespace = "gardener"
 	defer must(t, cleanup(client, dsKey))
@@ -97,6 +97,38 @@ func TestUpdateHandler(t *testing.T) {
 	}
 }
 
+func TestUpdateHandler_InvalidTransition(t *testing.T) {
+	server, tk, job := testSetup(t)
+	tk.SetPipeline(job.Experiment, job.Datatype, tracker.Pipeline{
+		tracker.Init, tracker.Parsing, tracker.ParseComplete, tracker.Complete})
+	tk.AddJob(job)
+
+	postAndExpect(t, tracker.UpdateURL(server, job, tracker.Parsing, ""), http.StatusOK)
+	postAndExpect(t, tracker.UpdateURL(server, job, tracker.Joining, ""), http.StatusConflict)
+	postAndExpect(t, tracker.UpdateURL(server, job, tracker.Init, ""), http.StatusConflict)
+	postAndExpect(t, tracker.UpdateURL(server, job, tracker.ParseComplete, ""), http.StatusOK)
+}
+
+func TestUpdateHandler_DefaultPipeline(t *testing.T) {
+	server, tk, _ := testSetup(t)
+	tk.SetPipeline("ndt", "annotation", tracker.Pipeline{
+		tracker.Init, tracker.Parsing, tracker.ParseComplete, tracker.Loading, tracker.Complete})
+	tk.SetDefaultPipeline(tracker.Pipeline{
+		tracker.Init, tracker.Parsing, tracker.ParseComplete, tracker.Loading, tracker.Joining, tracker.Complete})
+	date := time.Date(2019, 01, 02, 0, 0, 0, 0, time.UTC)
+	ndt7 := tracker.NewJob("bucket", "ndt", "ndt7", date)
+	ann := tracker.NewJob("bucket", "ndt", "annotation", date)
+	must(t, tk.AddJob(ndt7))
+	must(t, tk.AddJob(ann))
+
+	// Jobs without their own pipeline follow the default pipeline.
+	postAndExpect(t, tracker.UpdateURL(server, ndt7, tracker.Deduplicating, ""), http.StatusConflict)
+	postAndExpect(t, tracker.UpdateURL(server, ndt7, tracker.Parsing, ""), http.StatusOK)
+	postAndExpect(t, tracker.UpdateURL(server, ndt7, tracker.Joining, ""), http.StatusOK)
+	// Jobs with their own pipeline do not.
+	postAndExpect(t, tracker.UpdateURL(server, ann, tracker.Joining, ""), http.StatusConflict)
+}
+
 func TestHeartbeatHandler(t *testing.T) {
 	logx.LogxDebug.Set("true")
 	server, tk, job := testSetup(t)
@@ -159,3 +191,173 @@ func TestErrorHandler(t *testing.T) {
 		t.Fatal("Expected JobNotFound", err)
 	}
 }
+
+func TestHistoryHandler(t *testing.T) {
+	server, tk, job := testSetup(t)
+	filter := tracker.JobFilter{Experiment: job.Experiment, State: tracker.Complete}
+	url := tracker.HistoryURL(server, filter)
+
+	postAndExpect(t, url, http.StatusMethodNotAllowed)
+	// No archive.
+	getAndExpect(t, url, http.StatusNotImplemented)
+
+	tk.SetArchive(tracker.NewMemoryArchive())
+	tk.AddJob(job)
+	must(t, tk.SetStatus(job, tracker.Parsing, ""))
+	must(t, tk.SetStatus(job, tracker.Complete, ""))
+
+	resp, err := http.Get(url.String())
+	must(t, err)
+	defer resp.Body.Close()
+	jobs := []tracker.ArchivedJob{}
+	must(t, json.NewDecoder(resp.Body).Decode(&jobs))
+	if len(jobs) != 1 || jobs[0].Job != job || len(jobs[0].Status.History) != 3 {
+		t.Error("Wrong history:", jobs)
+	}
+
+	bad := server
+	bad.Path += "history"
+	bad.RawQuery = "start=yesterday"
+	getAndExpect(t, &bad, http.StatusBadRequest)
+}
+
+func TestJobsHandlers(t *testing.T) {
+	server, tk, job := testSetup(t)
+	other := tracker.NewJob("bucket", "exp", "other", job.Date.AddDate(0, 0, 1))
+	must(t, tk.AddJob(job))
+	must(t, tk.AddJob(other))
+	must(t, tk.SetStatus(job, tracker.Parsing, "foobar"))
+
+	getJSON := func(url *url.URL, v interface{}) {
+		resp, err := http.Get(url.String())
+		must(t, err)
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatal("Wrong status", resp.Status)
+		}
+		must(t, json.NewDecoder(resp.Body).Decode(v))
+	}
+
+	jobs := make(tracker.JobMap)
+	getJSON(tracker.JobsURL(server, tracker.JobFilter{}), &jobs)
+	if len(jobs) != 2 {
+		t.Error("Expected 2 jobs:", jobs)
+	}
+	jobs = make(tracker.JobMap)
+	getJSON(tracker.JobsURL(server, tracker.JobFilter{State: tracker.Parsing}), &jobs)
+	if s := jobs[job]; len(jobs) != 1 || s.Detail() != "foobar" {
+		t.Error("Expected parsing job:", jobs)
+	}
+
+	one := struct {
+		Job   tracker.Job
+		State tracker.Status
+	}{}
+	getJSON(tracker.JobURL(server, job), &one)
+	if one.Job != job || len(one.State.History) != 2 {
+		t.Error("Wrong job:", one)
+	}
+	getAndExpect(t, tracker.JobURL(server, tracker.NewJob("bucket", "exp", "none", job.Date)), http.StatusNotFound)
+
+	summary := map[tracker.State]int{}
+	getJSON(tracker.SummaryURL(server, tracker.JobFilter{Experiment: "exp"}), &summary)
+	if summary[tracker.Init] != 1 || summary[tracker.Parsing] != 1 {
+		t.Error("Wrong summary:", summary)
+	}
+
+	postAndExpect(t, tracker.SummaryURL(server, tracker.JobFilter{}), http.StatusMethodNotAllowed)
+}
+
+func postAuthAndExpect(t *testing.T, url *url.URL, token string, code int) {
+	req, err := http.NewRequest(http.MethodPost, url.String(), nil)
+	must(t, err)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	must(t, err)
+	if resp.StatusCode != code {
+		log.Output(2, resp.Status)
+		t.Fatalf("Expected %s, got %s", http.StatusText(code), resp.Status)
+	}
+	resp.Body.Close()
+}
+
+func TestOperatorHandlers(t *testing.T) {
+	server, _, job := testSetup(t)
+	// Operator endpoints are disabled without a token.
+	postAuthAndExpect(t, tracker.OperatorURL(server, "cancel", job, "", "reason"), "", http.StatusForbidden)
+
+	// Cancelled jobs are retained for a minute.
+	tk, err := tracker.NewTracker(context.Background(), nil, 0, 0, time.Minute)
+	must(t, err)
+	tk.SetPipeline(job.Experiment, job.Datatype, tracker.Pipeline{
+		tracker.Init, tracker.Parsing, tracker.ParseComplete, tracker.Loading, tracker.Complete})
+	h := tracker.NewHandler(tk)
+	h.SetOperatorToken("secret")
+	mux := http.NewServeMux()
+	h.Register(mux)
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+	base, err := url.Parse(ts.URL)
+	must(t, err)
+	reset := tracker.OperatorURL(*base, "reset", job, tracker.Loading, "retry load")
+
+	getAndExpect(t, reset, http.StatusMethodNotAllowed)
+	postAuthAndExpect(t, reset, "", http.StatusUnauthorized)
+	postAuthAndExpect(t, reset, "wrong", http.StatusUnauthorized)
+	postAuthAndExpect(t, reset, "secret", http.StatusGone)
+	postAuthAndExpect(t, tracker.OperatorURL(*base, "reset", job, tracker.Loading, ""), "secret", http.StatusFailedDependency)
+
+	must(t, tk.AddJob(job))
+	must(t, tk.SetJobError(job, "load failed"))
+	postAuthAndExpect(t, tracker.OperatorURL(*base, "reset", job, tracker.Complete, "no"), "secret", http.StatusConflict)
+
+	// Reset from Failed to Loading, bypassing the pipeline.
+	postAuthAndExpect(t, reset, "secret", http.StatusOK)
+	status, err := tk.GetStatus(job)
+	must(t, err)
+	if status.State() != tracker.Loading || status.Detail() != "reset by operator: retry load" {
+		t.Error("Wrong status after reset:", status)
+	}
+
+	// Cancelled jobs reject further updates.
+	postAuthAndExpect(t, tracker.OperatorURL(*base, "cancel", job, "", "bad data"), "secret", http.StatusOK)
+	postAndExpect(t, tracker.UpdateURL(*base, job, tracker.Complete, ""), http.StatusGone)
+	status, err = tk.GetStatus(job)
+	must(t, err)
+	if status.State() != tracker.Cancelled || status.Detail() != "cancelled by operator: bad data" {
+		t.Error("Wrong status after cancel:", status)
+	}
+
+	// Cancelled jobs may be restarted.
+	must(t, tk.AddJob(job))
+	postAuthAndExpect(t, tracker.OperatorURL(*base, "skip", job, "", "known outage"), "secret", http.StatusOK)
+	status, err = tk.GetStatus(job)
+	must(t, err)
+	if status.State() != tracker.Skipped || len(status.History) != 2 {
+		t.Error("Wrong status after skip:", status)
+	}
+}
+
+func TestReadOnlyHandlers(t *testing.T) {
+	saver := tracker.NewMemorySaver()
+	tk, err := tracker.NewTracker(context.Background(), saver, 0, 0, 0)
+	must(t, err)
+	job := tracker.NewJob("bucket", "exp", "type", time.Date(2019, 01, 02, 0, 0, 0, 0, time.UTC))
+	must(t, tk.AddJob(job))
+	_, err = tk.Sync(context.Background(), time.Time{})
+	must(t, err)
+
+	snap, err := tracker.LoadSnapshot(context.Background(), saver)
+	must(t, err)
+	mux := http.NewServeMux()
+	tracker.NewHandler(snap).RegisterReadOnly(mux)
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+	base, err := url.Parse(ts.URL)
+	must(t, err)
+
+	getAndExpect(t, tracker.JobURL(*base, job), http.StatusOK)
+	postAndExpect(t, tracker.UpdateURL(*base, job, tracker.Parsing, ""), http.StatusNotFound)
+}
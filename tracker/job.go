@@ -13,9 +13,7 @@ import (
 	"sync"
 	"time"
 
-	"cloud.google.com/go/datastore"
 	"cloud.google.com/go/storage"
-	"github.com/googleapis/google-cloud-go-testing/datastore/dsiface"
 	"github.com/googleapis/google-cloud-go-testing/storage/stiface"
 
 	"github.com/m-lab/go/cloud/bqx"
@@ -44,6 +42,9 @@ type JobWithTarget struct {
 	// either a BigQuery table, or a GCS bucket/prefix string.
 	TargetTable           bqx.PDT `json:",omitempty"`
 	TargetBucketAndPrefix string  `json:",omitempty"` // gs://bucket/prefix
+	// Lease held by the parser that the job is dispatched to, if the
+	// Tracker has a lease policy.
+	Lease *Lease `json:",omitempty"`
 }
 
 func (j JobWithTarget) String() string {
@@ -110,6 +111,14 @@ func (j Job) Marshal() []byte {
 	return b
 }
 
+// key returns a unique string identifying the job, used as the persistence key.
+func (j Job) key() string {
+	if j.Filter != "" {
+		return j.Path() + "?" + j.Filter
+	}
+	return j.Path()
+}
+
 func (j Job) String() string {
 	return fmt.Sprintf("%s:%s/%s", j.Date.Format("20060102"), j.Experiment, j.Datatype)
 }
@@ -165,6 +174,9 @@ var (
 	ErrInvalidStateTransition = errors.New("invalid state transition")
 	ErrNotYetImplemented      = errors.New("not yet implemented")
 	ErrNoChange               = errors.New("no change since last save")
+	ErrStaleLease             = errors.New("stale lease")
+	ErrJobClaimed             = errors.New("job is already claimed")
+	ErrStaleClaim             = errors.New("stale claim")
 )
 
 // State types are used for the Status.State values
@@ -184,14 +196,55 @@ const (
 	Stabilizing   State = "stabilizing"
 	Loading       State = "loading"
 	Deduplicating State = "deduplicating"
+	Validating    State = "validating"
 	Copying       State = "copying"
 	Joining       State = "joining"
+	Exporting     State = "exporting"
 	Deleting      State = "deleting"
 	Finishing     State = "finishing"
 	Failed        State = "failed"
 	Complete      State = "complete"
+	Cancelled     State = "cancelled" // Cancelled by an operator.
+	Skipped       State = "skipped"   // Skipped by an operator.
+	Requeued      State = "requeued"  // Parser lease expired, waiting to be dispatched again.
 )
 
+// resettable lists the states that an operator may reset a job to.
+var resettable = map[State]bool{
+	Init: true, Parsing: true, ParseComplete: true, Stabilizing: true,
+	Loading: true, Deduplicating: true, Validating: true, Copying: true,
+	Joining: true, Exporting: true, Deleting: true, Finishing: true,
+}
+
+// A Pipeline is the ordered list of States that jobs of a particular
+// experiment/datatype pass through.
+type Pipeline []State
+
+func (p Pipeline) index(state State) int {
+	for i := range p {
+		if p[i] == state {
+			return i
+		}
+	}
+	return -1
+}
+
+// Allows returns true if a job in state "from" may transition to state "to".
+// Jobs may always move to an error state, and may otherwise only move
+// forward through the pipeline.  Forward transitions may skip states,
+// e.g. when a parser does not report the Parsing state.
+func (p Pipeline) Allows(from, to State) bool {
+	if from == to || to == Failed || to == ParseError {
+		return true
+	}
+	if from == ParseError {
+		// Parsers may continue after reporting an error.
+		from = Parsing
+	}
+	f, t := p.index(from), p.index(to)
+	return f >= 0 && t > f
+}
+
 // StateInfo describes each state in processing history.
 type StateInfo struct {
 	State      State     // const after creation
@@ -224,6 +277,13 @@ func (si *StateInfo) setDetail(detail string) {
 type Status struct {
 	HeartbeatTime time.Time // Time of last ETL heartbeat.
 
+	Lease       Lease // Parser lease, while the job is being parsed.
+	LeaseLosses int   // Number of times the parser lease expired.
+
+	Claim int64 // Token of the current Claim, or zero if the job is not claimed.
+
+	Attempts int // Number of failed attempts in the current state, reset by NewState.
+
 	UpdateCount int // Number of updates
 
 	// History has shared backing store.  Copy on write is used to avoid
@@ -324,8 +384,10 @@ func (s *Status) updateMetrics(job Job) {
 		old := s.History[len(s.History)-2]
 		timeInState := time.Since(old.Start)
 		metrics.StateTimeHistogram.WithLabelValues(job.Experiment, job.Datatype, string(old.State)).Observe(timeInState.Seconds())
-		// old state will never be Failed, so the label is just the old.State.
-		metrics.TasksInFlight.WithLabelValues(job.Experiment, job.Datatype, string(old.State)).Dec()
+		// old state is only Failed if an operator reset the job, so use
+		// the old Label.
+		prev := Status{History: s.History[:len(s.History)-1]}
+		metrics.TasksInFlight.WithLabelValues(job.Experiment, job.Datatype, prev.Label()).Dec()
 	}
 
 	// Use s.Label() which takes into account whether the state is Failed.
@@ -341,6 +403,7 @@ func (s *Status) NewState(state State) StateInfo {
 		log.Println("Warning - same state")
 	} else {
 		s.History = append(s.History, newStateInfo(state))
+		s.Attempts = 0
 	}
 	return old
 }
@@ -353,8 +416,16 @@ func (s Status) String() string {
 		last.Detail)
 }
 
+// isDone returns true if the job is Complete, or was Cancelled or Skipped.
 func (s *Status) isDone() bool {
-	return s.LastStateInfo().State == Complete
+	state := s.LastStateInfo().State
+	return state == Complete || state == Cancelled || state == Skipped
+}
+
+// isCancelled returns true if an operator cancelled or skipped the job.
+func (s *Status) isCancelled() bool {
+	state := s.LastStateInfo().State
+	return state == Cancelled || state == Skipped
 }
 
 // Elapsed returns the elapsed time of the Job, rounded to nearest second.
@@ -474,45 +545,3 @@ func (jobs JobMap) WriteHTML(w io.Writer) error {
 	}
 	return err
 }
-
-// saverStruct is used only for saving and loading from datastore.
-type saverStruct struct {
-	SaveTime time.Time
-	LastInit Job
-	// Jobs is encoded as json, because datastore doesn't handle maps.
-	Jobs []byte `datastore:",noindex"`
-}
-
-func loadFromDatastore(ctx context.Context, client dsiface.Client, key *datastore.Key) (saverStruct, error) {
-	state := saverStruct{Jobs: make([]byte, 0)}
-	if client == nil {
-		return state, ErrClientIsNil
-	}
-
-	err := client.Get(ctx, key, &state) // This should error?
-	return state, err
-}
-
-// loadJobMap loads the persisted map of jobs in flight.
-func loadJobMap(ctx context.Context, client dsiface.Client, key *datastore.Key) (JobMap, Job, error) {
-	state, err := loadFromDatastore(ctx, client, key)
-	if err != nil {
-		return nil, Job{}, err
-	}
-	log.Println("Last save:", state.SaveTime.Format("01/02T15:04"))
-	log.Println(string(state.Jobs))
-
-	jobMap := make(JobMap, 100)
-	log.Println("Unmarshalling", len(state.Jobs))
-	err = json.Unmarshal(state.Jobs, &jobMap)
-	if err != nil {
-		log.Fatal("loadJobMap failed", err)
-	}
-	for j, s := range jobMap {
-		if len(s.History) < 1 {
-			log.Fatalf("Empty State history %+v : %+v\n", j, s)
-		}
-	}
-	return jobMap, state.LastInit, nil
-
-}
@@ -104,3 +104,28 @@ func TestStatusFailure(t *testing.T) {
 	}
 	t.Log(s.Detail())
 }
+
+func TestPipeline_Allows(t *testing.T) {
+	p := tracker.Pipeline{tracker.Init, tracker.Parsing, tracker.ParseComplete,
+		tracker.Loading, tracker.Copying, tracker.Complete}
+	tests := []struct {
+		from, to tracker.State
+		want     bool
+	}{
+		{tracker.Init, tracker.Parsing, true},
+		{tracker.Parsing, tracker.Parsing, true},
+		{tracker.Init, tracker.ParseComplete, true},
+		{tracker.Loading, tracker.Copying, true},
+		{tracker.Copying, tracker.Failed, true},
+		{tracker.Parsing, tracker.ParseError, true},
+		{tracker.ParseError, tracker.ParseComplete, true},
+		{tracker.Copying, tracker.Loading, false},
+		{tracker.Loading, tracker.Joining, false},
+		{tracker.Failed, tracker.Loading, false},
+	}
+	for _, tt := range tests {
+		if got := p.Allows(tt.from, tt.to); got != tt.want {
+			t.Errorf("Allows(%s, %s) = %v, want %v", tt.from, tt.to, got, tt.want)
+		}
+	}
+}
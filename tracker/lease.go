@@ -0,0 +1,169 @@
+package tracker
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/m-lab/etl-gardener/metrics"
+	"github.com/m-lab/go/logx"
+)
+
+// A Lease grants a parser exclusive ownership of a job until the Deadline.
+// Heartbeats extend the Deadline.  If the lease expires, the job is requeued,
+// and later updates from the parser that held the lease are rejected with
+// ErrStaleLease.
+type Lease struct {
+	ID       string
+	Deadline time.Time
+}
+
+// leased returns true if a job in this state is owned by a parser.
+func leased(state State) bool {
+	return state == Init || state == Parsing || state == ParseError
+}
+
+func newLeaseID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		// This should never happen, but the time is unique enough.
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+// SetLeasePolicy enables parser leases.  Jobs added with AddJob are granted
+// a lease for the given duration, which is extended by each Heartbeat.  Jobs
+// whose lease expires are moved to the Requeued state, so that they may be
+// dispatched again, and are Failed when the lease has expired maxLosses
+// times.  The leases are checked every checkInterval, until ctx is done or
+// the policy is set again.  The previous checker, if any, has returned when
+// SetLeasePolicy returns.
+func (tr *Tracker) SetLeasePolicy(ctx context.Context, duration time.Duration, maxLosses int, checkInterval time.Duration) {
+	tr.lock.Lock()
+	stop := tr.stopLeases
+	tr.stopLeases = nil
+	tr.lock.Unlock()
+	if stop != nil {
+		// The checker takes the lock, so it must be stopped without the lock.
+		stop()
+	}
+
+	tr.lock.Lock()
+	defer tr.lock.Unlock()
+	tr.leaseDuration = duration
+	tr.maxLeaseLosses = maxLosses
+	if duration > 0 && checkInterval > 0 {
+		ctx, cancel := context.WithCancel(ctx)
+		done := make(chan struct{})
+		tr.stopLeases = func() {
+			cancel()
+			<-done
+		}
+		go func() {
+			defer close(done)
+			ticker := time.NewTicker(checkInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+					tr.ExpireLeases()
+				}
+			}
+		}()
+	}
+}
+
+// ExpireLeases requeues or fails all jobs whose lease has expired.
+// It returns the number of expired leases.
+func (tr *Tracker) ExpireLeases() int {
+	return tr.expireLeases(time.Now())
+}
+
+// expireLeases expires the leases whose deadline is before now.
+func (tr *Tracker) expireLeases(now time.Time) int {
+	tr.lock.Lock()
+	expired := make([]Job, 0)
+	for j, s := range tr.jobs {
+		if s.Lease.ID != "" && now.After(s.Lease.Deadline) {
+			expired = append(expired, j)
+		}
+	}
+	tr.lock.Unlock()
+
+	count := 0
+	for _, j := range expired {
+		if err := tr.expireLease(j, now); err != nil {
+			logx.Debug.Println(j, err)
+			continue
+		}
+		count++
+	}
+	return count
+}
+
+// expireLease requeues or fails a job whose lease has expired.
+func (tr *Tracker) expireLease(job Job, now time.Time) error {
+	status, err := tr.GetStatus(job)
+	if err != nil {
+		return err
+	}
+	lease := status.Lease
+	oldState := status.State()
+	status.Lease = Lease{}
+	status.LeaseLosses++
+	metrics.WarningCount.WithLabelValues(job.Experiment, job.Datatype, "LeaseExpired").Inc()
+	tr.lock.Lock()
+	maxLosses := tr.maxLeaseLosses
+	tr.lock.Unlock()
+	if status.LeaseLosses >= maxLosses {
+		log.Println(job, "lease expired", status.LeaseLosses, "times, failing job")
+		errString := fmt.Sprintf("lease expired %d times", status.LeaseLosses)
+		job.failureMetric(oldState, errString)
+		status.NewState(Failed)
+		status.SetDetail(fmt.Sprintf("%s: %s", oldState, errString))
+	} else {
+		log.Println(job, "lease expired, requeueing")
+		status.NewState(Requeued)
+		status.SetDetail(fmt.Sprintf("lease expired in %s", oldState))
+	}
+	// Check that the lease was not extended or replaced in the meantime.
+	return tr.update(job, status, func(old *Status) error {
+		if old.Lease != lease || !now.After(old.Lease.Deadline) {
+			return ErrStaleLease
+		}
+		return nil
+	})
+}
+
+// checkLease returns a check that rejects updates to a job that is not
+// leased with leaseID.  An empty leaseID matches any lease, for parsers that
+// do not use leases.
+func checkLease(leaseID string) func(old *Status) error {
+	return func(old *Status) error {
+		if err := checkUpdate(old); err != nil {
+			return err
+		}
+		if leaseID != "" && old.Lease.ID != leaseID {
+			return ErrStaleLease
+		}
+		return nil
+	}
+}
+
+// checkUpdate rejects updates to jobs that were cancelled or skipped by an
+// operator, or requeued after their lease expired.
+func checkUpdate(old *Status) error {
+	if old.isCancelled() {
+		return ErrJobIsObsolete
+	}
+	if old.State() == Requeued {
+		return ErrStaleLease
+	}
+	return nil
+}
@@ -0,0 +1,159 @@
+package tracker_test
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+func TestLeases(t *testing.T) {
+	tk, err := tracker.NewTracker(context.Background(), nil, 0, 0, time.Minute)
+	must(t, err)
+	tk.SetLeasePolicy(context.Background(), time.Hour, 2, 0)
+
+	job := tracker.NewJob("bucket", "exp", "type", time.Date(2021, 3, 4, 0, 0, 0, 0, time.UTC))
+	must(t, tk.AddJob(job))
+	status, err := tk.GetStatus(job)
+	must(t, err)
+	lease := status.Lease
+	if lease.ID == "" || time.Until(lease.Deadline) <= 0 {
+		t.Fatalf("Bad lease: %+v", lease)
+	}
+
+	// Heartbeats extend the lease.
+	must(t, tk.LeasedHeartbeat(job, lease.ID))
+	status, _ = tk.GetStatus(job)
+	if status.Lease.Deadline.Before(lease.Deadline) {
+		t.Error("Lease was not extended", status.Lease, lease)
+	}
+	if err := tk.LeasedHeartbeat(job, "wrong"); err != tracker.ErrStaleLease {
+		t.Error("Expected ErrStaleLease, got", err)
+	}
+	must(t, tk.SetLeasedStatus(job, lease.ID, tracker.Parsing, "foo"))
+	status, _ = tk.GetStatus(job)
+	if n := tk.ExpireLeasesAt(status.Lease.Deadline.Add(-time.Second)); n != 0 {
+		t.Error("Expected no expired leases, got", n)
+	}
+
+	// The expired job is requeued, and the old lease holder is rejected.
+	if n := tk.ExpireLeasesAt(status.Lease.Deadline.Add(time.Second)); n != 1 {
+		t.Fatal("Expected 1 expired lease, got", n)
+	}
+	status, _ = tk.GetStatus(job)
+	if status.State() != tracker.Requeued || status.LeaseLosses != 1 || status.Lease.ID != "" {
+		t.Fatalf("Expected requeued job: %+v", status)
+	}
+	if err := tk.SetLeasedStatus(job, lease.ID, tracker.ParseComplete, ""); err != tracker.ErrStaleLease {
+		t.Error("Expected ErrStaleLease, got", err)
+	}
+	if err := tk.SetStatus(job, tracker.ParseComplete, ""); err != tracker.ErrStaleLease {
+		t.Error("Expected ErrStaleLease, got", err)
+	}
+
+	// Redispatching grants a new lease, and keeps the loss count.
+	must(t, tk.AddJob(job))
+	status, _ = tk.GetStatus(job)
+	if status.Lease.ID == "" || status.Lease.ID == lease.ID || status.LeaseLosses != 1 {
+		t.Fatalf("Bad redispatched job: %+v", status)
+	}
+
+	// Too many lease losses fail the job.
+	if n := tk.ExpireLeasesAt(status.Lease.Deadline.Add(time.Second)); n != 1 {
+		t.Fatal("Expected 1 expired lease, got", n)
+	}
+	status, _ = tk.GetStatus(job)
+	if status.State() != tracker.Failed || status.LeaseLosses != 2 {
+		t.Fatalf("Expected failed job: %+v", status)
+	}
+}
+
+func TestLeases_Release(t *testing.T) {
+	tk, err := tracker.NewTracker(context.Background(), nil, 0, 0, time.Minute)
+	must(t, err)
+	tk.SetLeasePolicy(context.Background(), time.Hour, 1, 0)
+
+	job := tracker.NewJob("bucket", "exp", "type", time.Date(2021, 3, 4, 0, 0, 0, 0, time.UTC))
+	must(t, tk.AddJob(job))
+	// Post processing does not require a lease.
+	must(t, tk.SetStatus(job, tracker.ParseComplete, ""))
+	if n := tk.ExpireLeasesAt(time.Now().Add(2 * time.Hour)); n != 0 {
+		t.Error("Expected no expired leases, got", n)
+	}
+	status, _ := tk.GetStatus(job)
+	if status.State() != tracker.ParseComplete || status.Lease.ID != "" {
+		t.Errorf("Lease was not released: %+v", status)
+	}
+}
+
+func TestLeaseHandlers(t *testing.T) {
+	server, tk, job := testSetup(t)
+	tk.SetLeasePolicy(context.Background(), time.Hour, 3, 0)
+	must(t, tk.AddJob(job))
+	status, err := tk.GetStatus(job)
+	must(t, err)
+	lease := status.Lease.ID
+
+	postAndExpect(t, tracker.WithLease(tracker.HeartbeatURL(server, job), lease), http.StatusOK)
+	postAndExpect(t, tracker.WithLease(tracker.HeartbeatURL(server, job), "stale"), http.StatusPreconditionFailed)
+	postAndExpect(t, tracker.WithLease(tracker.UpdateURL(server, job, tracker.Parsing, ""), "stale"), http.StatusPreconditionFailed)
+	postAndExpect(t, tracker.WithLease(tracker.ErrorURL(server, job, "oops"), "stale"), http.StatusPreconditionFailed)
+	postAndExpect(t, tracker.WithLease(tracker.UpdateURL(server, job, tracker.Parsing, ""), lease), http.StatusOK)
+	// Parsers that do not send a lease are still accepted.
+	postAndExpect(t, tracker.ErrorURL(server, job, "oops"), http.StatusOK)
+}
+
+func TestLeases_MaxLosses(t *testing.T) {
+	tk, err := tracker.NewTracker(context.Background(), nil, 0, 0, time.Minute)
+	must(t, err)
+	// The job is failed when the lease expires for the maxLosses'th time.
+	tk.SetLeasePolicy(context.Background(), time.Hour, 1, 0)
+	job := tracker.NewJob("bucket", "exp", "type", time.Date(2021, 3, 4, 0, 0, 0, 0, time.UTC))
+	must(t, tk.AddJob(job))
+	status, _ := tk.GetStatus(job)
+	if n := tk.ExpireLeasesAt(status.Lease.Deadline.Add(time.Second)); n != 1 {
+		t.Fatal("Expected 1 expired lease, got", n)
+	}
+	status, _ = tk.GetStatus(job)
+	if status.State() != tracker.Failed || status.LeaseLosses != 1 {
+		t.Fatalf("Expected failed job: %+v", status)
+	}
+}
+
+// waitForState waits up to 5 seconds for the job to reach the state.
+func waitForState(tk *tracker.Tracker, job tracker.Job, state tracker.State) tracker.Status {
+	var status tracker.Status
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(time.Millisecond) {
+		status, _ = tk.GetStatus(job)
+		if status.State() == state {
+			break
+		}
+	}
+	return status
+}
+
+func TestLeases_Checker(t *testing.T) {
+	tk, err := tracker.NewTracker(context.Background(), nil, 0, 0, time.Minute)
+	must(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	tk.SetLeasePolicy(ctx, time.Millisecond, 3, time.Millisecond)
+	job := tracker.NewJob("bucket", "exp", "type", time.Date(2021, 3, 4, 0, 0, 0, 0, time.UTC))
+	must(t, tk.AddJob(job))
+	if status := waitForState(tk, job, tracker.Requeued); status.State() != tracker.Requeued {
+		t.Fatalf("Expected requeued job: %+v", status)
+	}
+
+	// Once ctx is done, leases are no longer checked.  Setting the policy
+	// again waits for the checker to return, and without a check interval,
+	// there is no new checker.
+	cancel()
+	tk.SetLeasePolicy(context.Background(), time.Millisecond, 3, 0)
+	must(t, tk.AddJob(job))
+	time.Sleep(20 * time.Millisecond)
+	status, _ := tk.GetStatus(job)
+	if status.State() != tracker.Init {
+		t.Fatalf("Lease should not be expired: %+v", status)
+	}
+}
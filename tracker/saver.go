@@ -0,0 +1,378 @@
+package tracker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/googleapis/google-cloud-go-testing/datastore/dsiface"
+)
+
+// ErrCorruptSnapshot is returned when a persisted tracker state cannot be decoded.
+var ErrCorruptSnapshot = errors.New("corrupt tracker snapshot")
+
+// A Saver saves and loads the tracker state, i.e. the Status of each Job and
+// the last Job that was added.  Savers are incremental: the Tracker passes
+// only the jobs that changed, and the jobs that were removed, since the
+// previous successful save.
+type Saver interface {
+	SaveJobs(ctx context.Context, updated JobMap, deleted []Job, lastJob Job) error
+	// Load returns the most recently saved state.  It returns
+	// ErrCorruptSnapshot if the saved state cannot be decoded.
+	Load(ctx context.Context) (JobMap, Job, error)
+}
+
+// isNotSaved returns true if a Load error means that no state has been saved.
+func isNotSaved(err error) bool {
+	return os.IsNotExist(err) || errors.Is(err, datastore.ErrNoSuchEntity)
+}
+
+// saverStruct is used only for saving and loading from datastore.
+type saverStruct struct {
+	SaveTime time.Time
+	LastInit Job
+	// Jobs is encoded as json, because datastore doesn't handle maps.
+	// It is only populated in legacy snapshots, which stored all jobs
+	// in a single entity.
+	Jobs []byte `datastore:",noindex"`
+}
+
+// decodeJobMap unmarshals and validates a json encoded JobMap.
+func decodeJobMap(data []byte) (JobMap, error) {
+	jobMap := make(JobMap, 100)
+	log.Println("Unmarshalling", len(data))
+	err := json.Unmarshal(data, &jobMap)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCorruptSnapshot, err)
+	}
+	for j, s := range jobMap {
+		if len(s.History) < 1 {
+			return nil, fmt.Errorf("%w: empty State history %+v : %+v", ErrCorruptSnapshot, j, s)
+		}
+	}
+	return jobMap, nil
+}
+
+// decodeStatus unmarshals and validates a single json encoded Status.
+func decodeStatus(job Job, data []byte) (Status, error) {
+	s := Status{}
+	if err := json.Unmarshal(data, &s); err != nil {
+		return s, fmt.Errorf("%w: %v : %v", ErrCorruptSnapshot, job, err)
+	}
+	if len(s.History) < 1 {
+		return s, fmt.Errorf("%w: empty State history %+v : %+v", ErrCorruptSnapshot, job, s)
+	}
+	return s, nil
+}
+
+/////////////////////////////////////////////////////////////
+//                   DatastoreSaver                        //
+/////////////////////////////////////////////////////////////
+
+// jobKind is the Datastore kind of the per-job entities.
+const jobKind = "Job"
+
+// maxBatchSize is the Datastore limit on entities per PutMulti/DeleteMulti.
+const maxBatchSize = 500
+
+// jobEntity is the Datastore representation of a single job.  The Job and
+// current State are indexed, so jobs can be queried from outside Gardener.
+type jobEntity struct {
+	Job        Job
+	State      State
+	UpdateTime time.Time
+	// Status is encoded as json, because datastore doesn't handle the
+	// History slice of structs.
+	Status []byte `datastore:",noindex"`
+}
+
+// DatastoreSaver saves each job as its own Datastore entity, as a child of
+// the tracker key.  The tracker key entity holds the last Job added.
+type DatastoreSaver struct {
+	client dsiface.Client
+	key    *datastore.Key
+}
+
+// NewDatastoreSaver creates a Saver that uses the provided client and key.
+func NewDatastoreSaver(client dsiface.Client, key *datastore.Key) *DatastoreSaver {
+	return &DatastoreSaver{client: client, key: key}
+}
+
+// jobKey returns the Datastore key for a job.
+func (ds *DatastoreSaver) jobKey(j Job) *datastore.Key {
+	k := datastore.NameKey(jobKind, j.key(), ds.key)
+	k.Namespace = ds.key.Namespace
+	return k
+}
+
+// SaveJobs implements Saver.SaveJobs
+func (ds *DatastoreSaver) SaveJobs(ctx context.Context, updated JobMap, deleted []Job, lastJob Job) error {
+	if ds.client == nil {
+		return ErrClientIsNil
+	}
+	keys := make([]*datastore.Key, 0, len(updated))
+	entities := make([]*jobEntity, 0, len(updated))
+	for j, s := range updated {
+		status, err := json.Marshal(s)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, ds.jobKey(j))
+		entities = append(entities, &jobEntity{Job: j, State: s.State(), UpdateTime: s.DetailTime(), Status: status})
+	}
+	for len(keys) > 0 {
+		n := len(keys)
+		if n > maxBatchSize {
+			n = maxBatchSize
+		}
+		tctx, cf := context.WithTimeout(ctx, 10*time.Second)
+		_, err := ds.client.PutMulti(tctx, keys[:n], entities[:n])
+		cf()
+		if err != nil {
+			return err
+		}
+		keys, entities = keys[n:], entities[n:]
+	}
+
+	keys = make([]*datastore.Key, len(deleted))
+	for i := range deleted {
+		keys[i] = ds.jobKey(deleted[i])
+	}
+	for len(keys) > 0 {
+		n := len(keys)
+		if n > maxBatchSize {
+			n = maxBatchSize
+		}
+		tctx, cf := context.WithTimeout(ctx, 10*time.Second)
+		err := ds.client.DeleteMulti(tctx, keys[:n])
+		cf()
+		if err != nil {
+			return err
+		}
+		keys = keys[n:]
+	}
+
+	// This also replaces any legacy snapshot, now that the jobs are saved
+	// individually.
+	state := saverStruct{SaveTime: time.Now(), LastInit: lastJob}
+	ctx, cf := context.WithTimeout(ctx, 10*time.Second)
+	defer cf()
+	_, err := ds.client.Put(ctx, ds.key, &state)
+	return err
+}
+
+// Load implements Saver.Load
+func (ds *DatastoreSaver) Load(ctx context.Context) (JobMap, Job, error) {
+	if ds.client == nil {
+		return nil, Job{}, ErrClientIsNil
+	}
+	state := saverStruct{Jobs: make([]byte, 0)}
+	stateErr := ds.client.Get(ctx, ds.key, &state)
+	if stateErr != nil && stateErr != datastore.ErrNoSuchEntity {
+		return nil, Job{}, stateErr
+	}
+	log.Println("Last save:", state.SaveTime.Format("01/02T15:04"))
+
+	entities := make([]jobEntity, 0, 100)
+	q := datastore.NewQuery(jobKind).Namespace(ds.key.Namespace).Ancestor(ds.key)
+	if _, err := ds.client.GetAll(ctx, q, &entities); err != nil {
+		return nil, Job{}, err
+	}
+	if len(entities) == 0 {
+		if stateErr != nil {
+			return nil, Job{}, stateErr
+		}
+		// Fall back to a legacy snapshot.  Its jobs will be saved
+		// individually on the next save.
+		if len(state.Jobs) > 0 {
+			jobMap, err := decodeJobMap(state.Jobs)
+			if err != nil {
+				return nil, Job{}, err
+			}
+			return jobMap, state.LastInit, nil
+		}
+	}
+
+	jobMap := make(JobMap, len(entities))
+	for i := range entities {
+		s, err := decodeStatus(entities[i].Job, entities[i].Status)
+		if err != nil {
+			return nil, Job{}, err
+		}
+		jobMap[entities[i].Job] = s
+	}
+	log.Printf("Loaded %d jobs.\n", len(jobMap))
+	return jobMap, state.LastInit, nil
+}
+
+/////////////////////////////////////////////////////////////
+//                   MemorySaver                           //
+/////////////////////////////////////////////////////////////
+
+// MemorySaver keeps the tracker state in memory.  It is useful for testing,
+// and for running Gardener without any external persistence.
+type MemorySaver struct {
+	lock    sync.Mutex
+	jobs    map[Job][]byte // json encoded, so that Load returns independent copies.
+	lastJob Job
+}
+
+// NewMemorySaver creates an empty MemorySaver.
+func NewMemorySaver() *MemorySaver {
+	return &MemorySaver{jobs: make(map[Job][]byte, 100)}
+}
+
+// SaveJobs implements Saver.SaveJobs
+func (ms *MemorySaver) SaveJobs(ctx context.Context, updated JobMap, deleted []Job, lastJob Job) error {
+	encoded := make(map[Job][]byte, len(updated))
+	for j, s := range updated {
+		b, err := json.Marshal(s)
+		if err != nil {
+			return err
+		}
+		encoded[j] = b
+	}
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	for j, b := range encoded {
+		ms.jobs[j] = b
+	}
+	for _, j := range deleted {
+		delete(ms.jobs, j)
+	}
+	ms.lastJob = lastJob
+	return nil
+}
+
+// Load implements Saver.Load
+func (ms *MemorySaver) Load(ctx context.Context) (JobMap, Job, error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	jobMap := make(JobMap, len(ms.jobs))
+	for j, b := range ms.jobs {
+		s, err := decodeStatus(j, b)
+		if err != nil {
+			return nil, Job{}, err
+		}
+		jobMap[j] = s
+	}
+	return jobMap, ms.lastJob, nil
+}
+
+/////////////////////////////////////////////////////////////
+//                   FileSaver                             //
+/////////////////////////////////////////////////////////////
+
+// fileState is the json structure of the FileSaver file.
+type fileState struct {
+	SaveTime time.Time
+	LastInit Job
+	Jobs     json.RawMessage
+}
+
+// FileSaver saves the tracker state to a local json file.  It keeps a copy
+// of the saved jobs, applies each incremental save to it, and replaces the
+// file atomically, so a crash during SaveJobs leaves the previous state intact.
+type FileSaver struct {
+	path string
+
+	lock   sync.Mutex
+	loaded bool
+	jobs   JobMap
+}
+
+// NewFileSaver creates a Saver that uses the file at path.
+func NewFileSaver(path string) *FileSaver {
+	return &FileSaver{path: path}
+}
+
+// SaveJobs implements Saver.SaveJobs
+func (fs *FileSaver) SaveJobs(ctx context.Context, updated JobMap, deleted []Job, lastJob Job) error {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	if !fs.loaded {
+		// Don't discard jobs saved by a previous instance, or replace a
+		// file that can't be loaded.
+		jobs, _, err := fs.load()
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		fs.jobs, fs.loaded = jobs, true
+	}
+	if fs.jobs == nil {
+		fs.jobs = make(JobMap, len(updated))
+	}
+	for j, s := range updated {
+		fs.jobs[j] = s
+	}
+	for _, j := range deleted {
+		delete(fs.jobs, j)
+	}
+
+	jsonJobs, err := fs.jobs.MarshalJSON()
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(fileState{SaveTime: time.Now(), LastInit: lastJob, Jobs: jsonJobs})
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(fs.path), filepath.Base(fs.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // Fails harmlessly after successful Rename.
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), fs.path)
+}
+
+// Load implements Saver.Load
+func (fs *FileSaver) Load(ctx context.Context) (JobMap, Job, error) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	jobs, lastJob, err := fs.load()
+	if os.IsNotExist(err) {
+		fs.jobs, fs.loaded = make(JobMap, 100), true
+	}
+	if err != nil {
+		return nil, Job{}, err
+	}
+	fs.jobs, fs.loaded = make(JobMap, len(jobs)), true
+	for j, s := range jobs {
+		fs.jobs[j] = s
+	}
+	return jobs, lastJob, nil
+}
+
+// load reads and decodes the file.  Caller must hold the lock.
+func (fs *FileSaver) load() (JobMap, Job, error) {
+	data, err := ioutil.ReadFile(fs.path)
+	if err != nil {
+		return nil, Job{}, err
+	}
+	state := fileState{}
+	if err = json.Unmarshal(data, &state); err != nil {
+		return nil, Job{}, fmt.Errorf("%w: %v", ErrCorruptSnapshot, err)
+	}
+	log.Println("Last save:", state.SaveTime.Format("01/02T15:04"))
+
+	jobMap, err := decodeJobMap(state.Jobs)
+	if err != nil {
+		return nil, Job{}, err
+	}
+	return jobMap, state.LastInit, nil
+}
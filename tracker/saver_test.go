@@ -0,0 +1,254 @@
+package tracker_test
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/m-lab/go/cloudtest/dsfake"
+
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+// queryClient extends dsfake.Client with the multi-entity operations and
+// queries used by DatastoreSaver.  GetAll ignores the query, and returns
+// all entities that have a parent key.
+type queryClient struct {
+	*dsfake.Client
+}
+
+func newQueryClient() *queryClient {
+	return &queryClient{dsfake.NewClient()}
+}
+
+func (c *queryClient) PutMulti(ctx context.Context, keys []*datastore.Key, src interface{}) ([]*datastore.Key, error) {
+	v := reflect.ValueOf(src)
+	for i := range keys {
+		if _, err := c.Put(ctx, keys[i], v.Index(i).Interface()); err != nil {
+			return nil, err
+		}
+	}
+	return keys, nil
+}
+
+func (c *queryClient) DeleteMulti(ctx context.Context, keys []*datastore.Key) error {
+	for i := range keys {
+		if err := c.Delete(ctx, keys[i]); err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *queryClient) GetAll(ctx context.Context, q *datastore.Query, dst interface{}) ([]*datastore.Key, error) {
+	v := reflect.ValueOf(dst).Elem()
+	keys := []*datastore.Key{}
+	for _, k := range c.GetKeys() {
+		if k.Parent == nil {
+			continue
+		}
+		key := k
+		e := reflect.New(v.Type().Elem())
+		if err := c.Get(ctx, &key, e.Interface()); err != nil {
+			return nil, err
+		}
+		v.Set(reflect.Append(v, e.Elem()))
+		keys = append(keys, &key)
+	}
+	return keys, nil
+}
+
+// countingSaver records the jobs passed to each SaveJobs call.
+type countingSaver struct {
+	*tracker.MemorySaver
+	updated int
+	deleted int
+}
+
+func (cs *countingSaver) SaveJobs(ctx context.Context, updated tracker.JobMap, deleted []tracker.Job, lastJob tracker.Job) error {
+	cs.updated += len(updated)
+	cs.deleted += len(deleted)
+	return cs.MemorySaver.SaveJobs(ctx, updated, deleted, lastJob)
+}
+
+func testSaverRoundTrip(t *testing.T, saver tracker.Saver) {
+	ctx := context.Background()
+	tk, err := tracker.NewTracker(ctx, saver, 0, 0, 0)
+	must(t, err)
+	createJobs(t, tk, "RoundTrip", "type", 10)
+	job := tracker.NewJob("bucket", "RoundTrip", "type", startDate)
+	must(t, tk.SetStatus(job, tracker.Parsing, "foobar"))
+	_, err = tk.Sync(ctx, time.Time{})
+	must(t, err)
+
+	restore, err := tracker.NewTracker(ctx, saver, 0, 0, 0)
+	must(t, err)
+	if restore.NumJobs() != 10 {
+		t.Fatal("Incorrect number of jobs", restore.NumJobs())
+	}
+	status, err := restore.GetStatus(job)
+	must(t, err)
+	if status.State() != tracker.Parsing || status.Detail() != "foobar" {
+		t.Error("Wrong status:", status)
+	}
+	if restore.LastJob().Experiment != "RoundTrip" {
+		t.Error("Wrong last job:", restore.LastJob())
+	}
+}
+
+func TestMemorySaver(t *testing.T) {
+	testSaverRoundTrip(t, tracker.NewMemorySaver())
+}
+
+func TestFileSaver(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestFileSaver")
+	must(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "tracker.json")
+	_, _, err = tracker.NewFileSaver(path).Load(context.Background())
+	if !os.IsNotExist(err) {
+		t.Error("Expected IsNotExist:", err)
+	}
+	testSaverRoundTrip(t, tracker.NewFileSaver(path))
+
+	// Corrupt snapshots should be reported, and should not be replaced.
+	corrupt := []byte(`{"Jobs":[{"Job":{},"State":{"History":[]}}]}`)
+	must(t, ioutil.WriteFile(path, corrupt, 0644))
+	saver := tracker.NewFileSaver(path)
+	_, _, err = saver.Load(context.Background())
+	if !errors.Is(err, tracker.ErrCorruptSnapshot) {
+		t.Error("Expected ErrCorruptSnapshot:", err)
+	}
+	_, err = tracker.NewTracker(context.Background(), tracker.NewFileSaver(path), 0, 0, 0)
+	if !errors.Is(err, tracker.ErrCorruptSnapshot) {
+		t.Error("Expected ErrCorruptSnapshot:", err)
+	}
+	job := tracker.NewJob("bucket", "exp", "type", startDate)
+	err = saver.SaveJobs(context.Background(), tracker.JobMap{job: tracker.NewStatus()}, nil, job)
+	if !errors.Is(err, tracker.ErrCorruptSnapshot) {
+		t.Error("Expected ErrCorruptSnapshot:", err)
+	}
+	data, err := ioutil.ReadFile(path)
+	must(t, err)
+	if string(data) != string(corrupt) {
+		t.Error("Corrupt snapshot was replaced:", string(data))
+	}
+}
+
+func TestDatastoreSaver(t *testing.T) {
+	client := newQueryClient()
+	dsKey := datastore.NameKey("TestDatastoreSaver", "jobs", nil)
+	dsKey.Namespace = "gardener"
+	testSaverRoundTrip(t, tracker.NewDatastoreSaver(client, dsKey))
+
+	// Each job should be stored as a separate entity.
+	jobKeys := 0
+	for _, k := range client.GetKeys() {
+		if k.Parent != nil && k.Parent.Name == dsKey.Name {
+			jobKeys++
+		}
+	}
+	if jobKeys != 10 {
+		t.Error("Expected 10 job entities:", jobKeys)
+	}
+}
+
+func TestDatastoreSaver_Legacy(t *testing.T) {
+	ctx := context.Background()
+	client := newQueryClient()
+	dsKey := datastore.NameKey("TestDatastoreSaver_Legacy", "jobs", nil)
+	dsKey.Namespace = "gardener"
+
+	job := tracker.NewJob("bucket", "exp", "type", startDate)
+	jobs := tracker.JobMap{job: tracker.NewStatus()}
+	jsonJobs, err := jobs.MarshalJSON()
+	must(t, err)
+	legacy := struct {
+		SaveTime time.Time
+		LastInit tracker.Job
+		Jobs     []byte
+	}{time.Now(), job, jsonJobs}
+	_, err = client.Put(ctx, dsKey, &legacy)
+	must(t, err)
+
+	// The legacy snapshot should be loaded, and migrated on the next Sync.
+	tk, err := tracker.InitTracker(ctx, client, dsKey, 0, 0, 0)
+	must(t, err)
+	if tk.NumJobs() != 1 || tk.LastJob() != job {
+		t.Fatal("Legacy snapshot not loaded", tk.NumJobs(), tk.LastJob())
+	}
+	_, err = tk.Sync(ctx, time.Time{})
+	must(t, err)
+	must(t, client.Get(ctx, dsKey, &legacy))
+	if len(legacy.Jobs) != 0 {
+		t.Error("Legacy snapshot should be replaced", string(legacy.Jobs))
+	}
+	restore, err := tracker.InitTracker(ctx, client, dsKey, 0, 0, 0)
+	must(t, err)
+	if _, err := restore.GetStatus(job); err != nil {
+		t.Error("Migrated job not restored:", err)
+	}
+}
+
+func TestSync_Incremental(t *testing.T) {
+	ctx := context.Background()
+	saver := &countingSaver{MemorySaver: tracker.NewMemorySaver()}
+	tk, err := tracker.NewTracker(ctx, saver, 0, 0, 0)
+	must(t, err)
+	createJobs(t, tk, "Incremental", "type", 10)
+	_, err = tk.Sync(ctx, time.Time{})
+	must(t, err)
+	if saver.updated != 10 {
+		t.Error("Expected 10 updated jobs:", saver.updated)
+	}
+
+	// Nothing changed, so nothing should be saved.
+	_, err = tk.Sync(ctx, time.Time{})
+	must(t, err)
+	if saver.updated != 10 {
+		t.Error("Expected no updates:", saver.updated)
+	}
+
+	// One job updated, and one job completed and deleted.
+	must(t, tk.SetStatus(tracker.NewJob("bucket", "Incremental", "type", startDate), tracker.Parsing, ""))
+	must(t, tk.SetStatus(tracker.NewJob("bucket", "Incremental", "type", startDate.AddDate(0, 0, 1)), tracker.Complete, ""))
+	_, err = tk.Sync(ctx, time.Time{})
+	must(t, err)
+	if saver.updated != 11 || saver.deleted != 1 {
+		t.Error("Expected one update and one delete:", saver.updated, saver.deleted)
+	}
+
+	restore, err := tracker.NewTracker(ctx, saver, 0, 0, 0)
+	must(t, err)
+	if restore.NumJobs() != 9 {
+		t.Error("Incorrect number of jobs", restore.NumJobs())
+	}
+}
+
+func TestDatastoreSaver_Corrupt(t *testing.T) {
+	client := newQueryClient()
+	dsKey := datastore.NameKey("TestDatastoreSaver_Corrupt", "jobs", nil)
+	dsKey.Namespace = "gardener"
+	defer must(t, cleanup(client, dsKey))
+
+	// This has the same fields as the tracker's saved entity.
+	bad := struct {
+		SaveTime time.Time
+		LastInit tracker.Job
+		Jobs     []byte
+	}{time.Now(), tracker.Job{}, []byte("not json")}
+	_, err := client.Put(context.Background(), dsKey, &bad)
+	must(t, err)
+
+	_, _, err = tracker.NewDatastoreSaver(client, dsKey).Load(context.Background())
+	if !errors.Is(err, tracker.ErrCorruptSnapshot) {
+		t.Error("Expected ErrCorruptSnapshot:", err)
+	}
+}
@@ -5,9 +5,10 @@
 //     to get a copy or set the Status value, so there is minimal
 //     contention.
 //  2. Status objects are persisted to a Saver by a separate
-//     goroutine that periodically updates any modified Status objects.
-//     The Status's updatetime is used to determine whether it needs
-//     to be saved.
+//     goroutine that periodically saves any modified Status objects,
+//     and removes any deleted jobs.  The tracker records which jobs
+//     have changed since the last successful save.  Savers are provided
+//     for Datastore, local files, and memory.
 package tracker
 
 import (
@@ -28,8 +29,7 @@ import (
 // Tracker keeps track of all the jobs in flight.
 // Only tracker functions should access any of the fields.
 type Tracker struct {
-	client dsiface.Client
-	dsKey  *datastore.Key
+	saver  Saver
 	ticker *time.Ticker
 
 	// The lock should be held whenever accessing the jobs JobMap
@@ -40,41 +40,172 @@ type Tracker struct {
 	lastJob Job    // The last job that was added/initialized.
 	jobs    JobMap // Map from Job to Status.
 
+	// Jobs modified or deleted since the last successful save.
+	dirty   map[Job]struct{}
+	deleted map[Job]struct{}
+
 	// Time after which stale job should be ignored or replaced.
 	expirationTime time.Duration
 	// Delay before removing Complete jobs.
 	cleanupDelay time.Duration
+
+	// Optional archive for the history of finished jobs.
+	archive Archive
+
+	// Optional pipelines, keyed by experiment/datatype, that constrain
+	// the state transitions.  Protected by lock.
+	pipelines map[string]Pipeline
+	// Optional pipeline for jobs without their own.  Protected by lock.
+	defaultPipeline Pipeline
+
+	// Parser lease policy.  Leases are disabled if leaseDuration is zero.
+	// Protected by lock.
+	leaseDuration  time.Duration
+	maxLeaseLosses int
+	stopLeases     func() // Stops the lease checker, if any, and waits for it.
+
+	// The most recent Claim token.  Protected by lock.
+	claimToken int64
+
+	// Subscribers to state transitions.  Static after creation.
+	events *EventBus
+	// Optional hook for jobs that become Complete or Failed.  Protected by lock.
+	finishHook func(Event)
+}
+
+func pipelineKey(experiment, datatype string) string {
+	return experiment + "/" + datatype
 }
 
-// InitTracker recovers the Tracker state from a Client object.
+// InitTracker recovers the Tracker state from a Datastore Client object.
 // May return error if recovery fails.
 func InitTracker(
 	ctx context.Context,
 	client dsiface.Client, key *datastore.Key,
 	saveInterval time.Duration, expirationTime time.Duration, cleanupDelay time.Duration) (*Tracker, error) {
+	var saver Saver
+	if client != nil {
+		saver = NewDatastoreSaver(client, key)
+	}
+	return NewTracker(ctx, saver, saveInterval, expirationTime, cleanupDelay)
+}
 
-	jobMap, lastJob, err := loadJobMap(ctx, client, key)
-	if err != nil {
-		log.Println(err, key)
-		jobMap = make(JobMap, 100)
+// NewTracker recovers the Tracker state from a Saver, which may be nil.
+// If nothing has been saved yet, the Tracker starts with no jobs.  If the
+// saved state cannot be recovered, e.g. with ErrCorruptSnapshot, the error is
+// returned, so that the saved state is not replaced by the next save.
+func NewTracker(
+	ctx context.Context, saver Saver,
+	saveInterval time.Duration, expirationTime time.Duration, cleanupDelay time.Duration) (*Tracker, error) {
+	jobMap := make(JobMap, 100)
+	lastJob := Job{}
+	if saver != nil {
+		loaded, last, err := saver.Load(ctx)
+		switch {
+		case isNotSaved(err):
+			log.Println("No saved tracker state:", err)
+		case err != nil:
+			return nil, err
+		default:
+			jobMap, lastJob = loaded, last
+		}
 	}
+	var claimToken int64
 	for j, s := range jobMap {
 		// Update the metrics for all jobs still in flight or failed.
 		if !s.isDone() {
 			metrics.StartedCount.WithLabelValues(j.Experiment, j.Datatype).Inc()
 			metrics.TasksInFlight.WithLabelValues(j.Experiment, j.Datatype, s.Label()).Inc()
 		}
+		// Claims do not survive a restart, but their tokens must not be reused.
+		if s.Claim != 0 {
+			if s.Claim > claimToken {
+				claimToken = s.Claim
+			}
+			s.Claim = 0
+			jobMap[j] = s
+		}
 	}
 	t := Tracker{
-		client: client, dsKey: key, lastModified: time.Now(),
+		saver: saver, lastModified: time.Now(),
 		lastJob: lastJob, jobs: jobMap,
-		expirationTime: expirationTime, cleanupDelay: cleanupDelay}
-	if client != nil && saveInterval > 0 {
+		dirty: make(map[Job]struct{}, len(jobMap)), deleted: make(map[Job]struct{}),
+		expirationTime: expirationTime, cleanupDelay: cleanupDelay,
+		pipelines: make(map[string]Pipeline), claimToken: claimToken,
+		events: NewEventBus()}
+	// Save all recovered jobs once, so that state recovered from a legacy
+	// snapshot is migrated to the Saver's current format.
+	for j := range jobMap {
+		t.dirty[j] = struct{}{}
+	}
+	if saver != nil && saveInterval > 0 {
 		t.saveEvery(saveInterval)
 	}
 	return &t, nil
 }
 
+// LoadSnapshot returns a Tracker holding the state saved by another
+// Tracker, for serving read-only status.  The snapshot has no Saver, so
+// changes to it are not persisted, and it does not update metrics.
+func LoadSnapshot(ctx context.Context, saver Saver) (*Tracker, error) {
+	jobMap, lastJob, err := saver.Load(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &Tracker{
+		lastModified: time.Now(), lastJob: lastJob, jobs: jobMap,
+		dirty: make(map[Job]struct{}), deleted: make(map[Job]struct{}),
+		pipelines: make(map[string]Pipeline), events: NewEventBus()}, nil
+}
+
+// SetPipeline constrains the state transitions of all jobs with the given
+// experiment and datatype.  SetStatus will reject transitions that are not
+// allowed by the pipeline.
+func (tr *Tracker) SetPipeline(experiment, datatype string, p Pipeline) {
+	tr.lock.Lock()
+	defer tr.lock.Unlock()
+	tr.pipelines[pipelineKey(experiment, datatype)] = p
+}
+
+// SetDefaultPipeline constrains the state transitions of all jobs whose
+// experiment and datatype have no pipeline set by SetPipeline.
+func (tr *Tracker) SetDefaultPipeline(p Pipeline) {
+	tr.lock.Lock()
+	defer tr.lock.Unlock()
+	tr.defaultPipeline = p
+}
+
+// SetArchive sets the Archive to which finished jobs are appended.
+func (tr *Tracker) SetArchive(a Archive) {
+	tr.lock.Lock()
+	defer tr.lock.Unlock()
+	tr.archive = a
+}
+
+// History returns the archived jobs that match the filter.
+// Returns ErrNoArchive if the Tracker has no Archive.
+func (tr *Tracker) History(ctx context.Context, f JobFilter) ([]ArchivedJob, error) {
+	tr.lock.Lock()
+	a := tr.archive
+	tr.lock.Unlock()
+	if a == nil {
+		return nil, ErrNoArchive
+	}
+	return a.Query(ctx, f)
+}
+
+// allows checks whether the job's pipeline, or the default pipeline (if any),
+// allows the transition.
+func (tr *Tracker) allows(job Job, from, to State) bool {
+	tr.lock.Lock()
+	defer tr.lock.Unlock()
+	p, ok := tr.pipelines[pipelineKey(job.Experiment, job.Datatype)]
+	if !ok {
+		p = tr.defaultPipeline
+	}
+	return p == nil || p.Allows(from, to)
+}
+
 // NumJobs returns the number of jobs in flight.  This includes
 // jobs in "Complete" state that have not been removed from saver.
 func (tr *Tracker) NumJobs() int {
@@ -94,28 +225,74 @@ func (tr *Tracker) NumFailed() int {
 	return counts[Failed]
 }
 
-// Sync snapshots the full job state and saves it to the datastore client IFF it has changed.
+// markDirty records that a job must be saved.  Caller must hold the lock.
+func (tr *Tracker) markDirty(job Job) {
+	tr.dirty[job] = struct{}{}
+	delete(tr.deleted, job)
+}
+
+// markDeleted records that a job must be removed from the Saver.
+// Caller must hold the lock.
+func (tr *Tracker) markDeleted(job Job) {
+	delete(tr.dirty, job)
+	tr.deleted[job] = struct{}{}
+}
+
+// takeChanges returns the jobs modified and deleted since the last call,
+// and the last initialized Job.
+func (tr *Tracker) takeChanges() (JobMap, []Job, Job) {
+	tr.lock.Lock()
+	defer tr.lock.Unlock()
+	tr.removeObsolete()
+	updated := make(JobMap, len(tr.dirty))
+	for j := range tr.dirty {
+		if s, ok := tr.jobs[j]; ok {
+			updated[j] = s
+		}
+	}
+	deleted := make([]Job, 0, len(tr.deleted))
+	for j := range tr.deleted {
+		deleted = append(deleted, j)
+	}
+	tr.dirty = make(map[Job]struct{}, len(tr.dirty))
+	tr.deleted = make(map[Job]struct{}, len(tr.deleted))
+	return updated, deleted, tr.lastJob
+}
+
+// restoreChanges marks changes that failed to save, unless they have been
+// superseded since takeChanges.
+func (tr *Tracker) restoreChanges(updated JobMap, deleted []Job) {
+	tr.lock.Lock()
+	defer tr.lock.Unlock()
+	for j := range updated {
+		if _, ok := tr.deleted[j]; !ok {
+			tr.dirty[j] = struct{}{}
+		}
+	}
+	for _, j := range deleted {
+		if _, ok := tr.jobs[j]; !ok {
+			tr.deleted[j] = struct{}{}
+		}
+	}
+}
+
+// Sync saves the jobs that have changed since the last save to the Saver,
+// and removes deleted jobs.
 // Returns time last saved, which may or may not be updated.
 func (tr *Tracker) Sync(ctx context.Context, lastSave time.Time) (time.Time, error) {
-	jobs, lastInit, lastMod := tr.GetState()
-	if lastMod.Before(lastSave) {
-		logx.Debug.Println("Skipping save", lastMod, lastSave)
-		return lastSave, nil
+	if tr.saver == nil {
+		return lastSave, ErrClientIsNil
 	}
-
-	jsonJobs, err := jobs.MarshalJSON()
-	if err != nil {
-		return lastSave, err
+	updated, deleted, lastInit := tr.takeChanges()
+	if len(updated) == 0 && len(deleted) == 0 {
+		logx.Debug.Println("Skipping save", lastSave)
+		return lastSave, nil
 	}
 
-	// Save the full state.
 	lastTry := time.Now()
-	state := saverStruct{time.Now(), lastInit, jsonJobs}
-	ctx, cf := context.WithTimeout(ctx, 10*time.Second)
-	defer cf()
-	_, err = tr.client.Put(ctx, tr.dsKey, &state)
-
+	err := tr.saver.SaveJobs(ctx, updated, deleted, lastInit)
 	if err != nil {
+		tr.restoreChanges(updated, deleted)
 		return lastSave, err
 	}
 	return lastTry, nil
@@ -150,7 +327,8 @@ func (tr *Tracker) GetStatus(job Job) (Status, error) {
 	return status, nil
 }
 
-// AddJob adds a new job to the Tracker.
+// AddJob adds a new job to the Tracker.  If the Tracker has a lease policy,
+// the job is granted a new Lease.
 // May return ErrJobAlreadyExists if job already exists and is still in flight.
 func (tr *Tracker) AddJob(job Job) error {
 	status := NewStatus()
@@ -161,80 +339,198 @@ func (tr *Tracker) AddJob(job Job) error {
 	if ok {
 		if s.isDone() {
 			log.Println("Restarting completed job", job)
-		} else if s.State() == Failed {
+		} else if s.State() == Failed || s.State() == Requeued {
 			// If job didn't complete, the InFlight metric needs to be updated.
 			metrics.TasksInFlight.WithLabelValues(job.Experiment, job.Datatype, s.Label()).Dec()
-			log.Println("Restarting failed job", job)
+			log.Println("Restarting", s.State(), "job", job)
+			if s.State() == Requeued {
+				// Keep counting lease losses until the job is Failed.
+				status.LeaseLosses = s.LeaseLosses
+			}
 		} else {
 			return ErrJobAlreadyExists
 		}
 	}
+	if tr.leaseDuration > 0 {
+		status.Lease = Lease{ID: newLeaseID(), Deadline: time.Now().Add(tr.leaseDuration)}
+	}
 
 	tr.lastJob = job
 	tr.lastModified = time.Now()
+	tr.markDirty(job)
 	metrics.StartedCount.WithLabelValues(job.Experiment, job.Datatype).Inc()
 	tr.jobs[job] = status
 	status.updateMetrics(job)
+	tr.events.Publish(Event{Job: job, NewState: status.State(), Time: time.Now(), Started: status.StartTime()})
 	return nil
 }
 
 // UpdateJob updates an existing job.
-// May return ErrJobNotFound if job no longer exists.
+// May return ErrJobNotFound if job no longer exists, ErrJobIsObsolete
+// if the job was cancelled or skipped by an operator, or ErrStaleLease if
+// the job was requeued after its lease expired.
+// When a job becomes Complete or Failed, its history is appended
+// to the Archive, if any.  State transitions are published to subscribers.
 func (tr *Tracker) UpdateJob(job Job, new Status) error {
+	return tr.update(job, new, checkUpdate)
+}
+
+// update updates an existing job, and archives it if it has just finished.
+// If check is not nil, it is applied to the old Status while holding the
+// lock, and the update is rejected if it returns an error.  Operator actions
+// use a nil check, so that they may override cancelled jobs.
+func (tr *Tracker) update(job Job, new Status, check func(old *Status) error) error {
+	a, err := tr.updateJob(job, new, check)
+	if err != nil || a == nil {
+		return err
+	}
+	// The archive may be slow, so it is not called while holding the lock.
+	if err := a.Append(context.Background(), job, new); err != nil {
+		metrics.WarningCount.WithLabelValues(job.Experiment, job.Datatype, "ArchiveError").Inc()
+		log.Println(job, "archive error:", err)
+	}
+	return nil
+}
+
+// updateJob updates an existing job, and returns the Archive if the job
+// has just finished.  Transitions are published while holding the lock, so
+// that subscribers see each job's transitions in order.
+func (tr *Tracker) updateJob(job Job, new Status, check func(old *Status) error) (Archive, error) {
 	tr.lock.Lock()
 	defer tr.lock.Unlock()
 	old, ok := tr.jobs[job]
 	if !ok {
-		return ErrJobNotFound
+		return nil, ErrJobNotFound
+	}
+	if check != nil {
+		if err := check(&old); err != nil {
+			return nil, err
+		}
+		// Claims are only changed by ClaimJob and ReleaseClaim.
+		new.Claim = old.Claim
+	} else {
+		// Operator actions revoke any claim.
+		new.Claim = 0
 	}
 
+	var archive Archive
 	if old.State() != new.State() {
 		log.Println(job, old.LastStateInfo(), "->", new.State())
 		new.updateMetrics(job)
+		e := Event{Job: job, OldState: old.State(), NewState: new.State(),
+			Detail: new.Detail(), Time: time.Now(), Started: new.StartTime()}
+		tr.events.Publish(e)
+		if tr.finishHook != nil && (e.NewState == Complete || e.NewState == Failed) {
+			tr.finishHook(e)
+		}
+		if new.isDone() || new.State() == Failed {
+			archive = tr.archive
+		}
 	}
 
 	tr.lastModified = time.Now()
 	// When jobs are done, we update stats and may remove them from tracker.
 	if new.isDone() {
-		metrics.CompletedCount.WithLabelValues(job.Experiment, job.Datatype).Inc()
+		if new.State() == Complete {
+			metrics.CompletedCount.WithLabelValues(job.Experiment, job.Datatype).Inc()
+		}
 
 		// This could be done by GetStatus, but would change behaviors slightly.
 		if tr.cleanupDelay == 0 {
 			delete(tr.jobs, job)
-			return nil
+			tr.markDeleted(job)
+			return archive, nil
 		}
 	}
 	tr.jobs[job] = new
-	return nil
+	tr.markDirty(job)
+	return archive, nil
 }
 
 // SetDetail updates a job's detail message in memory.
 func (tr *Tracker) SetDetail(job Job, detail string) error {
+	return tr.SetClaimedDetail(Claim{Job: job}, detail)
+}
+
+// SetClaimedDetail is like SetDetail, but returns ErrStaleClaim unless the
+// job is still held by the claim.
+func (tr *Tracker) SetClaimedDetail(c Claim, detail string) error {
 	// NOTE: This is not a deep copy.  Shares the History elements.
-	status, err := tr.GetStatus(job)
+	status, err := tr.GetStatus(c.Job)
 	if err != nil {
 		return err
 	}
 	status.SetDetail(detail)
 	status.UpdateCount++
-	return tr.UpdateJob(job, status)
+	return tr.update(c.Job, status, checkClaim(c.Token))
+}
+
+// RecordAttempt counts a failed attempt to process a job in its current
+// state, and updates the detail message.  It returns the updated Status.
+func (tr *Tracker) RecordAttempt(job Job, detail string) (Status, error) {
+	return tr.RecordClaimedAttempt(Claim{Job: job}, detail)
+}
+
+// RecordClaimedAttempt is like RecordAttempt, but returns ErrStaleClaim
+// unless the job is still held by the claim.
+func (tr *Tracker) RecordClaimedAttempt(c Claim, detail string) (Status, error) {
+	status, err := tr.GetStatus(c.Job)
+	if err != nil {
+		return status, err
+	}
+	status.SetDetail(detail)
+	status.Attempts++
+	status.UpdateCount++
+	return status, tr.update(c.Job, status, checkClaim(c.Token))
 }
 
 // SetStatus updates a job's state in memory.
 // It may or may not change the job state.  If it does change state,
 // the detail string is applied to the last state, not the new state.
+// Returns ErrInvalidStateTransition if the job's pipeline does not allow
+// the transition, or ErrJobIsObsolete if the job was cancelled or skipped.
 func (tr *Tracker) SetStatus(job Job, state State, detail string) error {
+	return tr.setStatus(job, state, detail, checkUpdate)
+}
+
+// SetLeasedStatus is like SetStatus, but returns ErrStaleLease unless the
+// job is leased with leaseID.  The lease is released when the job leaves
+// the parser's states.
+func (tr *Tracker) SetLeasedStatus(job Job, leaseID string, state State, detail string) error {
+	return tr.setStatus(job, state, detail, checkLease(leaseID))
+}
+
+// SetClaimedStatus is like SetStatus, but returns ErrStaleClaim unless the
+// job is still held by the claim.  The claim is kept until it is released.
+func (tr *Tracker) SetClaimedStatus(c Claim, state State, detail string) error {
+	return tr.setStatus(c.Job, state, detail, checkClaim(c.Token))
+}
+
+// setStatus updates a job's state, if check accepts the job's Status both
+// before and after the transition is validated.
+func (tr *Tracker) setStatus(job Job, state State, detail string, check func(old *Status) error) error {
 	// NOTE: This is not a deep copy.  Shares the History elements.
 	status, err := tr.GetStatus(job)
 	if err != nil {
 		metrics.WarningCount.WithLabelValues(job.Experiment, job.Datatype, "NoSuchJob").Inc()
 		return err
 	}
+	if err := check(&status); err != nil {
+		return err
+	}
 	last := status.LastStateInfo()
+	if !tr.allows(job, last.State, state) {
+		metrics.WarningCount.WithLabelValues(job.Experiment, job.Datatype, "InvalidStateTransition").Inc()
+		log.Println(job, ErrInvalidStateTransition, last.State, "->", state)
+		return ErrInvalidStateTransition
+	}
 	status.SetDetail(detail)
 
 	if state != last.State {
 		status.NewState(state)
+		if !leased(state) {
+			status.Lease = Lease{}
+		}
 
 		if state == ParseComplete {
 			// TODO enable this once we have file or byte counts.
@@ -245,21 +541,77 @@ func (tr *Tracker) SetStatus(job Job, state State, detail string) error {
 		}
 	}
 	status.UpdateCount++
-	return tr.UpdateJob(job, status)
+	return tr.update(job, status, check)
+}
+
+// ResetJob moves a job to the given state, e.g. a Failed job back to Loading,
+// regardless of its pipeline.  The operator's reason is recorded in the new
+// state's detail.  Returns ErrInvalidStateTransition if the state is not a
+// processing state.
+func (tr *Tracker) ResetJob(job Job, state State, reason string) error {
+	if !resettable[state] {
+		return ErrInvalidStateTransition
+	}
+	return tr.operatorUpdate(job, state, "reset", reason)
+}
+
+// CancelJob cancels a job in flight.  Further updates to the job are rejected
+// with ErrJobIsObsolete, until the job is reset or restarted with AddJob.
+func (tr *Tracker) CancelJob(job Job, reason string) error {
+	return tr.operatorUpdate(job, Cancelled, "cancelled", reason)
+}
+
+// SkipJob marks a job as skipped.  It is otherwise handled like CancelJob.
+func (tr *Tracker) SkipJob(job Job, reason string) error {
+	return tr.operatorUpdate(job, Skipped, "skipped", reason)
+}
+
+// operatorUpdate moves a job to a new state, overriding any pipeline
+// constraints, and records the action and reason in the job's History.
+func (tr *Tracker) operatorUpdate(job Job, state State, action string, reason string) error {
+	status, err := tr.GetStatus(job)
+	if err != nil {
+		return err
+	}
+	log.Println(job, "operator", action, "from", status.State(), "to", state, ":", reason)
+	status.NewState(state)
+	status.SetDetail(fmt.Sprintf("%s by operator: %s", action, reason))
+	status.UpdateCount++
+	// The parser, if any, no longer owns the job.
+	status.Lease = Lease{}
+	return tr.update(job, status, nil)
 }
 
-// Heartbeat updates a job's heartbeat time.
+// Heartbeat updates a job's heartbeat time, and extends its lease, if any.
 func (tr *Tracker) Heartbeat(job Job) error {
+	return tr.LeasedHeartbeat(job, "")
+}
+
+// LeasedHeartbeat is like Heartbeat, but returns ErrStaleLease unless the
+// job is leased with leaseID.
+func (tr *Tracker) LeasedHeartbeat(job Job, leaseID string) error {
 	status, err := tr.GetStatus(job)
 	if err != nil {
 		return err
 	}
 	status.HeartbeatTime = time.Now()
-	return tr.UpdateJob(job, status)
+	if status.Lease.ID != "" {
+		tr.lock.Lock()
+		status.Lease.Deadline = status.HeartbeatTime.Add(tr.leaseDuration)
+		tr.lock.Unlock()
+	}
+	return tr.update(job, status, checkLease(leaseID))
 }
 
 // SetJobError updates a job's error fields, and handles persistence.
 func (tr *Tracker) SetJobError(job Job, errString string) error {
+	return tr.SetClaimedJobError(Claim{Job: job}, errString)
+}
+
+// SetClaimedJobError is like SetJobError, but returns ErrStaleClaim unless
+// the job is still held by the claim.
+func (tr *Tracker) SetClaimedJobError(c Claim, errString string) error {
+	job := c.Job
 	status, err := tr.GetStatus(job)
 	if err != nil {
 		return err
@@ -267,10 +619,11 @@ func (tr *Tracker) SetJobError(job Job, errString string) error {
 	oldState := status.State()
 	job.failureMetric(oldState, errString)
 	status.NewState(Failed)
+	status.Lease = Lease{}
 	// Set the final detail to include the prior state and error message.
 	status.SetDetail(fmt.Sprintf("%s: %s", oldState, errString))
 
-	return tr.UpdateJob(job, status)
+	return tr.update(job, status, checkClaim(c.Token))
 }
 
 // GetState returns the full job map, last initialized Job, and last mod time.
@@ -278,9 +631,18 @@ func (tr *Tracker) SetJobError(job Job, errString string) error {
 func (tr *Tracker) GetState() (JobMap, Job, time.Time) {
 	tr.lock.Lock()
 	defer tr.lock.Unlock()
+	tr.removeObsolete()
 	m := make(JobMap, len(tr.jobs))
 	for j, s := range tr.jobs {
-		// Remove any obsolete jobs.
+		m[j] = s
+	}
+	return m, tr.lastJob, tr.lastModified
+}
+
+// removeObsolete removes expired jobs, and Complete jobs older than the
+// cleanupDelay.  Caller must hold the lock.
+func (tr *Tracker) removeObsolete() {
+	for j, s := range tr.jobs {
 		updateTime := s.DetailTime()
 		if (tr.expirationTime > 0 && time.Since(updateTime) > tr.expirationTime) ||
 			(s.isDone() && time.Since(updateTime) > tr.cleanupDelay) {
@@ -291,11 +653,29 @@ func (tr *Tracker) GetState() (JobMap, Job, time.Time) {
 			}
 			tr.lastModified = time.Now()
 			delete(tr.jobs, j)
-		} else {
-			m[j] = s
+			tr.markDeleted(j)
 		}
 	}
-	return m, tr.lastJob, tr.lastModified
+}
+
+// Jobs returns the jobs that match the filter.
+func (tr *Tracker) Jobs(f JobFilter) JobMap {
+	jobs, _, _ := tr.GetState()
+	for j, s := range jobs {
+		if !f.Matches(j, s) {
+			delete(jobs, j)
+		}
+	}
+	return jobs
+}
+
+// Summary returns the number of jobs that match the filter in each state.
+func (tr *Tracker) Summary(f JobFilter) map[State]int {
+	counts := make(map[State]int, 20)
+	for _, s := range tr.Jobs(f) {
+		counts[s.State()]++
+	}
+	return counts
 }
 
 // WriteHTMLStatusTo writes out the status of all jobs to the html writer.
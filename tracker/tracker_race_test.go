@@ -13,7 +13,6 @@ import (
 
 	"cloud.google.com/go/datastore"
 	"github.com/m-lab/etl-gardener/tracker"
-	"github.com/m-lab/go/cloudtest/dsfake"
 )
 
 func TestConcurrentUpdates(t *testing.T) {
@@ -27,7 +26,7 @@ func TestConcurrentUpdates(t *testing.T) {
 
 	ctx := context.Background()
 
-	client := dsfake.NewClient()
+	client := newQueryClient()
 	dsKey := datastore.NameKey("TestConcurrentUpdates", "jobs", nil)
 	dsKey.Namespace = "gardener"
 	defer must(t, cleanup(client, dsKey))
@@ -11,7 +11,6 @@ import (
 	"cloud.google.com/go/datastore"
 	"github.com/googleapis/google-cloud-go-testing/datastore/dsiface"
 
-	"github.com/m-lab/go/cloudtest/dsfake"
 	"github.com/m-lab/go/logx"
 
 	"github.com/m-lab/etl-gardener/tracker"
@@ -73,7 +72,7 @@ func cleanup(client dsiface.Client, key *datastore.Key) error {
 	defer cf()
 	err := client.Delete(ctx, key)
 	if err != nil && err != datastore.ErrNoSuchEntity {
-		tc, ok := client.(*dsfake.Client)
+		tc, ok := client.(*queryClient)
 		if ok {
 			keys := tc.GetKeys()
 			log.Println(keys)
@@ -98,7 +97,7 @@ func TestTrackerAddDelete(t *testing.T) {
 	ctx := context.Background()
 	logx.LogxDebug.Set("true")
 
-	client := dsfake.NewClient()
+	client := newQueryClient()
 	dsKey := datastore.NameKey("TestTrackerAddDelete", "jobs", nil)
 	dsKey.Namespace = "gardener"
 	defer must(t, cleanup(client, dsKey))
@@ -166,7 +165,7 @@ func TestTrackerAddDelete(t *testing.T) {
 }
 
 func TestUpdates(t *testing.T) {
-	client := dsfake.NewClient()
+	client := newQueryClient()
 	dsKey := datastore.NameKey("TestUpdate", "jobs", nil)
 	dsKey.Namespace = "gardener"
 	defer must(t, cleanup(client, dsKey))
@@ -208,10 +207,37 @@ func TestUpdates(t *testing.T) {
 	}
 }
 
+func TestSetPipeline(t *testing.T) {
+	tk, err := tracker.InitTracker(context.Background(), nil, nil, 0, 0, time.Minute)
+	must(t, err)
+	tk.SetPipeline("exp", "annotation", tracker.Pipeline{
+		tracker.Init, tracker.Parsing, tracker.ParseComplete, tracker.Loading, tracker.Complete})
+
+	ann := tracker.NewJob("bucket", "exp", "annotation", startDate)
+	other := tracker.NewJob("bucket", "exp", "other", startDate)
+	must(t, tk.AddJob(ann))
+	must(t, tk.AddJob(other))
+
+	must(t, tk.SetStatus(ann, tracker.Loading, ""))
+	if err := tk.SetStatus(ann, tracker.Joining, ""); err != tracker.ErrInvalidStateTransition {
+		t.Error("Should be ErrInvalidStateTransition", err)
+	}
+	status, err := tk.GetStatus(ann)
+	must(t, err)
+	if status.State() != tracker.Loading {
+		t.Error("State should be unchanged:", status)
+	}
+	must(t, tk.SetStatus(ann, tracker.Complete, ""))
+
+	// Jobs without a pipeline are not constrained.
+	must(t, tk.SetStatus(other, tracker.Joining, ""))
+	must(t, tk.SetStatus(other, tracker.Loading, ""))
+}
+
 // This tests whether AddJob and SetStatus generate appropriate
 // errors when job doesn't exist.
 func TestNonexistentJobAccess(t *testing.T) {
-	client := dsfake.NewClient()
+	client := newQueryClient()
 	dsKey := datastore.NameKey("TestNonexistentJobAccess", "jobs", nil)
 	dsKey.Namespace = "gardener"
 	defer must(t, cleanup(client, dsKey))
@@ -266,7 +292,7 @@ func TestJobMapHTML(t *testing.T) {
 }
 
 func TestExpiration(t *testing.T) {
-	client := dsfake.NewClient()
+	client := newQueryClient()
 	dsKey := datastore.NameKey("TestExpiration", "jobs", nil)
 	dsKey.Namespace = "gardener"
 	defer must(t, cleanup(client, dsKey))
@@ -293,3 +319,26 @@ func TestExpiration(t *testing.T) {
 	// Job should have been removed by saveEvery, so this should succeed.
 	must(t, tk.AddJob(job))
 }
+
+func TestOperatorActions(t *testing.T) {
+	tk, err := tracker.NewTracker(context.Background(), nil, 0, 0, time.Minute)
+	must(t, err)
+	job := tracker.NewJob("bucket", "exp", "type", startDate)
+	if err := tk.CancelJob(job, "reason"); err != tracker.ErrJobNotFound {
+		t.Error("Expected ErrJobNotFound:", err)
+	}
+	must(t, tk.AddJob(job))
+	if err := tk.ResetJob(job, tracker.Failed, "reason"); err != tracker.ErrInvalidStateTransition {
+		t.Error("Expected ErrInvalidStateTransition:", err)
+	}
+	must(t, tk.CancelJob(job, "reason"))
+	if err := tk.SetStatus(job, tracker.Parsing, ""); err != tracker.ErrJobIsObsolete {
+		t.Error("Expected ErrJobIsObsolete:", err)
+	}
+	if err := tk.SetJobError(job, "error"); err != tracker.ErrJobIsObsolete {
+		t.Error("Expected ErrJobIsObsolete:", err)
+	}
+	// An operator may reset a cancelled job.
+	must(t, tk.ResetJob(job, tracker.Parsing, "try again"))
+	must(t, tk.SetStatus(job, tracker.ParseComplete, ""))
+}